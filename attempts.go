@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AttemptPolicy tells how failed attempts of one key are throttled. After FreeAttempts
+// failures every next failure locks key for BaseLockout doubled each time up to MaxLockout.
+// Failures are forgotten after Window without new ones
+type AttemptPolicy struct {
+	FreeAttempts int
+	BaseLockout  time.Duration
+	MaxLockout   time.Duration
+	Window       time.Duration
+}
+
+// fail counts failed attempt in record and locks it if needed
+func (ap AttemptPolicy) fail(record *LoginAttemptModel, now time.Time) {
+	if now.Sub(record.LastFailureAt) > ap.Window {
+		record.Failures = 0
+	}
+	record.Failures++
+	record.LastFailureAt = now
+
+	excess := record.Failures - ap.FreeAttempts
+	if excess <= 0 {
+		return
+	}
+	lockout := ap.BaseLockout
+	for i := 1; i < excess && lockout < ap.MaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > ap.MaxLockout {
+		lockout = ap.MaxLockout
+	}
+	record.LockedUntil = now.Add(lockout)
+}
+
+// AttemptStore keeps failed attempts by key, like "user:bob" or "ip:10.0.0.1"
+type AttemptStore interface {
+	// Reserve atomically counts attempt as failed unless key is locked, and returns
+	// updated record and whether key is locked. Nothing is counted on locked key
+	Reserve(key string, now time.Time, policy AttemptPolicy) (*LoginAttemptModel, bool, error)
+	// Refund takes back one reserved attempt, lock it has caused stays
+	Refund(key string) error
+	Reset(key string) error
+	// Locked returns records locked at the moment
+	Locked(now time.Time) ([]LoginAttemptModel, error)
+	// Prune drops records without failures since before and not locked anymore
+	Prune(before time.Time, now time.Time) (int64, error)
+}
+
+// memoryAttemptStore is for single replica deployments, records are lost on restart
+type memoryAttemptStore struct {
+	mu      sync.Mutex
+	records map[string]LoginAttemptModel
+}
+
+func NewMemoryAttemptStore() AttemptStore {
+	return &memoryAttemptStore{records: map[string]LoginAttemptModel{}}
+}
+
+func (mas *memoryAttemptStore) Reserve(key string, now time.Time, policy AttemptPolicy) (*LoginAttemptModel, bool, error) {
+	mas.mu.Lock()
+	defer mas.mu.Unlock()
+	record := mas.records[key]
+	record.AttemptKey = key
+	if record.LockedUntil.After(now) {
+		return &record, true, nil
+	}
+	policy.fail(&record, now)
+	mas.records[key] = record
+	return &record, false, nil
+}
+
+func (mas *memoryAttemptStore) Refund(key string) error {
+	mas.mu.Lock()
+	defer mas.mu.Unlock()
+	if record, ok := mas.records[key]; ok && record.Failures > 0 {
+		record.Failures--
+		mas.records[key] = record
+	}
+	return nil
+}
+
+func (mas *memoryAttemptStore) Reset(key string) error {
+	mas.mu.Lock()
+	defer mas.mu.Unlock()
+	delete(mas.records, key)
+	return nil
+}
+
+func (mas *memoryAttemptStore) Locked(now time.Time) ([]LoginAttemptModel, error) {
+	mas.mu.Lock()
+	defer mas.mu.Unlock()
+	var locked []LoginAttemptModel
+	for _, record := range mas.records {
+		if record.LockedUntil.After(now) {
+			locked = append(locked, record)
+		}
+	}
+	return locked, nil
+}
+
+func (mas *memoryAttemptStore) Prune(before time.Time, now time.Time) (int64, error) {
+	mas.mu.Lock()
+	defer mas.mu.Unlock()
+	var pruned int64
+	for key, record := range mas.records {
+		if record.LastFailureAt.Before(before) && !record.LockedUntil.After(now) {
+			delete(mas.records, key)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// dbAttemptStore keeps records in login_attempt_models table, shared by replicas
+type dbAttemptStore struct {
+	dbe *DBEngine
+}
+
+func NewDBAttemptStore(dbe *DBEngine) AttemptStore {
+	return &dbAttemptStore{dbe: dbe}
+}
+
+func (das *dbAttemptStore) Reserve(key string, now time.Time, policy AttemptPolicy) (*LoginAttemptModel, bool, error) {
+	locked := false
+	record, err := das.dbe.UpdateLoginAttempt(key, func(record *LoginAttemptModel) {
+		if locked = record.LockedUntil.After(now); !locked {
+			policy.fail(record, now)
+		}
+	})
+	return record, locked, err
+}
+
+func (das *dbAttemptStore) Refund(key string) error {
+	return das.dbe.RefundLoginAttempt(key)
+}
+
+func (das *dbAttemptStore) Reset(key string) error {
+	return das.dbe.DeleteLoginAttempt(key)
+}
+
+func (das *dbAttemptStore) Locked(now time.Time) ([]LoginAttemptModel, error) {
+	return das.dbe.GetLockedLoginAttempts(now)
+}
+
+func (das *dbAttemptStore) Prune(before time.Time, now time.Time) (int64, error) {
+	return das.dbe.PruneLoginAttempts(before, now)
+}
+
+func NewAttemptStore(kind string, dbe *DBEngine) (AttemptStore, error) {
+	switch strings.ToLower(kind) {
+	case "memory":
+		return NewMemoryAttemptStore(), nil
+	case "postgres":
+		return NewDBAttemptStore(dbe), nil
+	default:
+		return nil, fmt.Errorf("unknown attempt store %q", kind)
+	}
+}
+
+// AttemptTracker throttles credential guessing per account and per client ip.
+// Ip policy is usually looser, since many users may share one address
+type AttemptTracker struct {
+	store   AttemptStore
+	account AttemptPolicy
+	ip      AttemptPolicy
+}
+
+func NewAttemptTracker(store AttemptStore, account AttemptPolicy, ip AttemptPolicy) *AttemptTracker {
+	return &AttemptTracker{store: store, account: account, ip: ip}
+}
+
+// Keys of throttled accounts, usernames are case insensitive
+func userAttemptKey(username string) string {
+	return "user:" + strings.ToLower(username)
+}
+
+func serviceAttemptKey(name string) string {
+	return "service:" + name
+}
+
+func ipAttemptKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Reserve counts attempt on account from ip as failed before credentials are checked,
+// so that a burst of parallel guesses can't pass the lock check all at once.
+// It returns how long caller has to wait if account or ip is locked, then nothing is counted
+func (at *AttemptTracker) Reserve(account string, ip string) (time.Duration, error) {
+	now := time.Now()
+	record, locked, err := at.store.Reserve(account, now, at.account)
+	if err != nil {
+		return 0, err
+	}
+	if locked {
+		return record.LockedUntil.Sub(now), nil
+	}
+	record, locked, err = at.store.Reserve(ipAttemptKey(ip), now, at.ip)
+	if err == nil && !locked {
+		return 0, nil
+	}
+	// account attempt is not made after all
+	if refundErr := at.store.Refund(account); refundErr != nil {
+		return 0, refundErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return record.LockedUntil.Sub(now), nil
+}
+
+// Succeed forgets failures of account and takes back reserved attempt of ip.
+// Other failures of ip stay, or one valid account would let attacker reset
+// ip counter between guesses
+func (at *AttemptTracker) Succeed(account string, ip string) error {
+	if err := at.store.Reset(account); err != nil {
+		return err
+	}
+	return at.store.Refund(ipAttemptKey(ip))
+}
+
+// Refund takes back reserved attempt which was neither failed nor succeeded,
+// like when credentials couldn't be checked
+func (at *AttemptTracker) Refund(account string, ip string) error {
+	if err := at.store.Refund(account); err != nil {
+		return err
+	}
+	return at.store.Refund(ipAttemptKey(ip))
+}
+
+// Unlock forgets failures of key, it is used by admins
+func (at *AttemptTracker) Unlock(key string) error {
+	return at.store.Reset(key)
+}
+
+func (at *AttemptTracker) Locked() ([]LoginAttemptModel, error) {
+	return at.store.Locked(time.Now())
+}
+
+// Run periodically prunes records older than the longest window,
+// it is meant to be run in its own goroutine
+func (at *AttemptTracker) Run(interval time.Duration) {
+	window := at.account.Window
+	if at.ip.Window > window {
+		window = at.ip.Window
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		pruned, err := at.store.Prune(now.Add(-window), now)
+		if err != nil {
+			log.Printf("can't prune login attempts: %s", err)
+			continue
+		}
+		if pruned > 0 {
+			log.Printf("pruned %d login attempts", pruned)
+		}
+	}
+}
+
+// reserveAttempt counts attempt on account as failed until succeededAttempt or refundAttempt,
+// attempt on locked account or from locked ip is rejected with 429.
+// Tracker failures are logged and let attempt through, so that sign-in keeps working
+func (s *Server) reserveAttempt(c *fiber.Ctx, account string) error {
+	wait, err := s.attempts.Reserve(account, s.clientIP(c))
+	if err != nil {
+		log.Printf("can't check login attempts of %s: %s", account, err)
+		return nil
+	}
+	if wait <= 0 {
+		return nil
+	}
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(wait/time.Second)+1))
+	return apiError(codeTooManyAttempts, "too many failed attempts, try again later")
+}
+
+func (s *Server) succeededAttempt(c *fiber.Ctx, account string) {
+	if err := s.attempts.Succeed(account, s.clientIP(c)); err != nil {
+		log.Printf("can't reset attempts of %s: %s", account, err)
+	}
+}
+
+func (s *Server) refundAttempt(c *fiber.Ctx, account string) {
+	if err := s.attempts.Refund(account, s.clientIP(c)); err != nil {
+		log.Printf("can't refund attempt of %s: %s", account, err)
+	}
+}
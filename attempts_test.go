@@ -0,0 +1,156 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var testAttemptPolicy = AttemptPolicy{
+	FreeAttempts: 3,
+	BaseLockout:  time.Minute,
+	MaxLockout:   10 * time.Minute,
+	Window:       time.Hour,
+}
+
+func TestAttemptPolicyBackoff(t *testing.T) {
+	// lockouts after each of consecutive failures
+	want := []time.Duration{
+		0, 0, 0,
+		time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute,
+		10 * time.Minute, 10 * time.Minute,
+	}
+	now := time.Now()
+	var record LoginAttemptModel
+	for i, lockout := range want {
+		testAttemptPolicy.fail(&record, now)
+		if record.Failures != i+1 {
+			t.Fatalf("failure %d is counted as %d", i+1, record.Failures)
+		}
+		if lockout == 0 {
+			if record.LockedUntil.After(now) {
+				t.Errorf("free failure %d locks until %s", i+1, record.LockedUntil)
+			}
+			continue
+		}
+		if got := record.LockedUntil.Sub(now); got != lockout {
+			t.Errorf("failure %d locks for %s, want %s", i+1, got, lockout)
+		}
+	}
+}
+
+func TestAttemptPolicyWindow(t *testing.T) {
+	now := time.Now()
+	var record LoginAttemptModel
+	for i := 0; i < testAttemptPolicy.FreeAttempts; i++ {
+		testAttemptPolicy.fail(&record, now)
+	}
+
+	// failure within window is not free anymore
+	within := record
+	testAttemptPolicy.fail(&within, now.Add(testAttemptPolicy.Window))
+	if within.Failures != 4 || !within.LockedUntil.After(now.Add(testAttemptPolicy.Window)) {
+		t.Errorf("failure within window has %d failures, locked until %s", within.Failures, within.LockedUntil)
+	}
+
+	// failures behind window are forgotten
+	later := now.Add(testAttemptPolicy.Window + time.Second)
+	testAttemptPolicy.fail(&record, later)
+	if record.Failures != 1 || record.LockedUntil.After(later) {
+		t.Errorf("failure behind window has %d failures, locked until %s", record.Failures, record.LockedUntil)
+	}
+}
+
+func TestMemoryAttemptStore(t *testing.T) {
+	store := NewMemoryAttemptStore()
+	policy := AttemptPolicy{FreeAttempts: 1, BaseLockout: time.Minute, MaxLockout: time.Minute, Window: time.Hour}
+	now := time.Now()
+
+	if _, locked, _ := store.Reserve("user:bob", now, policy); locked {
+		t.Fatalf("free attempt is locked")
+	}
+	record, locked, _ := store.Reserve("user:bob", now, policy)
+	if locked || record.Failures != 2 {
+		t.Fatalf("second attempt locked %t with %d failures", locked, record.Failures)
+	}
+	// nothing is counted on locked key
+	record, locked, _ = store.Reserve("user:bob", now.Add(time.Second), policy)
+	if !locked || record.Failures != 2 {
+		t.Errorf("attempt on locked key locked %t with %d failures", locked, record.Failures)
+	}
+	if records, _ := store.Locked(now); len(records) != 1 || records[0].AttemptKey != "user:bob" {
+		t.Errorf("locked records %v, want user:bob", records)
+	}
+
+	// refund keeps lock it has caused
+	if err := store.Refund("user:bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, locked, _ := store.Reserve("user:bob", now.Add(time.Second), policy); !locked {
+		t.Errorf("refund unlocks key")
+	}
+	record, locked, _ = store.Reserve("user:bob", now.Add(2*time.Minute), policy)
+	if locked || record.Failures != 2 {
+		t.Errorf("attempt after lockout locked %t with %d failures, want 2", locked, record.Failures)
+	}
+
+	if err := store.Reset("user:bob"); err != nil {
+		t.Fatal(err)
+	}
+	if record, locked, _ := store.Reserve("user:bob", now.Add(2*time.Minute), policy); locked || record.Failures != 1 {
+		t.Errorf("attempt after reset locked %t with %d failures, want 1", locked, record.Failures)
+	}
+}
+
+func TestMemoryAttemptStorePrune(t *testing.T) {
+	store := NewMemoryAttemptStore()
+	policy := AttemptPolicy{FreeAttempts: 0, BaseLockout: time.Hour, MaxLockout: time.Hour, Window: time.Hour}
+	now := time.Now()
+	store.Reserve("ip:10.0.0.1", now.Add(-2*time.Hour), policy)
+	store.Reserve("ip:10.0.0.2", now.Add(-30*time.Minute), policy)
+	store.Reserve("ip:10.0.0.3", now.Add(-10*time.Minute), AttemptPolicy{FreeAttempts: 1, Window: time.Hour})
+
+	// old and unlocked goes, locked and recent stay
+	pruned, err := store.Prune(now.Add(-15*time.Minute), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 1 {
+		t.Errorf("pruned %d records, want 1", pruned)
+	}
+	if records, _ := store.Locked(now); len(records) != 1 || records[0].AttemptKey != "ip:10.0.0.2" {
+		t.Errorf("locked records %v, want ip:10.0.0.2", records)
+	}
+}
+
+func TestAttemptTrackerReserve(t *testing.T) {
+	store := NewMemoryAttemptStore()
+	account := AttemptPolicy{FreeAttempts: 5, BaseLockout: time.Minute, MaxLockout: time.Hour, Window: time.Hour}
+	ip := AttemptPolicy{FreeAttempts: 1, BaseLockout: time.Minute, MaxLockout: time.Hour, Window: time.Hour}
+	at := NewAttemptTracker(store, account, ip)
+	bob := userAttemptKey("Bob")
+
+	for i := 0; i < 2; i++ {
+		if wait, err := at.Reserve(bob, "10.0.0.1"); err != nil || wait > 0 {
+			t.Fatalf("attempt %d waits %s: %v", i+1, wait, err)
+		}
+	}
+	// locked ip rejects attempt and takes back the account one
+	wait, err := at.Reserve(bob, "10.0.0.1")
+	if err != nil || wait <= 0 {
+		t.Fatalf("attempt from locked ip waits %s: %v", wait, err)
+	}
+	if record, _, _ := store.Reserve(bob, time.Now(), account); record.Failures != 3 {
+		t.Errorf("account has %d failures, want 2", record.Failures-1)
+	}
+
+	// success resets account but not failures of ip
+	if err := at.Succeed(bob, "10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if record, _, _ := store.Reserve(bob, time.Now(), account); record.Failures != 1 {
+		t.Errorf("account has %d failures after success, want 0", record.Failures-1)
+	}
+	if wait, _ := at.Reserve(userAttemptKey("alice"), "10.0.0.1"); wait <= 0 {
+		t.Errorf("success of other ip unlocks ip")
+	}
+}
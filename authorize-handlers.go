@@ -0,0 +1,526 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt"
+	"gorm.io/gorm"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Authorization flow keeps its state in signed tokens passed through html forms
+const (
+	tokenUseAuthorizeLogin   = "authorize_login"
+	tokenUseAuthorizeMfa     = "authorize_mfa"
+	tokenUseAuthorizeConsent = "authorize_consent"
+)
+
+const (
+	authorizeFlowTTL       = time.Minute * 10
+	authorizationCodeTTL   = time.Minute
+	authorizePath          = "/oauth/authorize"
+	authorizeMfaPath       = "/oauth/authorize/mfa"
+	authorizeConsentPath   = "/oauth/authorize/consent"
+	securityEventCodeReuse = "authorization_code_reuse"
+)
+
+// AuthorizeClaims carry validated authorization request between
+// login and consent pages, and authenticated user after login
+type AuthorizeClaims struct {
+	*jwt.StandardClaims
+	TokenUse string           `json:"token_use"`
+	Request  authorizeRequest `json:"req"`
+	UserId   uint             `json:"uid,omitempty"`
+	AuthTime int64            `json:"auth_time,omitempty"`
+}
+
+func (ac *AuthorizeClaims) standard() *jwt.StandardClaims {
+	return ac.StandardClaims
+}
+
+func (ac *AuthorizeClaims) use() string {
+	return ac.TokenUse
+}
+
+func generateAuthorizeJWT(claims *AuthorizeClaims, tokenUse string, tc *TokenConfig) (string, error) {
+	claims.StandardClaims = tc.standardClaims(tokenUse, authorizeFlowTTL)
+	claims.TokenUse = tokenUse
+
+	token := jwt.New(jwt.GetSigningMethod("RS256"))
+	token.Claims = claims
+	return signToken(token, tokenUse, tc)
+}
+
+func parseAuthorizeJWT(tokenString string, tokenUse string, tc *TokenConfig) (*AuthorizeClaims, error) {
+	claims := &AuthorizeClaims{StandardClaims: &jwt.StandardClaims{}}
+	if err := parseClaims(tokenString, claims, tokenUse, tc); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// validRedirectUri accepts absolute https uris without fragment,
+// plain http is allowed only for loopback addresses
+func validRedirectUri(uri string) bool {
+	parsed, err := url.Parse(uri)
+	if err != nil || !parsed.IsAbs() || parsed.Fragment != "" || parsed.Host == "" {
+		return false
+	}
+	switch parsed.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := parsed.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	default:
+		return false
+	}
+}
+
+// resolveRedirectUri matches requested redirect uri against registered ones exactly.
+// It may be omitted only if client has a single registered uri
+func resolveRedirectUri(client *ServiceModel, requested string) (string, bool) {
+	registered := strings.Fields(client.RedirectUris)
+	if requested == "" {
+		if len(registered) == 1 {
+			return registered[0], true
+		}
+		return "", false
+	}
+	for _, uri := range registered {
+		if uri == requested {
+			return uri, true
+		}
+	}
+	return "", false
+}
+
+// verifyCodeChallenge checks PKCE S256 code verifier (RFC 7636)
+func verifyCodeChallenge(verifier string, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	digest := sha256.Sum256([]byte(verifier))
+	return sameDigest(b64url(digest[:]), challenge)
+}
+
+// redirectToClient sends authorization response to client redirect uri
+func (s *Server) redirectToClient(c *fiber.Ctx, req authorizeRequest, params url.Values) error {
+	target, err := url.Parse(req.RedirectUri)
+	if err != nil {
+		return renderPage(c, fiber.StatusBadRequest, errorPage, "invalid redirect uri")
+	}
+	query := target.Query()
+	for name, values := range params {
+		for _, value := range values {
+			query.Add(name, value)
+		}
+	}
+	if req.State != "" {
+		query.Set("state", req.State)
+	}
+	// RFC 9207 issuer identification against mix-up attacks
+	query.Set("iss", s.tokens.Issuer)
+	target.RawQuery = query.Encode()
+	return c.Redirect(target.String(), fiber.StatusFound)
+}
+
+func (s *Server) redirectError(c *fiber.Ctx, req authorizeRequest, code string, description string) error {
+	return s.redirectToClient(c, req, url.Values{"error": {code}, "error_description": {description}})
+}
+
+// HandleAuthorize validates authorization request and shows login page
+func (s *Server) HandleAuthorize(c *fiber.Ctx) error {
+	log.Printf("handle authorize at %s", c.Path())
+
+	var req authorizeRequest
+	if err := c.QueryParser(&req); err != nil {
+		return renderPage(c, fiber.StatusBadRequest, errorPage, "malformed authorization request")
+	}
+
+	// errors about client and redirect uri must not be redirected anywhere
+	client, err := s.dbe.GetServiceByName(req.ClientId)
+	if err != nil {
+		return renderPage(c, fiber.StatusBadRequest, errorPage, "unknown client")
+	}
+	redirectUri, ok := resolveRedirectUri(client, req.RedirectUri)
+	if !ok {
+		return renderPage(c, fiber.StatusBadRequest, errorPage, "redirect uri is not registered for client")
+	}
+	req.RedirectUri = redirectUri
+
+	if req.ResponseType != "code" {
+		return s.redirectError(c, req, "unsupported_response_type", "only code response type is supported")
+	}
+	if req.CodeChallenge == "" {
+		return s.redirectError(c, req, oauthInvalidRequest, "code_challenge is required")
+	}
+	if req.CodeChallengeMethod != "S256" {
+		return s.redirectError(c, req, oauthInvalidRequest, "code_challenge_method must be S256")
+	}
+	scope, ok := grantScope(req.Scope, client.Scopes)
+	if !ok {
+		return s.redirectError(c, req, oauthInvalidScope, "requested scope is not allowed for client")
+	}
+	req.Scope = scope
+
+	token, err := generateAuthorizeJWT(&AuthorizeClaims{Request: req}, tokenUseAuthorizeLogin, s.tokens)
+	if err != nil {
+		return s.redirectError(c, req, oauthServerError, "can't start authorization")
+	}
+	return renderPage(c, fiber.StatusOK, loginPage, loginPageData{
+		Client: client.Name,
+		Action: authorizePath,
+		Token:  token,
+	})
+}
+
+// HandleAuthorizeLogin authenticates user, then asks for consent
+// unless user has already granted requested scope to the client
+func (s *Server) HandleAuthorizeLogin(c *fiber.Ctx) error {
+	log.Printf("handle authorize login at %s", c.Path())
+
+	var req authorizeLoginRequest
+	if err := c.BodyParser(&req); err != nil {
+		return renderPage(c, fiber.StatusBadRequest, errorPage, "malformed login request")
+	}
+	if err := validate.Struct(req); err != nil {
+		return renderPage(c, fiber.StatusBadRequest, errorPage, "expect username and password")
+	}
+
+	claims, err := parseAuthorizeJWT(req.Request, tokenUseAuthorizeLogin, s.tokens)
+	if err != nil {
+		return renderPage(c, fiber.StatusBadRequest, errorPage, "authorization request expired, start again")
+	}
+
+	account := userAttemptKey(req.Username)
+	if err := s.reserveAttempt(c, account); err != nil {
+		return renderPage(c, fiber.StatusTooManyRequests, loginPage, loginPageData{
+			Client:   claims.Request.ClientId,
+			Action:   authorizePath,
+			Token:    req.Request,
+			Username: req.Username,
+			Error:    err.Error(),
+		})
+	}
+	exist, err := s.dbe.CheckUser(req.Username, req.Password)
+	if err != nil {
+		s.refundAttempt(c, account)
+		log.Printf("can't check user %s: %s", req.Username, err)
+		return renderPage(c, fiber.StatusInternalServerError, errorPage, "can't check credentials")
+	}
+	if !exist {
+		return renderPage(c, fiber.StatusUnauthorized, loginPage, loginPageData{
+			Client:   claims.Request.ClientId,
+			Action:   authorizePath,
+			Token:    req.Request,
+			Username: req.Username,
+			Error:    "invalid username or password",
+		})
+	}
+	s.succeededAttempt(c, account)
+	user, err := s.dbe.GetUserByUsername(req.Username)
+	if err != nil {
+		return renderPage(c, fiber.StatusInternalServerError, errorPage, "can't find such user")
+	}
+	if s.requireVerifiedEmail && !user.EmailVerified() {
+		return renderPage(c, fiber.StatusForbidden, loginPage, loginPageData{
+			Client:   claims.Request.ClientId,
+			Action:   authorizePath,
+			Token:    req.Request,
+			Username: req.Username,
+			Error:    "verify your email before signing in",
+		})
+	}
+
+	claims.UserId = user.Id
+	mfa, err := s.mfaRequired(user.Id)
+	if err != nil {
+		return renderPage(c, fiber.StatusInternalServerError, errorPage, "can't check two-factor authentication")
+	}
+	if mfa {
+		if s.secrets == nil {
+			return renderPage(c, fiber.StatusServiceUnavailable, errorPage, errMfaUnavailable.Detail)
+		}
+		token, err := generateAuthorizeJWT(claims, tokenUseAuthorizeMfa, s.tokens)
+		if err != nil {
+			return s.redirectError(c, claims.Request, oauthServerError, "can't continue authorization")
+		}
+		return renderPage(c, fiber.StatusOK, mfaPage, mfaPageData{
+			Client: claims.Request.ClientId,
+			Action: authorizeMfaPath,
+			Token:  token,
+		})
+	}
+
+	claims.AuthTime = time.Now().Unix()
+	return s.continueAuthorize(c, claims, user)
+}
+
+// HandleAuthorizeMfa checks second factor of user who has passed login page
+func (s *Server) HandleAuthorizeMfa(c *fiber.Ctx) error {
+	log.Printf("handle authorize mfa at %s", c.Path())
+
+	var req authorizeMfaRequest
+	if err := c.BodyParser(&req); err != nil {
+		return renderPage(c, fiber.StatusBadRequest, errorPage, "malformed mfa request")
+	}
+	if err := validate.Struct(req); err != nil {
+		return renderPage(c, fiber.StatusBadRequest, errorPage, "expect code")
+	}
+
+	claims, err := parseAuthorizeJWT(req.Mfa, tokenUseAuthorizeMfa, s.tokens)
+	if err != nil {
+		return renderPage(c, fiber.StatusBadRequest, errorPage, "authorization request expired, start again")
+	}
+	user, err := s.dbe.GetUserById(claims.UserId)
+	if err != nil {
+		return renderPage(c, fiber.StatusInternalServerError, errorPage, "can't find such user")
+	}
+	if err := s.verifySecondFactor(c, user, req.Code); err != nil {
+		status, message := fiber.StatusInternalServerError, err.Error()
+		var apiErr *APIError
+		if errors.As(err, &apiErr) {
+			status, message = apiErr.Status, apiErr.Detail
+		}
+		return renderPage(c, status, mfaPage, mfaPageData{
+			Client: claims.Request.ClientId,
+			Action: authorizeMfaPath,
+			Token:  req.Mfa,
+			Error:  message,
+		})
+	}
+
+	claims.AuthTime = time.Now().Unix()
+	return s.continueAuthorize(c, claims, user)
+}
+
+// continueAuthorize issues code for authenticated user if consent exists, or shows consent page
+func (s *Server) continueAuthorize(c *fiber.Ctx, claims *AuthorizeClaims, user *UserModel) error {
+	granted, found, err := s.dbe.GetConsentScope(user.Id, claims.Request.ClientId)
+	if err != nil {
+		return s.redirectError(c, claims.Request, oauthServerError, "can't check consent")
+	}
+	if _, covered := grantScope(claims.Request.Scope, granted); found && covered {
+		return s.issueAuthorizationCode(c, claims)
+	}
+
+	token, err := generateAuthorizeJWT(claims, tokenUseAuthorizeConsent, s.tokens)
+	if err != nil {
+		return s.redirectError(c, claims.Request, oauthServerError, "can't continue authorization")
+	}
+	return renderPage(c, fiber.StatusOK, consentPage, consentPageData{
+		Client:   claims.Request.ClientId,
+		Action:   authorizeConsentPath,
+		Token:    token,
+		Username: user.Username,
+		Scopes:   parseScope(claims.Request.Scope),
+	})
+}
+
+// HandleAuthorizeConsent records user decision and finishes authorization
+func (s *Server) HandleAuthorizeConsent(c *fiber.Ctx) error {
+	log.Printf("handle authorize consent at %s", c.Path())
+
+	var req authorizeConsentRequest
+	if err := c.BodyParser(&req); err != nil {
+		return renderPage(c, fiber.StatusBadRequest, errorPage, "malformed consent request")
+	}
+	if err := validate.Struct(req); err != nil {
+		return renderPage(c, fiber.StatusBadRequest, errorPage, "expect consent decision")
+	}
+
+	claims, err := parseAuthorizeJWT(req.Consent, tokenUseAuthorizeConsent, s.tokens)
+	if err != nil {
+		return renderPage(c, fiber.StatusBadRequest, errorPage, "authorization request expired, start again")
+	}
+	if req.Decision != "allow" {
+		return s.redirectError(c, claims.Request, "access_denied", "user denied access")
+	}
+
+	granted, _, err := s.dbe.GetConsentScope(claims.UserId, claims.Request.ClientId)
+	if err != nil {
+		return s.redirectError(c, claims.Request, oauthServerError, "can't save consent")
+	}
+	scope := normalizeScope(granted + " " + claims.Request.Scope)
+	if err := s.dbe.SaveConsentScope(claims.UserId, claims.Request.ClientId, scope); err != nil {
+		return s.redirectError(c, claims.Request, oauthServerError, "can't save consent")
+	}
+
+	return s.issueAuthorizationCode(c, claims)
+}
+
+func (s *Server) issueAuthorizationCode(c *fiber.Ctx, claims *AuthorizeClaims) error {
+	code, err := newOpaqueToken()
+	if err != nil {
+		return s.redirectError(c, claims.Request, oauthServerError, "can't issue code")
+	}
+	now := time.Now()
+	model := &AuthorizationCodeModel{
+		CodeHash:      hashOpaqueToken(code),
+		ClientId:      claims.Request.ClientId,
+		UserId:        claims.UserId,
+		RedirectUri:   claims.Request.RedirectUri,
+		Scope:         claims.Request.Scope,
+		Nonce:         claims.Request.Nonce,
+		CodeChallenge: claims.Request.CodeChallenge,
+		AuthTime:      time.Unix(claims.AuthTime, 0),
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(authorizationCodeTTL),
+	}
+	if err := s.dbe.CreateAuthorizationCode(model); err != nil {
+		return s.redirectError(c, claims.Request, oauthServerError, "can't issue code")
+	}
+
+	return s.redirectToClient(c, claims.Request, url.Values{"code": {code}})
+}
+
+// oauthClient authenticates confidential client or identifies public one by client_id
+func (s *Server) oauthClient(c *fiber.Ctx, req *clientAuth) (*ServiceModel, error) {
+	if _, _, err := clientCredentials(c, req); !errors.Is(err, errNoClientCredentials) {
+		return s.authenticateClient(c, req)
+	}
+	if req.ClientId == "" {
+		return nil, errNoClientCredentials
+	}
+	client, err := s.dbe.GetServiceByName(req.ClientId)
+	if err != nil {
+		return nil, err
+	}
+	if !client.Public {
+		return nil, fmt.Errorf("client %s must authenticate", client.Name)
+	}
+	return client, nil
+}
+
+func (s *Server) authorizationCodeGrant(c *fiber.Ctx, req *tokenRequest) error {
+	if req.Code == "" || req.CodeVerifier == "" {
+		return oauthError(c, fiber.StatusBadRequest, oauthInvalidRequest, "code and code_verifier are required")
+	}
+
+	client, err := s.oauthClient(c, &req.clientAuth)
+	if err != nil {
+		log.Printf("reject client: %s", err)
+		return oauthError(c, fiber.StatusUnauthorized, oauthInvalidClient, "client authentication failed")
+	}
+
+	code, err := s.dbe.GetAuthorizationCode(hashOpaqueToken(req.Code))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return oauthError(c, fiber.StatusBadRequest, oauthInvalidGrant, "invalid code")
+	}
+	if err != nil {
+		return oauthError(c, fiber.StatusInternalServerError, oauthServerError, "can't check code")
+	}
+	if code.ClientId != client.Name || time.Now().After(code.ExpiresAt) {
+		return oauthError(c, fiber.StatusBadRequest, oauthInvalidGrant, "invalid code")
+	}
+	if req.RedirectUri != code.RedirectUri {
+		return oauthError(c, fiber.StatusBadRequest, oauthInvalidGrant, "redirect_uri doesn't match")
+	}
+	if !verifyCodeChallenge(req.CodeVerifier, code.CodeChallenge) {
+		return oauthError(c, fiber.StatusBadRequest, oauthInvalidGrant, "invalid code_verifier")
+	}
+
+	// code used twice: revoke tokens issued for it (RFC 6749 section 4.1.2)
+	used, err := s.dbe.MarkAuthorizationCodeUsed(code.Id)
+	if err != nil {
+		return oauthError(c, fiber.StatusInternalServerError, oauthServerError, "can't use code")
+	}
+	if !used {
+		if code.SessionId != 0 {
+			if _, err := s.dbe.RevokeSession(code.UserId, code.SessionId); err != nil {
+				log.Printf("can't revoke session %d: %s", code.SessionId, err)
+			}
+		}
+		s.securityEvent(c, securityEventCodeReuse, code.UserId, code.SessionId,
+			fmt.Sprintf("authorization code %d of client %s exchanged twice", code.Id, client.Name))
+		return oauthError(c, fiber.StatusBadRequest, oauthInvalidGrant, "invalid code")
+	}
+
+	user, err := s.dbe.GetUserById(code.UserId)
+	if err != nil {
+		return oauthError(c, fiber.StatusBadRequest, oauthInvalidGrant, "invalid code")
+	}
+	info, err := s.userInfo(user)
+	if err != nil {
+		return oauthError(c, fiber.StatusInternalServerError, oauthServerError, "can't get user roles")
+	}
+	tokens, session, err := s.startSession(c, info, client.Name, code.Scope)
+	if err != nil {
+		log.Printf("can't create tokens: %s", err)
+		return oauthError(c, fiber.StatusInternalServerError, oauthServerError, "can't create tokens")
+	}
+	if err := s.dbe.SetAuthorizationCodeSession(code.Id, session.Id); err != nil {
+		log.Printf("can't bind code %d to session: %s", code.Id, err)
+	}
+
+	var idToken string
+	if hasScope(code.Scope, "openid") {
+		if idToken, err = generateIdToken(user, client.Name, code.Scope, code.AuthTime, code.Nonce, s.tokens); err != nil {
+			return oauthError(c, fiber.StatusInternalServerError, oauthServerError, "can't create id token")
+		}
+	}
+
+	return userTokenResponse(c, tokens, session.Scope, idToken)
+}
+
+// userRefreshTokenGrant rotates refresh token of session started by client
+func (s *Server) userRefreshTokenGrant(c *fiber.Ctx, req *tokenRequest, token *RefreshTokenModel) error {
+	client, err := s.oauthClient(c, &req.clientAuth)
+	if err != nil {
+		log.Printf("reject client: %s", err)
+		return oauthError(c, fiber.StatusUnauthorized, oauthInvalidClient, "client authentication failed")
+	}
+	session, err := s.dbe.GetSessionById(token.SessionId)
+	if err != nil || session.ClientId != client.Name {
+		return oauthError(c, fiber.StatusBadRequest, oauthInvalidGrant, "invalid refresh token")
+	}
+	// scope may only narrow the one of session, as RFC 6749 §6 asks
+	scope, ok := grantScope(req.Scope, session.Scope)
+	if !ok {
+		return oauthError(c, fiber.StatusBadRequest, oauthInvalidScope, "requested scope exceeds granted one")
+	}
+
+	session, parentId, err := s.useRefreshToken(c, req.RefreshToken, client.Name)
+	if errors.Is(err, errRefreshTokenInvalid) || errors.Is(err, errRefreshTokenReused) {
+		return oauthError(c, fiber.StatusBadRequest, oauthInvalidGrant, err.Error())
+	}
+	if err != nil {
+		return oauthError(c, fiber.StatusInternalServerError, oauthServerError, "can't rotate refresh token")
+	}
+
+	tokens, err := s.refreshSessionTokens(session, scope, parentId)
+	if err != nil {
+		return oauthError(c, fiber.StatusInternalServerError, oauthServerError, "can't create tokens")
+	}
+
+	var idToken string
+	if hasScope(scope, "openid") {
+		user, err := s.dbe.GetUserById(session.UserId)
+		if err == nil {
+			idToken, err = generateIdToken(user, client.Name, scope, session.CreatedAt, "", s.tokens)
+		}
+		if err != nil {
+			return oauthError(c, fiber.StatusInternalServerError, oauthServerError, "can't create id token")
+		}
+	}
+	return userTokenResponse(c, tokens, scope, idToken)
+}
+
+func userTokenResponse(c *fiber.Ctx, tokens JwtResponse, scope string, idToken string) error {
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	c.Set("Pragma", "no-cache")
+	return c.JSON(TokenResponse{
+		AccessToken:  tokens.JWT,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(accessTokenTTL / time.Second),
+		RefreshToken: tokens.RefreshToken,
+		Scope:        scope,
+		IdToken:      idToken,
+	})
+}
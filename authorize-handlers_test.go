@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/sha256"
+	"strings"
+	"testing"
+)
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	const verifier = "dBjftJeZ4CVP-mJ0kzbPbpGgAQ4F-9oTOgAuqPNDTXk"
+	// BASE64URL(SHA256(verifier)) without padding
+	const challenge = "HETV2vZ7o9-9cIUFibF07x-VcgEKjmW2dtTyCCzsCeQ"
+
+	tests := []struct {
+		name      string
+		verifier  string
+		challenge string
+		want      bool
+	}{
+		{"matching verifier", verifier, challenge, true},
+		{"wrong verifier", strings.Replace(verifier, "d", "e", 1), challenge, false},
+		{"wrong challenge", verifier, strings.Replace(challenge, "H", "G", 1), false},
+		{"plain method", verifier, verifier, false},
+		{"padded challenge", verifier, challenge + "=", false},
+		{"standard base64 challenge", verifier, strings.NewReplacer("-", "+", "_", "/").Replace(challenge), false},
+		{"empty challenge", verifier, "", false},
+		{"empty verifier", "", challenge, false},
+		{"short verifier", verifier[:42], b64urlSHA256(verifier[:42]), false},
+		{"shortest verifier", verifier[:43], b64urlSHA256(verifier[:43]), true},
+		{"longest verifier", strings.Repeat("a", 128), b64urlSHA256(strings.Repeat("a", 128)), true},
+		{"long verifier", strings.Repeat("a", 129), b64urlSHA256(strings.Repeat("a", 129)), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyCodeChallenge(tt.verifier, tt.challenge); got != tt.want {
+				t.Errorf("verifyCodeChallenge(%q, %q) = %t, want %t", tt.verifier, tt.challenge, got, tt.want)
+			}
+		})
+	}
+}
+
+func b64urlSHA256(s string) string {
+	digest := sha256.Sum256([]byte(s))
+	return b64url(digest[:])
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gofiber/fiber/v2"
+	"html/template"
+)
+
+const pageStyle = `
+body { font-family: sans-serif; background: #f4f5f7; display: flex; justify-content: center; }
+main { background: #fff; margin-top: 10vh; padding: 2em; border-radius: 8px; width: 22em; box-shadow: 0 1px 4px rgba(0,0,0,.15); }
+h1 { font-size: 1.3em; margin-top: 0; }
+label { display: block; margin: .8em 0 .3em; }
+input[type=text], input[type=password] { width: 100%; box-sizing: border-box; padding: .5em; }
+button { margin-top: 1.2em; padding: .5em 1.2em; }
+.error { color: #b00020; }
+`
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Sign in</title>
+<style>` + pageStyle + `</style>
+</head>
+<body>
+<main>
+<h1>Sign in to {{.Client}}</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="request" value="{{.Token}}">
+<label for="username">Username</label>
+<input type="text" id="username" name="username" value="{{.Username}}" autocomplete="username" required autofocus>
+<label for="password">Password</label>
+<input type="password" id="password" name="password" autocomplete="current-password" required>
+<button type="submit">Sign in</button>
+</form>
+</main>
+</body>
+</html>
+`))
+
+var mfaPage = template.Must(template.New("mfa").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Two-factor authentication</title>
+<style>` + pageStyle + `</style>
+</head>
+<body>
+<main>
+<h1>Sign in to {{.Client}}</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="mfa" value="{{.Token}}">
+<label for="code">Code from authenticator app or recovery code</label>
+<input type="text" id="code" name="code" autocomplete="one-time-code" required autofocus>
+<button type="submit">Verify</button>
+</form>
+</main>
+</body>
+</html>
+`))
+
+var consentPage = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Authorize {{.Client}}</title>
+<style>` + pageStyle + `</style>
+</head>
+<body>
+<main>
+<h1>{{.Client}} wants to access your account</h1>
+<p>Signed in as <b>{{.Username}}</b>. The application asks for:</p>
+<ul>
+{{range .Scopes}}<li>{{.}}</li>
+{{else}}<li>basic access</li>
+{{end}}</ul>
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="consent" value="{{.Token}}">
+<button type="submit" name="decision" value="allow">Allow</button>
+<button type="submit" name="decision" value="deny">Deny</button>
+</form>
+</main>
+</body>
+</html>
+`))
+
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Authorization error</title>
+<style>` + pageStyle + `</style>
+</head>
+<body>
+<main>
+<h1>Authorization error</h1>
+<p class="error">{{.}}</p>
+</main>
+</body>
+</html>
+`))
+
+type loginPageData struct {
+	Client   string
+	Action   string
+	Token    string
+	Username string
+	Error    string
+}
+
+type mfaPageData struct {
+	Client string
+	Action string
+	Token  string
+	Error  string
+}
+
+type consentPageData struct {
+	Client   string
+	Action   string
+	Token    string
+	Username string
+	Scopes   []string
+}
+
+// renderPage writes html page, forbidding framing and caching of it
+func renderPage(c *fiber.Ctx, status int, page *template.Template, data interface{}) error {
+	var buf bytes.Buffer
+	if err := page.Execute(&buf, data); err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderXFrameOptions, "DENY")
+	c.Set(fiber.HeaderContentSecurityPolicy, "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+	return c.Status(status).Send(buf.Bytes())
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Minimal CBOR (RFC 8949) decoder for WebAuthn attestation objects and COSE keys.
+// Only definite length items are supported, floats and tags are rejected
+
+var errCBOR = errors.New("malformed cbor")
+
+const cborMaxDepth = 16
+
+// decodeCBOR decodes first data item and returns the rest of data. Maps decode into
+// map[interface{}]interface{} with int64 or string keys, integers into int64
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+// cborHead reads major type and argument of item head
+func cborHead(data []byte) (byte, uint64, []byte, error) {
+	if len(data) < 1 {
+		return 0, 0, nil, errCBOR
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+	switch {
+	case info < 24:
+		return major, uint64(info), data, nil
+	case info == 24 && len(data) >= 1:
+		return major, uint64(data[0]), data[1:], nil
+	case info == 25 && len(data) >= 2:
+		return major, uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26 && len(data) >= 4:
+		return major, uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27 && len(data) >= 8:
+		return major, binary.BigEndian.Uint64(data), data[8:], nil
+	default:
+		return 0, 0, nil, fmt.Errorf("%w: unsupported item head 0x%02x", errCBOR, major<<5|info)
+	}
+}
+
+func decodeCBORItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, fmt.Errorf("%w: nested too deep", errCBOR)
+	}
+	major, arg, rest, err := cborHead(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > 1<<63-1 {
+			return nil, nil, fmt.Errorf("%w: integer overflow", errCBOR)
+		}
+		return int64(arg), rest, nil
+	case 1:
+		if arg > 1<<63-1 {
+			return nil, nil, fmt.Errorf("%w: integer overflow", errCBOR)
+		}
+		return -1 - int64(arg), rest, nil
+	case 2, 3:
+		if arg > uint64(len(rest)) {
+			return nil, nil, fmt.Errorf("%w: truncated string", errCBOR)
+		}
+		if major == 3 {
+			return string(rest[:arg]), rest[arg:], nil
+		}
+		return rest[:arg], rest[arg:], nil
+	case 4:
+		// every item takes at least a byte
+		if arg > uint64(len(rest)) {
+			return nil, nil, fmt.Errorf("%w: truncated array", errCBOR)
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item interface{}
+			if item, rest, err = decodeCBORItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, rest, nil
+	case 5:
+		if arg > uint64(len(rest))/2 {
+			return nil, nil, fmt.Errorf("%w: truncated map", errCBOR)
+		}
+		items := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value interface{}
+			if key, rest, err = decodeCBORItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("%w: unsupported map key", errCBOR)
+			}
+			if _, duplicate := items[key]; duplicate {
+				return nil, nil, fmt.Errorf("%w: duplicate map key", errCBOR)
+			}
+			if value, rest, err = decodeCBORItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			items[key] = value
+		}
+		return items, rest, nil
+	case 7:
+		switch arg {
+		case 20:
+			return false, rest, nil
+		case 21:
+			return true, rest, nil
+		case 22:
+			return nil, rest, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("%w: unsupported major type %d", errCBOR, major)
+}
+
+// COSE algorithms (RFC 8152) WebAuthn credentials may use
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+// COSE key parameters
+const (
+	coseKeyKty = 1
+	coseKeyAlg = 3
+	coseKeyCrv = -1
+	coseKeyX   = -2
+	coseKeyY   = -3
+	coseKeyN   = -1
+	coseKeyE   = -2
+
+	coseKtyOKP = 1
+	coseKtyEC2 = 2
+	coseKtyRSA = 3
+
+	coseCrvP256    = 1
+	coseCrvEd25519 = 6
+)
+
+// COSEKey is credential public key with its signature algorithm
+type COSEKey struct {
+	Alg       int64
+	PublicKey crypto.PublicKey
+}
+
+func coseInt(key map[interface{}]interface{}, label int64) (int64, bool) {
+	value, ok := key[label].(int64)
+	return value, ok
+}
+
+func coseBytes(key map[interface{}]interface{}, label int64) ([]byte, bool) {
+	value, ok := key[label].([]byte)
+	return value, ok
+}
+
+// parseCOSEKey decodes COSE_Key and returns the rest of data
+func parseCOSEKey(data []byte) (*COSEKey, []byte, error) {
+	item, rest, err := decodeCBOR(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return nil, nil, errors.New("cose key is not a map")
+	}
+	kty, _ := coseInt(key, coseKeyKty)
+	alg, _ := coseInt(key, coseKeyAlg)
+
+	switch {
+	case kty == coseKtyEC2 && alg == coseAlgES256:
+		crv, _ := coseInt(key, coseKeyCrv)
+		x, okX := coseBytes(key, coseKeyX)
+		y, okY := coseBytes(key, coseKeyY)
+		if crv != coseCrvP256 || !okX || !okY || len(x) != 32 || len(y) != 32 {
+			return nil, nil, errors.New("invalid ec2 cose key")
+		}
+		publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return nil, nil, errors.New("ec2 cose key is not on curve")
+		}
+		return &COSEKey{Alg: alg, PublicKey: publicKey}, rest, nil
+	case kty == coseKtyOKP && alg == coseAlgEdDSA:
+		crv, _ := coseInt(key, coseKeyCrv)
+		x, okX := coseBytes(key, coseKeyX)
+		if crv != coseCrvEd25519 || !okX || len(x) != ed25519.PublicKeySize {
+			return nil, nil, errors.New("invalid okp cose key")
+		}
+		return &COSEKey{Alg: alg, PublicKey: ed25519.PublicKey(x)}, rest, nil
+	case kty == coseKtyRSA && alg == coseAlgRS256:
+		n, okN := coseBytes(key, coseKeyN)
+		e, okE := coseBytes(key, coseKeyE)
+		if !okN || !okE || len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, nil, errors.New("invalid rsa cose key")
+		}
+		return &COSEKey{Alg: alg, PublicKey: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}}, rest, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported cose key type %d with algorithm %d", kty, alg)
+	}
+}
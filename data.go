@@ -1,14 +1,29 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"github.com/jackc/pgconn"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"log"
+	"time"
 )
 
+var errDuplicate = errors.New("duplicate value")
+
+// pgUniqueViolation is postgres error code of unique constraint violation
+const pgUniqueViolation = "23505"
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation
+}
+
 type DBEngine struct {
-	DB *gorm.DB
+	DB        *gorm.DB
+	passwords *PasswordHashing
 }
 
 type DBConfig struct {
@@ -21,7 +36,7 @@ type DBConfig struct {
 	Tz       string
 }
 
-func NewDBEngine(dbc DBConfig) (*DBEngine, error) {
+func NewDBEngine(dbc DBConfig, passwords *PasswordHashing) (*DBEngine, error) {
 	dsn := fmt.Sprintf(
 		"host=%s user=%s password=%s dbname=%s port=%s sslmode=%s TimeZone=%s",
 		dbc.Host,
@@ -41,59 +56,153 @@ func NewDBEngine(dbc DBConfig) (*DBEngine, error) {
 
 	dbe := &DBEngine{}
 	dbe.DB = db
+	dbe.passwords = passwords
 	return dbe, nil
 }
 
-func (dbe *DBEngine) CreateUser(username string, password string) (*UserModel, error) {
-	user := &UserModel{Username: username, Password: password}
+// CreateUser creates user with hashed password, empty email is left unset
+func (dbe *DBEngine) CreateUser(username string, password string, email string) (*UserModel, error) {
+	hash, err := dbe.passwords.Hash(password)
+	if err != nil {
+		return nil, err
+	}
+	user := &UserModel{Username: username, Password: hash}
+	if email != "" {
+		user.Email = &email
+	}
 	if err := dbe.DB.Create(user).Error; err != nil {
+		if isUniqueViolation(err) {
+			return nil, errDuplicate
+		}
 		return nil, err
 	}
 	return user, nil
 }
 
-func (dbe *DBEngine) CreateService(name string, secretKey string) (*ServiceModel, error) {
-	service := &ServiceModel{Name: name, SecretKey: secretKey}
+func (dbe *DBEngine) CreateService(name string, secretKey string, scopes string, redirectUris string, public bool) (*ServiceModel, error) {
+	var hash string
+	if !public {
+		var err error
+		if hash, err = dbe.passwords.Hash(secretKey); err != nil {
+			return nil, err
+		}
+	}
+	service := &ServiceModel{Name: name, SecretKey: hash, Scopes: scopes, RedirectUris: redirectUris, Public: public}
 	if err := dbe.DB.Create(service).Error; err != nil {
+		if isUniqueViolation(err) {
+			return nil, errDuplicate
+		}
 		return nil, err
 	}
 	return service, nil
 }
 
+// CheckUser verifies user password. Password hashes with outdated
+// parameters and legacy plaintext passwords are rehashed in place
 func (dbe *DBEngine) CheckUser(username string, password string) (bool, error) {
-	user := &UserModel{}
-	var exists bool
-	if err := dbe.DB.
-		Model(&user).
-		Select("count(*) > 0").
-		Where("username = ? AND password = ?", username, password).
-		Find(&exists).
-		Error; err != nil {
+	user, err := dbe.GetUserByUsername(username)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		dbe.passwords.Burn(password)
+		return false, nil
+	}
+	if err != nil {
 		return false, err
 	}
+	return dbe.CheckUserPassword(user, password)
+}
 
-	return exists, nil
+// CheckUserPassword verifies password of known user
+func (dbe *DBEngine) CheckUserPassword(user *UserModel, password string) (bool, error) {
+	ok, rehash, err := dbe.passwords.Verify(password, user.Password)
+	if err != nil || !ok {
+		return false, err
+	}
+	if rehash {
+		if err := dbe.updateSecretHash(user, "password", password); err != nil {
+			log.Printf("can't rehash password of user %d: %s", user.Id, err)
+		}
+	}
+
+	return true, nil
+}
+
+// ChangeUserPassword sets new password and revokes every user session except exceptSessionId
+func (dbe *DBEngine) ChangeUserPassword(userId uint, password string, exceptSessionId uint) error {
+	hash, err := dbe.passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+	return dbe.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.
+			Model(&UserModel{}).
+			Where("id = ?", userId).
+			Update("password", hash).
+			Error; err != nil {
+			return err
+		}
+		return tx.
+			Model(&SessionModel{}).
+			Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userId, exceptSessionId).
+			Update("revoked_at", time.Now()).
+			Error
+	})
+}
+
+// ChangeUsername returns errDuplicate if username is taken
+func (dbe *DBEngine) ChangeUsername(userId uint, username string) error {
+	err := dbe.DB.
+		Model(&UserModel{}).
+		Where("id = ?", userId).
+		Update("username", username).
+		Error
+	if isUniqueViolation(err) {
+		return errDuplicate
+	}
+	return err
 }
 
+// CheckService verifies service secret key, rehashing it like CheckUser does
 func (dbe *DBEngine) CheckService(name string, secretKey string) (bool, error) {
-	service := &ServiceModel{}
-	var exists bool
-	if err := dbe.DB.
-		Model(&service).
-		Select("count(*) > 0").
-		Where("name = ? AND secret_key = ?", name, secretKey).
-		Find(&exists).
-		Error; err != nil {
+	service, err := dbe.GetServiceByName(name)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		dbe.passwords.Burn(secretKey)
+		return false, nil
+	}
+	if err != nil {
 		return false, err
 	}
 
-	return exists, nil
+	// public clients have no secret to check
+	if service.Public || service.SecretKey == "" {
+		return false, nil
+	}
+	ok, rehash, err := dbe.passwords.Verify(secretKey, service.SecretKey)
+	if err != nil || !ok {
+		return false, err
+	}
+	if rehash {
+		if err := dbe.updateSecretHash(service, "secret_key", secretKey); err != nil {
+			log.Printf("can't rehash secret key of service %d: %s", service.Id, err)
+		}
+	}
+
+	return true, nil
+}
+
+func (dbe *DBEngine) updateSecretHash(model interface{}, column string, secret string) error {
+	hash, err := dbe.passwords.Hash(secret)
+	if err != nil {
+		return err
+	}
+	return dbe.DB.Model(model).Update(column, hash).Error
 }
 
 func (dbe *DBEngine) CheckUserByUsername(username string) (bool, error) {
 	user := &UserModel{}
 	var exists bool
+	// deleted users keep their usernames
 	if err := dbe.DB.
+		Unscoped().
 		Model(&user).
 		Select("count(*) > 0").
 		Where("username = ?", username).
@@ -156,6 +265,193 @@ func (dbe *DBEngine) GetUserByUsername(username string) (*UserModel, error) {
 	return user, nil
 }
 
+func (dbe *DBEngine) GetUserByEmail(email string) (*UserModel, error) {
+	user := &UserModel{}
+	if err := dbe.DB.
+		Where("email = ?", email).
+		Take(&user).
+		Error; err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// SetUserEmail changes user email, new email is not verified.
+// It returns errDuplicate if email is taken
+func (dbe *DBEngine) SetUserEmail(userId uint, email string) error {
+	err := dbe.DB.
+		Model(&UserModel{}).
+		Where("id = ?", userId).
+		Updates(map[string]interface{}{"email": email, "email_verified_at": nil}).
+		Error
+	if isUniqueViolation(err) {
+		return errDuplicate
+	}
+	return err
+}
+
+func (dbe *DBEngine) CreateEmailVerification(userId uint, email string, tokenHash string) error {
+	now := time.Now()
+	verification := &EmailVerificationModel{
+		UserId:    userId,
+		Email:     email,
+		TokenHash: tokenHash,
+		CreatedAt: now,
+		ExpiresAt: now.Add(emailVerificationTTL),
+	}
+	return dbe.DB.Create(verification).Error
+}
+
+// GetLastEmailVerification returns the most recent verification sent to user
+func (dbe *DBEngine) GetLastEmailVerification(userId uint) (*EmailVerificationModel, error) {
+	verification := &EmailVerificationModel{}
+	if err := dbe.DB.
+		Where("user_id = ?", userId).
+		Order("created_at DESC").
+		Take(&verification).
+		Error; err != nil {
+		return nil, err
+	}
+
+	return verification, nil
+}
+
+// VerifyEmail uses verification token and marks its email verified. It returns
+// false if token is unknown, used, expired or user email has changed since
+func (dbe *DBEngine) VerifyEmail(tokenHash string) (bool, error) {
+	verified := false
+	err := dbe.DB.Transaction(func(tx *gorm.DB) error {
+		verification := &EmailVerificationModel{}
+		err := tx.
+			Where("token_hash = ?", tokenHash).
+			Take(&verification).
+			Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		result := tx.
+			Model(&EmailVerificationModel{}).
+			Where("id = ? AND used_at IS NULL AND expires_at > ?", verification.Id, now).
+			Update("used_at", now)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		result = tx.
+			Model(&UserModel{}).
+			Where("id = ? AND email = ?", verification.UserId, verification.Email).
+			Update("email_verified_at", now)
+		verified = result.RowsAffected > 0
+		return result.Error
+	})
+	return verified, err
+}
+
+func (dbe *DBEngine) CreatePasswordReset(userId uint, tokenHash string) error {
+	now := time.Now()
+	reset := &PasswordResetModel{
+		UserId:    userId,
+		TokenHash: tokenHash,
+		CreatedAt: now,
+		ExpiresAt: now.Add(passwordResetTTL),
+	}
+	return dbe.DB.Create(reset).Error
+}
+
+// GetLastPasswordReset returns the most recent reset token sent to user
+func (dbe *DBEngine) GetLastPasswordReset(userId uint) (*PasswordResetModel, error) {
+	reset := &PasswordResetModel{}
+	if err := dbe.DB.
+		Where("user_id = ?", userId).
+		Order("created_at DESC").
+		Take(&reset).
+		Error; err != nil {
+		return nil, err
+	}
+
+	return reset, nil
+}
+
+// GetPasswordReset returns reset token which is neither used nor expired
+func (dbe *DBEngine) GetPasswordReset(tokenHash string) (*PasswordResetModel, error) {
+	reset := &PasswordResetModel{}
+	if err := dbe.DB.
+		Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", tokenHash, time.Now()).
+		Take(&reset).
+		Error; err != nil {
+		return nil, err
+	}
+
+	return reset, nil
+}
+
+// ResetPassword uses reset token to set new password. All reset tokens and sessions
+// of user stop working. It returns zero user id if token is unknown, used or expired
+func (dbe *DBEngine) ResetPassword(tokenHash string, password string) (uint, error) {
+	hash, err := dbe.passwords.Hash(password)
+	if err != nil {
+		return 0, err
+	}
+
+	var userId uint
+	err = dbe.DB.Transaction(func(tx *gorm.DB) error {
+		reset := &PasswordResetModel{}
+		err := tx.
+			Where("token_hash = ?", tokenHash).
+			Take(&reset).
+			Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		result := tx.
+			Model(&PasswordResetModel{}).
+			Where("id = ? AND used_at IS NULL AND expires_at > ?", reset.Id, now).
+			Update("used_at", now)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		// other tokens sent to user are not needed anymore
+		if err := tx.
+			Model(&PasswordResetModel{}).
+			Where("user_id = ? AND used_at IS NULL", reset.UserId).
+			Update("used_at", now).
+			Error; err != nil {
+			return err
+		}
+
+		if err := tx.
+			Model(&UserModel{}).
+			Where("id = ?", reset.UserId).
+			Update("password", hash).
+			Error; err != nil {
+			return err
+		}
+		if err := tx.
+			Model(&SessionModel{}).
+			Where("user_id = ? AND revoked_at IS NULL", reset.UserId).
+			Update("revoked_at", now).
+			Error; err != nil {
+			return err
+		}
+		userId = reset.UserId
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return userId, nil
+}
+
 func (dbe *DBEngine) GetServiceByName(name string) (*ServiceModel, error) {
 	service := &ServiceModel{}
 	if err := dbe.DB.
@@ -168,35 +464,450 @@ func (dbe *DBEngine) GetServiceByName(name string) (*ServiceModel, error) {
 	return service, nil
 }
 
-func (dbe *DBEngine) UpdateRefreshToken(userId uint, refreshToken string) error {
-	user, err := dbe.GetUserById(userId)
+func (dbe *DBEngine) UpdateServiceRefreshToken(serviceId uint, refreshTokenHash string, scope string) error {
+	service, err := dbe.GetServiceById(serviceId)
 	if err != nil {
 		return err
 	}
-	if err := dbe.DB.Model(&user).Update("refresh_token", refreshToken).Error; err != nil {
+	if err := dbe.DB.Model(&service).Updates(map[string]interface{}{
+		"refresh_token_hash":       refreshTokenHash,
+		"refresh_token_expires_at": time.Now().Add(serviceRefreshTokenTTL),
+		"refresh_token_scope":      scope,
+	}).Error; err != nil {
 		return err
 	}
 	return nil
 }
 
-func (dbe *DBEngine) UpdateServiceRefreshToken(serviceId uint, refreshToken string) error {
-	service, err := dbe.GetServiceById(serviceId)
-	if err != nil {
+func (dbe *DBEngine) GetServiceByRefreshToken(refreshTokenHash string) (*ServiceModel, error) {
+	service := &ServiceModel{}
+	if err := dbe.DB.
+		Where("refresh_token_hash = ?", refreshTokenHash).
+		Take(&service).
+		Error; err != nil {
+		return nil, err
+	}
+
+	return service, nil
+}
+
+func (dbe *DBEngine) CheckUserInService(userId uint, serviceUsername string, serviceId uint) (bool, error) {
+	relation := &UserServiceRelation{}
+	var exists bool
+	if err := dbe.DB.
+		Model(&relation).
+		Select("count(*) > 0").
+		Where("user_id = ? AND service_username = ? AND service_model_id = ?", userId, serviceUsername, serviceId).
+		Find(&exists).
+		Error; err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+func (dbe *DBEngine) CreateSession(userId uint, userAgent string, ip string, clientId string, scope string) (*SessionModel, error) {
+	now := time.Now()
+	session := &SessionModel{
+		UserId:     userId,
+		UserAgent:  userAgent,
+		IP:         ip,
+		ClientId:   clientId,
+		Scope:      scope,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(refreshTokenTTL),
+	}
+	if err := dbe.DB.Create(session).Error; err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (dbe *DBEngine) GetSessionById(sessionId uint) (*SessionModel, error) {
+	session := &SessionModel{}
+	if err := dbe.DB.
+		Where("id = ?", sessionId).
+		Take(&session).
+		Error; err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// GetActiveSessions returns not revoked and not expired user sessions, recently used first
+func (dbe *DBEngine) GetActiveSessions(userId uint) ([]SessionModel, error) {
+	var sessions []SessionModel
+	if err := dbe.DB.
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userId, time.Now()).
+		Order("last_used_at DESC").
+		Find(&sessions).
+		Error; err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// AddRefreshToken stores a new token of session family and prolongs session.
+// Child of parentId token when rotating, root token when parentId is nil
+func (dbe *DBEngine) AddRefreshToken(session *SessionModel, parentId *uint, refreshTokenHash string) error {
+	now := time.Now()
+	return dbe.DB.Transaction(func(tx *gorm.DB) error {
+		token := &RefreshTokenModel{SessionId: session.Id, ParentId: parentId, TokenHash: refreshTokenHash, CreatedAt: now}
+		if err := tx.Create(token).Error; err != nil {
+			return err
+		}
+		return tx.Model(session).Updates(map[string]interface{}{
+			"last_used_at": now,
+			"expires_at":   now.Add(refreshTokenTTL),
+		}).Error
+	})
+}
+
+func (dbe *DBEngine) GetRefreshToken(refreshTokenHash string) (*RefreshTokenModel, error) {
+	token := &RefreshTokenModel{}
+	if err := dbe.DB.
+		Where("token_hash = ?", refreshTokenHash).
+		Take(&token).
+		Error; err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// MarkRefreshTokenRotated returns false if token has been already rotated,
+// so that two concurrent refreshes with the same token can't both succeed
+func (dbe *DBEngine) MarkRefreshTokenRotated(tokenId uint) (bool, error) {
+	result := dbe.DB.
+		Model(&RefreshTokenModel{}).
+		Where("id = ? AND rotated_at IS NULL", tokenId).
+		Update("rotated_at", time.Now())
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (dbe *DBEngine) RevokeToken(jti string, expiresAt time.Time) error {
+	return dbe.DB.
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&RevokedTokenModel{Jti: jti, ExpiresAt: expiresAt}).
+		Error
+}
+
+// ConsumeToken denylists single use token, it returns false if token has been already used
+func (dbe *DBEngine) ConsumeToken(jti string, expiresAt time.Time) (bool, error) {
+	result := dbe.DB.
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&RevokedTokenModel{Jti: jti, ExpiresAt: expiresAt})
+	return result.RowsAffected > 0, result.Error
+}
+
+func (dbe *DBEngine) IsTokenRevoked(jti string) (bool, error) {
+	var exists bool
+	if err := dbe.DB.
+		Model(&RevokedTokenModel{}).
+		Select("count(*) > 0").
+		Where("jti = ?", jti).
+		Find(&exists).
+		Error; err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+// PruneRevokedTokens removes denylist entries of already expired tokens
+func (dbe *DBEngine) PruneRevokedTokens() (int64, error) {
+	result := dbe.DB.Where("expires_at < ?", time.Now()).Delete(&RevokedTokenModel{})
+	return result.RowsAffected, result.Error
+}
+
+func (dbe *DBEngine) ClearServiceRefreshToken(serviceId uint) error {
+	return dbe.DB.
+		Model(&ServiceModel{}).
+		Where("id = ?", serviceId).
+		Update("refresh_token_hash", "").
+		Error
+}
+
+func (dbe *DBEngine) CreateAuthorizationCode(code *AuthorizationCodeModel) error {
+	return dbe.DB.Create(code).Error
+}
+
+func (dbe *DBEngine) GetAuthorizationCode(codeHash string) (*AuthorizationCodeModel, error) {
+	code := &AuthorizationCodeModel{}
+	if err := dbe.DB.
+		Where("code_hash = ?", codeHash).
+		Take(&code).
+		Error; err != nil {
+		return nil, err
+	}
+
+	return code, nil
+}
+
+// MarkAuthorizationCodeUsed returns false if code has been already exchanged
+func (dbe *DBEngine) MarkAuthorizationCodeUsed(codeId uint) (bool, error) {
+	result := dbe.DB.
+		Model(&AuthorizationCodeModel{}).
+		Where("id = ? AND used_at IS NULL", codeId).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (dbe *DBEngine) SetAuthorizationCodeSession(codeId uint, sessionId uint) error {
+	return dbe.DB.
+		Model(&AuthorizationCodeModel{}).
+		Where("id = ?", codeId).
+		Update("session_id", sessionId).
+		Error
+}
+
+// GetConsentScope returns scope user has granted to client, found is false if user never did
+func (dbe *DBEngine) GetConsentScope(userId uint, clientId string) (scope string, found bool, err error) {
+	var consents []OAuthConsentModel
+	if err := dbe.DB.
+		Where("user_id = ? AND client_id = ?", userId, clientId).
+		Limit(1).
+		Find(&consents).
+		Error; err != nil {
+		return "", false, err
+	}
+	if len(consents) == 0 {
+		return "", false, nil
+	}
+	return consents[0].Scope, true, nil
+}
+
+func (dbe *DBEngine) SaveConsentScope(userId uint, clientId string, scope string) error {
+	consent := &OAuthConsentModel{UserId: userId, ClientId: clientId, Scope: scope}
+	return dbe.DB.
+		Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_id"}, {Name: "client_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"scope", "updated_at"}),
+		}).
+		Create(consent).
+		Error
+}
+
+func (dbe *DBEngine) CreateSecurityEvent(event *SecurityEventModel) error {
+	return dbe.DB.Create(event).Error
+}
+
+func (dbe *DBEngine) RevokeSession(userId uint, sessionId uint) (bool, error) {
+	result := dbe.DB.
+		Model(&SessionModel{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", sessionId, userId).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// RevokeUserSessions revokes every user session except exceptSessionId (pass 0 to revoke all)
+func (dbe *DBEngine) RevokeUserSessions(userId uint, exceptSessionId uint) error {
+	return dbe.DB.
+		Model(&SessionModel{}).
+		Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userId, exceptSessionId).
+		Update("revoked_at", time.Now()).
+		Error
+}
+
+func (dbe *DBEngine) CreateUserServiceRelation(userId uint, serviceUsername string, serviceId uint) error {
+	exists, err := dbe.CheckUserInService(userId, serviceUsername, serviceId)
+	if err != nil || exists {
 		return err
 	}
-	if err := dbe.DB.Model(&service).Update("refresh_token", refreshToken).Error; err != nil {
+	relation := &UserServiceRelation{UserId: userId, ServiceUsername: serviceUsername, ServiceModelId: serviceId}
+	return dbe.DB.Create(relation).Error
+}
+
+// renameDuplicateUsernames prepares databases created before usernames were unique for
+// unique index. Of users sharing username, the oldest not deleted one keeps it and
+// others are renamed to username#id, every rename is logged for admins to tell users
+func (dbe *DBEngine) renameDuplicateUsernames() error {
+	migrator := dbe.DB.Migrator()
+	if !migrator.HasTable(&UserModel{}) || migrator.HasIndex(&UserModel{}, "Username") {
+		return nil
+	}
+	return dbe.DB.Transaction(func(tx *gorm.DB) error {
+		duplicates := tx.
+			Unscoped().
+			Model(&UserModel{}).
+			Select("username").
+			Group("username").
+			Having("count(*) > 1")
+		var users []UserModel
+		if err := tx.
+			Unscoped().
+			Where("username IN (?)", duplicates).
+			Order("username, deleted_at IS NOT NULL, id").
+			Find(&users).
+			Error; err != nil {
+			return err
+		}
+		for i, user := range users {
+			if i == 0 || users[i-1].Username != user.Username {
+				continue
+			}
+			username := fmt.Sprintf("%s#%d", user.Username, user.Id)
+			log.Printf("rename user %d of duplicate username %q to %q", user.Id, user.Username, username)
+			if err := tx.
+				Unscoped().
+				Model(&UserModel{}).
+				Where("id = ?", user.Id).
+				Update("username", username).
+				Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// checkDuplicateServiceNames stops migration of databases having services of the same name,
+// unlike usernames they are client ids configured in clients and can't be renamed silently
+func (dbe *DBEngine) checkDuplicateServiceNames() error {
+	migrator := dbe.DB.Migrator()
+	if !migrator.HasTable(&ServiceModel{}) || migrator.HasIndex(&ServiceModel{}, "Name") {
+		return nil
+	}
+	var names []string
+	if err := dbe.DB.
+		Unscoped().
+		Model(&ServiceModel{}).
+		Group("name").
+		Having("count(*) > 1").
+		Pluck("name", &names).
+		Error; err != nil {
 		return err
 	}
+	if len(names) > 0 {
+		return fmt.Errorf("services %q share names, rename or delete them to migrate", names)
+	}
 	return nil
 }
 
-func (dbe *DBEngine) CheckUserInService(userId uint, serviceUsername string, serviceId uint) (bool, error) {
-	relation := &UserServiceRelation{}
+// SeedRoles makes sure role exists and has all of permissions
+func (dbe *DBEngine) SeedRoles(role RoleModel, permissions []PermissionModel) error {
+	return dbe.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.
+			Where(RoleModel{Name: role.Name}).
+			Attrs(RoleModel{Description: role.Description}).
+			FirstOrCreate(&role).
+			Error; err != nil {
+			return err
+		}
+		for _, permission := range permissions {
+			if err := tx.
+				Where(PermissionModel{Name: permission.Name}).
+				Attrs(PermissionModel{Description: permission.Description}).
+				FirstOrCreate(&permission).
+				Error; err != nil {
+				return err
+			}
+			if err := tx.
+				Clauses(clause.OnConflict{DoNothing: true}).
+				Create(&RolePermission{RoleId: role.Id, PermissionId: permission.Id}).
+				Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func assignRole(db *gorm.DB, roleId uint, userIds []uint) error {
+	if len(userIds) == 0 {
+		return nil
+	}
+	userRoles := make([]UserRole, 0, len(userIds))
+	for _, userId := range userIds {
+		userRoles = append(userRoles, UserRole{UserId: userId, RoleId: roleId})
+	}
+	return db.
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&userRoles).
+		Error
+}
+
+// AssignRoleByUsernames gives role to users with given usernames
+func (dbe *DBEngine) AssignRoleByUsernames(roleName string, usernames []string) error {
+	if len(usernames) == 0 {
+		return nil
+	}
+	role, err := dbe.GetRoleByName(roleName)
+	if err != nil {
+		return err
+	}
+	var userIds []uint
+	if err := dbe.DB.
+		Model(&UserModel{}).
+		Where("username IN ?", usernames).
+		Pluck("id", &userIds).
+		Error; err != nil {
+		return err
+	}
+	return assignRole(dbe.DB, role.Id, userIds)
+}
+
+func (dbe *DBEngine) AssignRole(userId uint, roleId uint) error {
+	return assignRole(dbe.DB, roleId, []uint{userId})
+}
+
+// UnassignRole returns false if user hasn't had the role
+func (dbe *DBEngine) UnassignRole(userId uint, roleId uint) (bool, error) {
+	result := dbe.DB.
+		Where("user_id = ? AND role_id = ?", userId, roleId).
+		Delete(&UserRole{})
+	return result.RowsAffected > 0, result.Error
+}
+
+// GetUserAccess returns names of user roles and of permissions they grant
+func (dbe *DBEngine) GetUserAccess(userId uint) ([]string, []string, error) {
+	var roles []string
+	if err := dbe.DB.
+		Model(&RoleModel{}).
+		Joins("JOIN user_roles ON user_roles.role_id = role_models.id").
+		Where("user_roles.user_id = ?", userId).
+		Order("role_models.name").
+		Pluck("role_models.name", &roles).
+		Error; err != nil {
+		return nil, nil, err
+	}
+
+	var permissions []string
+	if err := dbe.DB.
+		Model(&PermissionModel{}).
+		Distinct("permission_models.name").
+		Joins("JOIN role_permissions ON role_permissions.permission_id = permission_models.id").
+		Joins("JOIN user_roles ON user_roles.role_id = role_permissions.role_id").
+		Where("user_roles.user_id = ?", userId).
+		Order("permission_models.name").
+		Pluck("permission_models.name", &permissions).
+		Error; err != nil {
+		return nil, nil, err
+	}
+
+	return roles, permissions, nil
+}
+
+func (dbe *DBEngine) UserHasPermission(userId uint, permission string) (bool, error) {
 	var exists bool
 	if err := dbe.DB.
-		Model(&relation).
+		Model(&UserRole{}).
 		Select("count(*) > 0").
-		Where("user_id = ? AND service_username = ? AND service_id = ?", userId, serviceUsername, serviceId).
+		Joins("JOIN role_permissions ON role_permissions.role_id = user_roles.role_id").
+		Joins("JOIN permission_models ON permission_models.id = role_permissions.permission_id").
+		Where("user_roles.user_id = ? AND permission_models.name = ?", userId, permission).
 		Find(&exists).
 		Error; err != nil {
 		return false, err
@@ -204,3 +915,738 @@ func (dbe *DBEngine) CheckUserInService(userId uint, serviceUsername string, ser
 
 	return exists, nil
 }
+
+func (dbe *DBEngine) GetUserRoles(userId uint) ([]RoleModel, error) {
+	var roles []RoleModel
+	if err := dbe.DB.
+		Joins("JOIN user_roles ON user_roles.role_id = role_models.id").
+		Where("user_roles.user_id = ?", userId).
+		Order("role_models.name").
+		Find(&roles).
+		Error; err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+func (dbe *DBEngine) CreateRole(name string, description string) (*RoleModel, error) {
+	role := &RoleModel{Name: name, Description: description}
+	if err := dbe.DB.Create(role).Error; err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+func (dbe *DBEngine) GetRoles() ([]RoleModel, error) {
+	var roles []RoleModel
+	if err := dbe.DB.Order("name").Find(&roles).Error; err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+func (dbe *DBEngine) GetRoleById(roleId uint) (*RoleModel, error) {
+	role := &RoleModel{}
+	if err := dbe.DB.
+		Where("id = ?", roleId).
+		Take(&role).
+		Error; err != nil {
+		return nil, err
+	}
+
+	return role, nil
+}
+
+func (dbe *DBEngine) GetRoleByName(name string) (*RoleModel, error) {
+	role := &RoleModel{}
+	if err := dbe.DB.
+		Where("name = ?", name).
+		Take(&role).
+		Error; err != nil {
+		return nil, err
+	}
+
+	return role, nil
+}
+
+// DeleteRole deletes role together with its assignments
+func (dbe *DBEngine) DeleteRole(roleId uint) error {
+	return dbe.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("role_id = ?", roleId).Delete(&RolePermission{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("role_id = ?", roleId).Delete(&UserRole{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&RoleModel{}, roleId).Error
+	})
+}
+
+// GetRolesPermissions returns permission names of every role by role id
+func (dbe *DBEngine) GetRolesPermissions() (map[uint][]string, error) {
+	var rows []struct {
+		RoleId uint
+		Name   string
+	}
+	if err := dbe.DB.
+		Model(&RolePermission{}).
+		Select("role_permissions.role_id, permission_models.name").
+		Joins("JOIN permission_models ON permission_models.id = role_permissions.permission_id").
+		Order("permission_models.name").
+		Scan(&rows).
+		Error; err != nil {
+		return nil, err
+	}
+
+	permissions := map[uint][]string{}
+	for _, row := range rows {
+		permissions[row.RoleId] = append(permissions[row.RoleId], row.Name)
+	}
+	return permissions, nil
+}
+
+func (dbe *DBEngine) CreatePermission(name string, description string) (*PermissionModel, error) {
+	permission := &PermissionModel{Name: name, Description: description}
+	if err := dbe.DB.Create(permission).Error; err != nil {
+		return nil, err
+	}
+	return permission, nil
+}
+
+func (dbe *DBEngine) GetPermissions() ([]PermissionModel, error) {
+	var permissions []PermissionModel
+	if err := dbe.DB.Order("name").Find(&permissions).Error; err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
+func (dbe *DBEngine) GetPermissionById(permissionId uint) (*PermissionModel, error) {
+	permission := &PermissionModel{}
+	if err := dbe.DB.
+		Where("id = ?", permissionId).
+		Take(&permission).
+		Error; err != nil {
+		return nil, err
+	}
+
+	return permission, nil
+}
+
+func (dbe *DBEngine) GetPermissionByName(name string) (*PermissionModel, error) {
+	permission := &PermissionModel{}
+	if err := dbe.DB.
+		Where("name = ?", name).
+		Take(&permission).
+		Error; err != nil {
+		return nil, err
+	}
+
+	return permission, nil
+}
+
+// DeletePermission deletes permission and takes it from all roles
+func (dbe *DBEngine) DeletePermission(permissionId uint) error {
+	return dbe.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("permission_id = ?", permissionId).Delete(&RolePermission{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&PermissionModel{}, permissionId).Error
+	})
+}
+
+func (dbe *DBEngine) GrantPermission(roleId uint, permissionId uint) error {
+	return dbe.DB.
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&RolePermission{RoleId: roleId, PermissionId: permissionId}).
+		Error
+}
+
+// RevokePermission returns false if role hasn't had the permission
+func (dbe *DBEngine) RevokePermission(roleId uint, permissionId uint) (bool, error) {
+	result := dbe.DB.
+		Where("role_id = ? AND permission_id = ?", roleId, permissionId).
+		Delete(&RolePermission{})
+	return result.RowsAffected > 0, result.Error
+}
+
+// CreateTeam creates team with its creator as owner
+func (dbe *DBEngine) CreateTeam(name string, ownerId uint) (*TeamModel, error) {
+	team := &TeamModel{Name: name}
+	err := dbe.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(team).Error; err != nil {
+			return err
+		}
+		return tx.Create(&TeamMembership{TeamId: team.Id, UserId: ownerId, Role: teamRoleOwner}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return team, nil
+}
+
+func (dbe *DBEngine) GetTeamById(teamId uint) (*TeamModel, error) {
+	team := &TeamModel{}
+	if err := dbe.DB.
+		Where("id = ?", teamId).
+		Take(&team).
+		Error; err != nil {
+		return nil, err
+	}
+
+	return team, nil
+}
+
+// DeleteTeam deletes team with its memberships and invitations
+// and unselects it in sessions
+func (dbe *DBEngine) DeleteTeam(teamId uint) error {
+	return dbe.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("team_id = ?", teamId).Delete(&TeamMembership{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("team_id = ?", teamId).Delete(&TeamInvitationModel{}).Error; err != nil {
+			return err
+		}
+		if err := tx.
+			Model(&SessionModel{}).
+			Where("active_team_id = ?", teamId).
+			Update("active_team_id", 0).
+			Error; err != nil {
+			return err
+		}
+		return tx.Delete(&TeamModel{}, teamId).Error
+	})
+}
+
+// UserTeam is a team together with user role in it
+type UserTeam struct {
+	TeamModel
+	Role string
+}
+
+func (dbe *DBEngine) GetUserTeams(userId uint) ([]UserTeam, error) {
+	var teams []UserTeam
+	if err := dbe.DB.
+		Model(&TeamModel{}).
+		Select("team_models.*, team_memberships.role").
+		Joins("JOIN team_memberships ON team_memberships.team_id = team_models.id").
+		Where("team_memberships.user_id = ?", userId).
+		Order("team_models.name").
+		Scan(&teams).
+		Error; err != nil {
+		return nil, err
+	}
+
+	return teams, nil
+}
+
+func (dbe *DBEngine) GetTeamMembership(teamId uint, userId uint) (*TeamMembership, error) {
+	membership := &TeamMembership{}
+	if err := dbe.DB.
+		Where("team_id = ? AND user_id = ?", teamId, userId).
+		Take(&membership).
+		Error; err != nil {
+		return nil, err
+	}
+
+	return membership, nil
+}
+
+// TeamMember is a team membership together with username
+type TeamMember struct {
+	TeamMembership
+	Username string
+}
+
+func (dbe *DBEngine) GetTeamMembers(teamId uint) ([]TeamMember, error) {
+	var members []TeamMember
+	if err := dbe.DB.
+		Model(&TeamMembership{}).
+		Select("team_memberships.*, user_models.username").
+		Joins("JOIN user_models ON user_models.id = team_memberships.user_id").
+		Where("team_memberships.team_id = ?", teamId).
+		Order("user_models.username").
+		Scan(&members).
+		Error; err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+func (dbe *DBEngine) CountTeamOwners(teamId uint) (int64, error) {
+	var owners int64
+	if err := dbe.DB.
+		Model(&TeamMembership{}).
+		Where("team_id = ? AND role = ?", teamId, teamRoleOwner).
+		Count(&owners).
+		Error; err != nil {
+		return 0, err
+	}
+
+	return owners, nil
+}
+
+func (dbe *DBEngine) UpdateTeamMemberRole(teamId uint, userId uint, role string) error {
+	return dbe.DB.
+		Model(&TeamMembership{}).
+		Where("team_id = ? AND user_id = ?", teamId, userId).
+		Update("role", role).
+		Error
+}
+
+// RemoveTeamMember removes user from team and unselects team in user sessions
+func (dbe *DBEngine) RemoveTeamMember(teamId uint, userId uint) error {
+	return dbe.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.
+			Where("team_id = ? AND user_id = ?", teamId, userId).
+			Delete(&TeamMembership{}).
+			Error; err != nil {
+			return err
+		}
+		return tx.
+			Model(&SessionModel{}).
+			Where("user_id = ? AND active_team_id = ?", userId, teamId).
+			Update("active_team_id", 0).
+			Error
+	})
+}
+
+func (dbe *DBEngine) SetSessionTeam(sessionId uint, teamId uint) error {
+	return dbe.DB.
+		Model(&SessionModel{}).
+		Where("id = ?", sessionId).
+		Update("active_team_id", teamId).
+		Error
+}
+
+// CreateTeamInvitation stores invitation filled with invitee, inviter and role
+func (dbe *DBEngine) CreateTeamInvitation(invitation *TeamInvitationModel, ttl time.Duration) (*TeamInvitationModel, error) {
+	now := time.Now()
+	invitation.CreatedAt = now
+	invitation.ExpiresAt = now.Add(ttl)
+	if err := dbe.DB.Create(invitation).Error; err != nil {
+		return nil, err
+	}
+	return invitation, nil
+}
+
+// TeamInvitation is an invitation together with team name
+type TeamInvitation struct {
+	TeamInvitationModel
+	TeamName string
+}
+
+// getPendingInvitations returns not answered and not expired invitations matching condition
+func (dbe *DBEngine) getPendingInvitations(query string, args ...interface{}) ([]TeamInvitation, error) {
+	var invitations []TeamInvitation
+	if err := dbe.DB.
+		Model(&TeamInvitationModel{}).
+		Select("team_invitation_models.*, team_models.name AS team_name").
+		Joins("JOIN team_models ON team_models.id = team_invitation_models.team_id").
+		Where("team_invitation_models.accepted_at IS NULL AND team_invitation_models.declined_at IS NULL").
+		Where("team_invitation_models.expires_at > ?", time.Now()).
+		Where(query, args...).
+		Order("team_invitation_models.created_at DESC").
+		Scan(&invitations).
+		Error; err != nil {
+		return nil, err
+	}
+
+	return invitations, nil
+}
+
+func (dbe *DBEngine) GetTeamInvitations(teamId uint) ([]TeamInvitation, error) {
+	return dbe.getPendingInvitations("team_invitation_models.team_id = ?", teamId)
+}
+
+func (dbe *DBEngine) GetUserInvitations(userId uint) ([]TeamInvitation, error) {
+	return dbe.getPendingInvitations("team_invitation_models.user_id = ?", userId)
+}
+
+// CheckPendingInvitation reports whether invitee of invitation has another pending invitation into team
+func (dbe *DBEngine) CheckPendingInvitation(invitation *TeamInvitationModel) (bool, error) {
+	query := "team_invitation_models.team_id = ? AND team_invitation_models.username = ?"
+	invitee := invitation.Username
+	if invitee == "" {
+		query = "team_invitation_models.team_id = ? AND team_invitation_models.email = ?"
+		invitee = invitation.Email
+	}
+	invitations, err := dbe.getPendingInvitations(query, invitation.TeamId, invitee)
+	if err != nil {
+		return false, err
+	}
+	return len(invitations) > 0, nil
+}
+
+func (dbe *DBEngine) GetTeamInvitationById(invitationId uint) (*TeamInvitationModel, error) {
+	invitation := &TeamInvitationModel{}
+	if err := dbe.DB.
+		Where("id = ?", invitationId).
+		Take(&invitation).
+		Error; err != nil {
+		return nil, err
+	}
+
+	return invitation, nil
+}
+
+var errInvitationUnavailable = errors.New("invitation is answered or expired")
+
+// acceptInvitation marks invitation accepted by user and makes user a team member
+func acceptInvitation(tx *gorm.DB, invitation *TeamInvitationModel, userId uint) error {
+	now := time.Now()
+	result := tx.
+		Model(&TeamInvitationModel{}).
+		Where("id = ? AND accepted_at IS NULL AND declined_at IS NULL AND expires_at > ?", invitation.Id, now).
+		Updates(map[string]interface{}{"accepted_at": now, "user_id": userId})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errInvitationUnavailable
+	}
+	return tx.
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&TeamMembership{TeamId: invitation.TeamId, UserId: userId, Role: invitation.Role}).
+		Error
+}
+
+// AcceptTeamInvitation makes user a team member. It returns errInvitationUnavailable
+// if invitation has been already answered or has expired
+func (dbe *DBEngine) AcceptTeamInvitation(invitation *TeamInvitationModel, userId uint) error {
+	return dbe.DB.Transaction(func(tx *gorm.DB) error {
+		return acceptInvitation(tx, invitation, userId)
+	})
+}
+
+// CreateInvitedUser signs up user accepting invitation, nothing is created if invitation is unavailable.
+// Email stays unverified, codes are handed to inviters rather than mailed to invitees
+func (dbe *DBEngine) CreateInvitedUser(username string, password string, email string, invitation *TeamInvitationModel) (*UserModel, error) {
+	hash, err := dbe.passwords.Hash(password)
+	if err != nil {
+		return nil, err
+	}
+	user := &UserModel{Username: username, Password: hash}
+	if email != "" {
+		user.Email = &email
+	}
+	err = dbe.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		return acceptInvitation(tx, invitation, user.Id)
+	})
+	if isUniqueViolation(err) {
+		return nil, errDuplicate
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// DeclineTeamInvitation returns false if invitation has been already answered
+func (dbe *DBEngine) DeclineTeamInvitation(invitationId uint) (bool, error) {
+	result := dbe.DB.
+		Model(&TeamInvitationModel{}).
+		Where("id = ? AND accepted_at IS NULL AND declined_at IS NULL", invitationId).
+		Update("declined_at", time.Now())
+	return result.RowsAffected > 0, result.Error
+}
+
+func (dbe *DBEngine) DeleteTeamInvitation(invitationId uint) error {
+	return dbe.DB.Delete(&TeamInvitationModel{}, invitationId).Error
+}
+
+var errMfaEnabled = errors.New("two-factor authentication is already enabled")
+
+// SetTotp starts TOTP enrollment with encrypted secret, replacing unconfirmed one.
+// Confirmed TOTP has to be disabled first
+func (dbe *DBEngine) SetTotp(userId uint, secret string) error {
+	return dbe.DB.Transaction(func(tx *gorm.DB) error {
+		existing := &TotpModel{}
+		err := tx.Where("user_id = ?", userId).Take(&existing).Error
+		if err == nil && existing.ConfirmedAt != nil {
+			return errMfaEnabled
+		}
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userId).Delete(&TotpModel{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&TotpModel{UserId: userId, Secret: secret}).Error
+	})
+}
+
+func (dbe *DBEngine) GetTotp(userId uint) (*TotpModel, error) {
+	totp := &TotpModel{}
+	if err := dbe.DB.
+		Where("user_id = ?", userId).
+		Take(&totp).
+		Error; err != nil {
+		return nil, err
+	}
+
+	return totp, nil
+}
+
+// replaceRecoveryCodes drops all recovery codes of user and stores digests of new ones
+func replaceRecoveryCodes(tx *gorm.DB, userId uint, codeHashes []string) error {
+	if err := tx.Where("user_id = ?", userId).Delete(&RecoveryCodeModel{}).Error; err != nil {
+		return err
+	}
+	codes := make([]RecoveryCodeModel, 0, len(codeHashes))
+	for _, hash := range codeHashes {
+		codes = append(codes, RecoveryCodeModel{UserId: userId, CodeHash: hash})
+	}
+	return tx.Create(&codes).Error
+}
+
+// ConfirmTotp enables TOTP of user by code of time step and stores recovery codes.
+// It returns false if TOTP is already confirmed or code of step has been used
+func (dbe *DBEngine) ConfirmTotp(userId uint, step int64, codeHashes []string) (bool, error) {
+	confirmed := false
+	err := dbe.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.
+			Model(&TotpModel{}).
+			Where("user_id = ? AND confirmed_at IS NULL AND last_step < ?", userId, step).
+			Updates(map[string]interface{}{"confirmed_at": time.Now(), "last_step": step, "failed_attempts": 0})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		confirmed = true
+		return replaceRecoveryCodes(tx, userId, codeHashes)
+	})
+	return confirmed, err
+}
+
+func (dbe *DBEngine) ReplaceRecoveryCodes(userId uint, codeHashes []string) error {
+	return dbe.DB.Transaction(func(tx *gorm.DB) error {
+		return replaceRecoveryCodes(tx, userId, codeHashes)
+	})
+}
+
+// CountRecoveryCodes returns how many unused recovery codes user has left
+func (dbe *DBEngine) CountRecoveryCodes(userId uint) (int64, error) {
+	var count int64
+	err := dbe.DB.
+		Model(&RecoveryCodeModel{}).
+		Where("user_id = ? AND used_at IS NULL", userId).
+		Count(&count).
+		Error
+	return count, err
+}
+
+// UseTotpStep accepts code of time step once, later steps only
+func (dbe *DBEngine) UseTotpStep(userId uint, step int64) (bool, error) {
+	result := dbe.DB.
+		Model(&TotpModel{}).
+		Where("user_id = ? AND confirmed_at IS NOT NULL AND last_step < ?", userId, step).
+		Updates(map[string]interface{}{"last_step": step, "failed_attempts": 0})
+	return result.RowsAffected > 0, result.Error
+}
+
+// UseRecoveryCode marks recovery code used, it returns false for unknown or used code
+func (dbe *DBEngine) UseRecoveryCode(userId uint, codeHash string) (bool, error) {
+	used := false
+	err := dbe.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.
+			Model(&RecoveryCodeModel{}).
+			Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userId, codeHash).
+			Update("used_at", time.Now())
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		used = true
+		return tx.
+			Model(&TotpModel{}).
+			Where("user_id = ?", userId).
+			Update("failed_attempts", 0).
+			Error
+	})
+	return used, err
+}
+
+// RecordMfaFailure counts wrong code, every mfaMaxFailures in a row lock second factor for mfaLockout
+func (dbe *DBEngine) RecordMfaFailure(userId uint) error {
+	return dbe.DB.
+		Model(&TotpModel{}).
+		Where("user_id = ?", userId).
+		Updates(map[string]interface{}{
+			"locked_until": gorm.Expr("CASE WHEN failed_attempts + 1 >= ? THEN ? ELSE locked_until END",
+				mfaMaxFailures, time.Now().Add(mfaLockout)),
+			"failed_attempts": gorm.Expr("CASE WHEN failed_attempts + 1 >= ? THEN 0 ELSE failed_attempts + 1 END",
+				mfaMaxFailures),
+		}).
+		Error
+}
+
+// DeleteTotp disables second factor of user together with recovery codes
+func (dbe *DBEngine) DeleteTotp(userId uint) error {
+	return dbe.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userId).Delete(&RecoveryCodeModel{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userId).Delete(&TotpModel{}).Error
+	})
+}
+
+func (dbe *DBEngine) CreateWebAuthnCredential(credential *WebAuthnCredentialModel) error {
+	err := dbe.DB.Create(credential).Error
+	if isUniqueViolation(err) {
+		return errDuplicate
+	}
+	return err
+}
+
+func (dbe *DBEngine) GetWebAuthnCredentials(userId uint) ([]WebAuthnCredentialModel, error) {
+	var credentials []WebAuthnCredentialModel
+	if err := dbe.DB.
+		Where("user_id = ?", userId).
+		Order("created_at").
+		Find(&credentials).
+		Error; err != nil {
+		return nil, err
+	}
+
+	return credentials, nil
+}
+
+func (dbe *DBEngine) GetWebAuthnCredential(credentialId string) (*WebAuthnCredentialModel, error) {
+	credential := &WebAuthnCredentialModel{}
+	if err := dbe.DB.
+		Where("credential_id = ?", credentialId).
+		Take(&credential).
+		Error; err != nil {
+		return nil, err
+	}
+
+	return credential, nil
+}
+
+// DeleteWebAuthnCredential returns false if user has no such credential
+func (dbe *DBEngine) DeleteWebAuthnCredential(userId uint, id uint) (bool, error) {
+	result := dbe.DB.
+		Where("id = ? AND user_id = ?", id, userId).
+		Delete(&WebAuthnCredentialModel{})
+	return result.RowsAffected > 0, result.Error
+}
+
+// UseWebAuthnCredential stores new signature counter of credential used for sign-in.
+// It returns false if counter has changed since credential was read, that is
+// the same assertion or a cloned authenticator is racing
+func (dbe *DBEngine) UseWebAuthnCredential(id uint, previousCount int64, signCount int64) (bool, error) {
+	result := dbe.DB.
+		Model(&WebAuthnCredentialModel{}).
+		Where("id = ? AND sign_count = ?", id, previousCount).
+		Updates(map[string]interface{}{"sign_count": signCount, "last_used_at": time.Now()})
+	return result.RowsAffected > 0, result.Error
+}
+
+// UpdateLoginAttempt applies update to record of key, creating it if needed.
+// Row is locked, so that concurrent failures are all counted
+func (dbe *DBEngine) UpdateLoginAttempt(key string, update func(*LoginAttemptModel)) (*LoginAttemptModel, error) {
+	attempt := &LoginAttemptModel{}
+	err := dbe.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.
+			Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&LoginAttemptModel{AttemptKey: key}).
+			Error; err != nil {
+			return err
+		}
+		if err := tx.
+			Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("attempt_key = ?", key).
+			Take(&attempt).
+			Error; err != nil {
+			return err
+		}
+		update(attempt)
+		return tx.Save(attempt).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attempt, nil
+}
+
+// RefundLoginAttempt takes back one failure of key
+func (dbe *DBEngine) RefundLoginAttempt(key string) error {
+	return dbe.DB.
+		Model(&LoginAttemptModel{}).
+		Where("attempt_key = ? AND failures > 0", key).
+		Update("failures", gorm.Expr("failures - 1")).
+		Error
+}
+
+func (dbe *DBEngine) DeleteLoginAttempt(key string) error {
+	return dbe.DB.Where("attempt_key = ?", key).Delete(&LoginAttemptModel{}).Error
+}
+
+func (dbe *DBEngine) GetLockedLoginAttempts(now time.Time) ([]LoginAttemptModel, error) {
+	var attempts []LoginAttemptModel
+	if err := dbe.DB.
+		Where("locked_until > ?", now).
+		Order("locked_until DESC").
+		Find(&attempts).
+		Error; err != nil {
+		return nil, err
+	}
+
+	return attempts, nil
+}
+
+// PruneLoginAttempts drops records without failures since before and not locked at now
+func (dbe *DBEngine) PruneLoginAttempts(before time.Time, now time.Time) (int64, error) {
+	result := dbe.DB.
+		Where("last_failure_at < ? AND locked_until <= ?", before, now).
+		Delete(&LoginAttemptModel{})
+	return result.RowsAffected, result.Error
+}
+
+// UpdateRateLimitBucket applies update to bucket of key under row lock,
+// new bucket has zero UpdatedAt
+func (dbe *DBEngine) UpdateRateLimitBucket(key string, update func(*RateLimitBucketModel)) error {
+	return dbe.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.
+			Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&RateLimitBucketModel{BucketKey: key}).
+			Error; err != nil {
+			return err
+		}
+		bucket := &RateLimitBucketModel{}
+		if err := tx.
+			Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("bucket_key = ?", key).
+			Take(&bucket).
+			Error; err != nil {
+			return err
+		}
+		update(bucket)
+		return tx.Save(bucket).Error
+	})
+}
+
+func (dbe *DBEngine) PruneRateLimitBuckets(before time.Time) (int64, error) {
+	result := dbe.DB.Where("updated_at < ?", before).Delete(&RateLimitBucketModel{})
+	return result.RowsAffected, result.Error
+}
+
+func (dbe *DBEngine) GetSigningKeys() ([]SigningKeyModel, error) {
+	var keys []SigningKeyModel
+	if err := dbe.DB.Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (dbe *DBEngine) SaveSigningKey(key *SigningKeyModel) error {
+	return dbe.DB.Save(key).Error
+}
+
+func (dbe *DBEngine) DeleteSigningKey(kid string) error {
+	return dbe.DB.Where("kid = ?", kid).Delete(&SigningKeyModel{}).Error
+}
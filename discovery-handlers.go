@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"log"
+	"strings"
+)
+
+// keysCacheAge must stay well below key overlap period,
+// so that verifiers see new keys before retired ones disappear
+const keysCacheAge = 300
+
+func (s *Server) HandleJWKS(c *fiber.Ctx) error {
+	log.Printf("handle jwks at %s", c.Path())
+
+	keys := s.tokens.Keys.Keys()
+	response := JWKSResponse{Keys: make([]JWK, 0, len(keys))}
+	for _, sk := range keys {
+		publicKey := sk.PublicKey()
+		response.Keys = append(response.Keys, JWK{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: "RS256",
+			Kid: sk.Kid,
+			N:   rsaModulus(publicKey),
+			E:   rsaExponent(publicKey),
+		})
+	}
+
+	c.Set(fiber.HeaderCacheControl, fmt.Sprintf("public, max-age=%d", keysCacheAge))
+	return c.JSON(response)
+}
+
+func (s *Server) HandleDiscovery(c *fiber.Ctx) error {
+	log.Printf("handle discovery at %s", c.Path())
+
+	issuer := strings.TrimSuffix(s.tokens.Issuer, "/")
+	response := DiscoveryResponse{
+		Issuer:                           issuer,
+		JwksUri:                          issuer + "/.well-known/jwks.json",
+		AuthorizationEndpoint:            issuer + authorizePath,
+		TokenEndpoint:                    issuer + "/oauth/token",
+		UserinfoEndpoint:                 issuer + "/userinfo",
+		RevocationEndpoint:               issuer + "/oauth/revoke",
+		IntrospectionEndpoint:            issuer + "/oauth/introspect",
+		ScopesSupported:                  []string{"openid", "profile", "email"},
+		ResponseTypesSupported:           []string{"code"},
+		GrantTypesSupported:              []string{"authorization_code", "client_credentials", "refresh_token"},
+		TokenEndpointAuthMethods:         []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:    []string{"S256"},
+		SubjectTypesSupported:            []string{"public"},
+		IdTokenSigningAlgValuesSupported: []string{"RS256"},
+		ClaimsSupported:                  []string{"iss", "sub", "aud", "exp", "iat", "jti", "auth_time", "nonce", "preferred_username", "updated_at", "email", "email_verified"},
+	}
+
+	c.Set(fiber.HeaderCacheControl, fmt.Sprintf("public, max-age=%d", keysCacheAge))
+	return c.JSON(response)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	emailVerificationTTL = 24 * time.Hour
+	// emailResendInterval is the least time between verification emails to one user
+	emailResendInterval = time.Minute
+)
+
+var errEmailUsed = errors.New("email is already used")
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// emailAvailable checks that no other user has email
+func (s *Server) emailAvailable(email string, userId uint) error {
+	owner, err := s.dbe.GetUserByEmail(email)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if owner.Id != userId {
+		return errEmailUsed
+	}
+	return nil
+}
+
+// verificationThrottle returns how long user has to wait before next verification email
+func (s *Server) verificationThrottle(userId uint) (time.Duration, error) {
+	last, err := s.dbe.GetLastEmailVerification(userId)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return time.Until(last.CreatedAt.Add(emailResendInterval)), nil
+}
+
+// sendEmailVerification mails verification token of email to user
+func (s *Server) sendEmailVerification(user *UserModel, email string) error {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return err
+	}
+	if err := s.dbe.CreateEmailVerification(user.Id, email, hashOpaqueToken(token)); err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Hello, %s!\n\nConfirm your email address with verification code:\n\n%s\n", user.Username, token)
+	if link := frontendLink(s.emailVerifyLink, "token", token); link != "" {
+		body = fmt.Sprintf("Hello, %s!\n\nConfirm your email address by opening the link:\n\n%s\n", user.Username, link)
+	}
+	body += fmt.Sprintf("\nThe code expires in %s. If you didn't ask for it, ignore this email.\n", emailVerificationTTL)
+
+	return s.mailer.Send(Mail{To: email, Subject: "Confirm your email", Body: body})
+}
+
+// HandleSetEmail sets or changes email of current user and sends verification to it
+func (s *Server) HandleSetEmail(c *fiber.Ctx) error {
+	log.Printf("handle set email at %s", c.Path())
+
+	var req emailRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect email")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationError(err)
+	}
+	email := normalizeEmail(req.Email)
+
+	user, err := s.dbe.GetUserById(userClaims(c).UserInfo.Id)
+	if err != nil {
+		return apiError(codeTokenInvalid, "no such user")
+	}
+	if user.Email != nil && *user.Email == email && user.EmailVerified() {
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+	err = s.emailAvailable(email, user.Id)
+	if errors.Is(err, errEmailUsed) {
+		return apiError(codeEmailTaken, "email is already used")
+	}
+	if err != nil {
+		return apiError(codeInternal, "can't check email")
+	}
+	wait, err := s.verificationThrottle(user.Id)
+	if err != nil {
+		return apiError(codeInternal, "can't check email")
+	}
+	if wait > 0 {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(wait/time.Second)+1))
+		return apiError(codeRateLimited, "verification email has been sent recently")
+	}
+
+	err = s.dbe.SetUserEmail(user.Id, email)
+	if errors.Is(err, errDuplicate) {
+		return apiError(codeEmailTaken, "email is already used")
+	}
+	if err != nil {
+		return apiError(codeInternal, "can't set email")
+	}
+	if err := s.sendEmailVerification(user, email); err != nil {
+		log.Printf("can't send verification to user %d: %s", user.Id, err)
+		return apiError(codeUnavailable, "can't send verification email")
+	}
+	return c.SendStatus(fiber.StatusAccepted)
+}
+
+func (s *Server) HandleVerifyEmail(c *fiber.Ctx) error {
+	log.Printf("handle verify email at %s", c.Path())
+
+	var req emailVerifyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect token")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationError(err)
+	}
+
+	verified, err := s.dbe.VerifyEmail(hashOpaqueToken(req.Token))
+	if err != nil {
+		return apiError(codeInternal, "can't verify email")
+	}
+	if !verified {
+		return apiError(codeTokenInvalid, "invalid or expired verification token")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// HandleResendEmailVerification sends new verification to not verified email. It doesn't
+// need sign-in, as unverified users may be unable to sign in, so it answers 202 whether or not
+// email is registered, and throttled requests are dropped silently
+func (s *Server) HandleResendEmailVerification(c *fiber.Ctx) error {
+	log.Printf("handle resend email verification at %s", c.Path())
+
+	var req emailRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect email")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationError(err)
+	}
+	email := normalizeEmail(req.Email)
+
+	user, err := s.dbe.GetUserByEmail(email)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.SendStatus(fiber.StatusAccepted)
+	}
+	if err != nil {
+		return apiError(codeInternal, "can't check email")
+	}
+	if user.EmailVerified() {
+		return c.SendStatus(fiber.StatusAccepted)
+	}
+	wait, err := s.verificationThrottle(user.Id)
+	if err != nil {
+		return apiError(codeInternal, "can't check email")
+	}
+	if wait > 0 {
+		log.Printf("throttle verification email to user %d", user.Id)
+		return c.SendStatus(fiber.StatusAccepted)
+	}
+
+	if err := s.sendEmailVerification(user, email); err != nil {
+		log.Printf("can't send verification to user %d: %s", user.Id, err)
+		return apiError(codeUnavailable, "can't send verification email")
+	}
+	return c.SendStatus(fiber.StatusAccepted)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// getEnv returns environment variable value or fallback if it is not set
+func getEnv(name string, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+func getEnvInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("invalid %s=%q, use default %d", name, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+func getEnvDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("invalid %s=%q, use default %s", name, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+// getEnvInterval reads period of background loop, which has to be positive
+func getEnvInterval(name string, fallback time.Duration) (time.Duration, error) {
+	interval := getEnvDuration(name, fallback)
+	if interval <= 0 {
+		return 0, fmt.Errorf("invalid %s=%s, expect positive duration", name, interval)
+	}
+	return interval, nil
+}
+
+func getEnvBool(name string, fallback bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("invalid %s=%q, use default %t", name, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+// getEnvList splits comma separated environment variable value
+func getEnvList(name string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
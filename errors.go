@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"log"
+	"reflect"
+	"strings"
+)
+
+// Stable codes of API errors, clients should match them rather than detail messages
+const (
+	codeInvalidRequest         = "invalid_request"
+	codeValidationFailed       = "validation_failed"
+	codeWeakPassword           = "weak_password"
+	codeAuthenticationRequired = "authentication_required"
+	codeInvalidCredentials     = "invalid_credentials"
+	codeTokenExpired           = "token_expired"
+	codeTokenRevoked           = "token_revoked"
+	codeTokenInvalid           = "token_invalid"
+	codeWrongTokenType         = "wrong_token_type"
+	codeInvalidCurrentPassword = "invalid_current_password"
+	codeInvalidMfaCode         = "invalid_mfa_code"
+	codeEmailNotVerified       = "email_not_verified"
+	codeForbidden              = "forbidden"
+	codeNotFound               = "not_found"
+	codeUserExists             = "user_exists"
+	codeEmailTaken             = "email_taken"
+	codeConflict               = "conflict"
+	codeGone                   = "gone"
+	codeTooManyAttempts        = "too_many_attempts"
+	codeRateLimited            = "rate_limited"
+	codeInternal               = "internal_error"
+	codeUnavailable            = "service_unavailable"
+)
+
+type errorKind struct {
+	Status int
+	Title  string
+}
+
+// errorCatalog gives status and title of every code. Current password and second
+// factor are checked for already identified user, so they fail with 403 rather than 401
+var errorCatalog = map[string]errorKind{
+	codeInvalidRequest:         {fiber.StatusBadRequest, "Invalid request"},
+	codeValidationFailed:       {fiber.StatusBadRequest, "Validation failed"},
+	codeWeakPassword:           {fiber.StatusBadRequest, "Password doesn't satisfy policy"},
+	codeAuthenticationRequired: {fiber.StatusUnauthorized, "Authentication required"},
+	codeInvalidCredentials:     {fiber.StatusUnauthorized, "Invalid credentials"},
+	codeTokenExpired:           {fiber.StatusUnauthorized, "Token expired"},
+	codeTokenRevoked:           {fiber.StatusUnauthorized, "Token revoked"},
+	codeTokenInvalid:           {fiber.StatusUnauthorized, "Invalid token"},
+	codeWrongTokenType:         {fiber.StatusUnauthorized, "Wrong token type"},
+	codeInvalidCurrentPassword: {fiber.StatusForbidden, "Invalid current password"},
+	codeInvalidMfaCode:         {fiber.StatusForbidden, "Invalid two-factor code"},
+	codeEmailNotVerified:       {fiber.StatusForbidden, "Email is not verified"},
+	codeForbidden:              {fiber.StatusForbidden, "Forbidden"},
+	codeNotFound:               {fiber.StatusNotFound, "Not found"},
+	codeUserExists:             {fiber.StatusConflict, "User already exists"},
+	codeEmailTaken:             {fiber.StatusConflict, "Email is already used"},
+	codeConflict:               {fiber.StatusConflict, "Conflict"},
+	codeGone:                   {fiber.StatusGone, "Gone"},
+	codeTooManyAttempts:        {fiber.StatusTooManyRequests, "Too many failed attempts"},
+	codeRateLimited:            {fiber.StatusTooManyRequests, "Rate limit exceeded"},
+	codeInternal:               {fiber.StatusInternalServerError, "Internal server error"},
+	codeUnavailable:            {fiber.StatusServiceUnavailable, "Service unavailable"},
+}
+
+// statusCodes are codes of plain fiber errors, like 404 of unknown route
+var statusCodes = map[int]string{
+	fiber.StatusBadRequest:          codeInvalidRequest,
+	fiber.StatusUnauthorized:        codeAuthenticationRequired,
+	fiber.StatusForbidden:           codeForbidden,
+	fiber.StatusNotFound:            codeNotFound,
+	fiber.StatusConflict:            codeConflict,
+	fiber.StatusGone:                codeGone,
+	fiber.StatusTooManyRequests:     codeRateLimited,
+	fiber.StatusInternalServerError: codeInternal,
+	fiber.StatusServiceUnavailable:  codeUnavailable,
+}
+
+// APIError is handler error with code of errorCatalog, Detail is message for humans
+type APIError struct {
+	Status int
+	Code   string
+	Detail string
+	// Errors are failed fields of validation errors
+	Errors []FieldError
+}
+
+func (e *APIError) Error() string {
+	return e.Detail
+}
+
+// apiError makes error of catalog code, it panics on unknown code
+func apiError(code string, detail string) *APIError {
+	kind, ok := errorCatalog[code]
+	if !ok {
+		panic("unknown error code " + code)
+	}
+	return &APIError{Status: kind.Status, Code: code, Detail: detail}
+}
+
+func init() {
+	// validation errors name fields as clients send them
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		for _, tag := range []string{"json", "form", "query"} {
+			name := strings.SplitN(field.Tag.Get(tag), ",", 2)[0]
+			if name == "-" {
+				return ""
+			}
+			if name != "" {
+				return name
+			}
+		}
+		return field.Name
+	})
+}
+
+// fieldRuleMessage explains failed validator rule
+func fieldRuleMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required", "required_without", "required_without_all", "required_with":
+		return "is required"
+	case "email":
+		return "must be an email address"
+	case "min":
+		return "must be at least " + fe.Param() + " long"
+	case "max":
+		return "must be at most " + fe.Param() + " long"
+	case "len":
+		return "must be " + fe.Param() + " long"
+	case "oneof":
+		return "must be one of " + fe.Param()
+	case "numeric", "number":
+		return "must be a number"
+	case "url", "uri":
+		return "must be an url"
+	default:
+		if fe.Param() != "" {
+			return fmt.Sprintf("must satisfy %s=%s", fe.Tag(), fe.Param())
+		}
+		return "must satisfy " + fe.Tag()
+	}
+}
+
+// validationError converts error of validate.Struct into validation_failed error with failed fields
+func validationError(err error) error {
+	var fieldErrors validator.ValidationErrors
+	if !errors.As(err, &fieldErrors) {
+		log.Printf("can't validate request: %s", err)
+		return apiError(codeInternal, "can't validate request")
+	}
+	apiErr := apiError(codeValidationFailed, "validation error")
+	for _, fe := range fieldErrors {
+		// namespace starts with request struct name
+		field := fe.Namespace()
+		if i := strings.IndexByte(field, '.'); i >= 0 {
+			field = field[i+1:]
+		}
+		apiErr.Errors = append(apiErr.Errors, FieldError{
+			Field:   field,
+			Rule:    fe.Tag(),
+			Message: field + " " + fieldRuleMessage(fe),
+		})
+	}
+	return apiErr
+}
+
+// problemType is URI reference of code, as RFC 7807 asks
+func problemType(code string) string {
+	return "urn:tma:error:" + code
+}
+
+// handleError is fiber error handler rendering RFC 7807 problem details. Plain fiber
+// errors get code of their status, other errors are logged and hidden behind internal_error
+func (s *Server) handleError(c *fiber.Ctx, err error) error {
+	var apiErr *APIError
+	var fiberErr *fiber.Error
+	switch {
+	case errors.As(err, &apiErr):
+	case errors.As(err, &fiberErr):
+		code, ok := statusCodes[fiberErr.Code]
+		if !ok {
+			code = strings.ToLower(strings.ReplaceAll(utils.StatusMessage(fiberErr.Code), " ", "_"))
+		}
+		apiErr = &APIError{Status: fiberErr.Code, Code: code, Detail: fiberErr.Message}
+	default:
+		log.Printf("unhandled error at %s: %s", c.Path(), err)
+		apiErr = apiError(codeInternal, "internal server error")
+	}
+
+	title := utils.StatusMessage(apiErr.Status)
+	if kind, ok := errorCatalog[apiErr.Code]; ok {
+		title = kind.Title
+	}
+	body, err := json.Marshal(ProblemResponse{
+		Type:     problemType(apiErr.Code),
+		Title:    title,
+		Status:   apiErr.Status,
+		Detail:   apiErr.Detail,
+		Instance: c.Path(),
+		Code:     apiErr.Code,
+		Errors:   apiErr.Errors,
+	})
+	if err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderContentType, "application/problem+json")
+	return c.Status(apiErr.Status).Send(body)
+}
+
+// fieldError makes validation_failed error of single field, for checks validator can't do
+func fieldError(field string, rule string, message string) *APIError {
+	err := apiError(codeValidationFailed, "validation error")
+	err.Errors = []FieldError{{Field: field, Rule: rule, Message: message}}
+	return err
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Values of token_type in introspection response, same as token_type_hint ones
+const (
+	introspectAccessToken  = "access_token"
+	introspectRefreshToken = "refresh_token"
+)
+
+// introspector describes token to client, ok is false if it doesn't know the token
+type introspector func(client *ServiceModel, token string) (response *IntrospectionResponse, ok bool, err error)
+
+// inactiveToken reports whether authentication error means token is unusable
+// rather than that it couldn't be checked
+func inactiveToken(err error) bool {
+	return errors.Is(err, errTokenInvalid) ||
+		errors.Is(err, errTokenExpired) ||
+		errors.Is(err, errTokenWrongUse) ||
+		errors.Is(err, errTokenRevoked) ||
+		errors.Is(err, gorm.ErrRecordNotFound)
+}
+
+// introspectJWT describes user or service access token. Any authenticated
+// client may introspect them, as resource servers do
+func (s *Server) introspectJWT(_ *ServiceModel, token string) (*IntrospectionResponse, bool, error) {
+	claims, err := s.authenticate(token)
+	if err == nil {
+		return &IntrospectionResponse{
+			Active:    true,
+			Scope:     accessScope(claims),
+			ClientId:  claims.ClientId,
+			Username:  claims.Username,
+			TokenType: introspectAccessToken,
+			Exp:       claims.ExpiresAt,
+			Iat:       claims.IssuedAt,
+			Sub:       strconv.FormatUint(uint64(claims.UserInfo.Id), 10),
+			Aud:       claims.Audience,
+			Iss:       claims.Issuer,
+			Jti:       claims.StandardClaims.Id,
+		}, true, nil
+	}
+	if !inactiveToken(err) {
+		return nil, false, err
+	}
+
+	serviceClaims, err := s.authenticateService(token)
+	if err == nil {
+		return &IntrospectionResponse{
+			Active:    true,
+			Scope:     serviceClaims.Scope,
+			ClientId:  serviceClaims.ClientId,
+			TokenType: introspectAccessToken,
+			Exp:       serviceClaims.ExpiresAt,
+			Iat:       serviceClaims.IssuedAt,
+			Sub:       serviceClaims.Subject,
+			Aud:       serviceClaims.Audience,
+			Iss:       serviceClaims.Issuer,
+			Jti:       serviceClaims.StandardClaims.Id,
+		}, true, nil
+	}
+	if !inactiveToken(err) {
+		return nil, false, err
+	}
+	return nil, false, nil
+}
+
+// introspectRefreshToken describes user or service refresh token,
+// only to the client it has been issued to
+func (s *Server) introspectRefreshToken(client *ServiceModel, token string) (*IntrospectionResponse, bool, error) {
+	digest := hashOpaqueToken(token)
+	now := time.Now()
+
+	refreshToken, err := s.dbe.GetRefreshToken(digest)
+	if err == nil {
+		session, err := s.dbe.GetSessionById(refreshToken.SessionId)
+		if err != nil {
+			return nil, false, err
+		}
+		if refreshToken.RotatedAt != nil || !session.Active(now) || session.ClientId != client.Name {
+			return nil, false, nil
+		}
+		user, err := s.dbe.GetUserById(session.UserId)
+		if err != nil {
+			return nil, false, err
+		}
+		return &IntrospectionResponse{
+			Active:    true,
+			Scope:     session.Scope,
+			ClientId:  session.ClientId,
+			Username:  user.Username,
+			TokenType: introspectRefreshToken,
+			Exp:       session.ExpiresAt.Unix(),
+			Iat:       refreshToken.CreatedAt.Unix(),
+			Sub:       subject(user),
+			Iss:       s.tokens.Issuer,
+		}, true, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, err
+	}
+
+	service, err := s.dbe.GetServiceByRefreshToken(digest)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if service.Id != client.Id || now.After(service.RefreshTokenExpiresAt) {
+		return nil, false, nil
+	}
+	return &IntrospectionResponse{
+		Active:    true,
+		Scope:     intersectScope(service.RefreshTokenScope, service.Scopes),
+		ClientId:  service.Name,
+		TokenType: introspectRefreshToken,
+		Exp:       service.RefreshTokenExpiresAt.Unix(),
+		Sub:       service.Name,
+		Iss:       s.tokens.Issuer,
+	}, true, nil
+}
+
+// HandleOAuthIntrospect is RFC 7662 introspection endpoint for registered clients.
+// Unlike local signature check it sees revoked tokens and sessions
+func (s *Server) HandleOAuthIntrospect(c *fiber.Ctx) error {
+	log.Printf("handle oauth introspect at %s", c.Path())
+
+	var req introspectRequest
+	if err := c.BodyParser(&req); err != nil {
+		return oauthError(c, fiber.StatusBadRequest, oauthInvalidRequest, "malformed request body")
+	}
+
+	client, err := s.authenticateClient(c, &req.clientAuth)
+	if err != nil {
+		log.Printf("reject client: %s", err)
+		return oauthError(c, fiber.StatusUnauthorized, oauthInvalidClient, "client authentication failed")
+	}
+	if err := validate.Struct(req); err != nil {
+		return oauthError(c, fiber.StatusBadRequest, oauthInvalidRequest, "token is required")
+	}
+
+	// hint only decides which kind is tried first
+	introspectors := []introspector{s.introspectJWT, s.introspectRefreshToken}
+	if req.TokenTypeHint == introspectRefreshToken {
+		introspectors = []introspector{s.introspectRefreshToken, s.introspectJWT}
+	}
+
+	response := &IntrospectionResponse{Active: false}
+	for _, introspect := range introspectors {
+		described, ok, err := introspect(client, req.Token)
+		if err != nil {
+			log.Printf("can't introspect token: %s", err)
+			return oauthError(c, fiber.StatusInternalServerError, oauthServerError, "can't introspect token")
+		}
+		if ok {
+			response = described
+			break
+		}
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	c.Set("Pragma", "no-cache")
+	return c.JSON(response)
+}
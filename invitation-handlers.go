@@ -0,0 +1,364 @@
+package main
+
+import (
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt"
+	"gorm.io/gorm"
+	"log"
+	"strings"
+	"time"
+)
+
+const tokenUseTeamInvitation = "team_invitation"
+
+// InvitationClaims are claims of invitation code. The code is single use,
+// since invitation can be answered only once
+type InvitationClaims struct {
+	*jwt.StandardClaims
+	TokenUse     string `json:"token_use"`
+	InvitationId uint   `json:"invitation_id"`
+	TeamId       uint   `json:"team_id"`
+}
+
+func (ic *InvitationClaims) standard() *jwt.StandardClaims {
+	return ic.StandardClaims
+}
+
+func (ic *InvitationClaims) use() string {
+	return ic.TokenUse
+}
+
+// generateInvitationCode signs code of invitation expiring together with it
+func generateInvitationCode(invitation *TeamInvitationModel, tc *TokenConfig) (string, error) {
+	standard := tc.standardClaims(tokenUseTeamInvitation, time.Until(invitation.ExpiresAt))
+	standard.ExpiresAt = invitation.ExpiresAt.Unix()
+
+	token := jwt.New(jwt.GetSigningMethod("RS256"))
+	token.Claims = &InvitationClaims{
+		standard,
+		tokenUseTeamInvitation,
+		invitation.Id,
+		invitation.TeamId,
+	}
+	return signToken(token, tokenUseTeamInvitation, tc)
+}
+
+func parseInvitationCode(code string, tc *TokenConfig) (*InvitationClaims, error) {
+	claims := &InvitationClaims{StandardClaims: &jwt.StandardClaims{}}
+	if err := parseClaims(code, claims, tokenUseTeamInvitation, tc); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// invitationByCode finds pending invitation of code
+func (s *Server) invitationByCode(code string) (*TeamInvitationModel, error) {
+	claims, err := parseInvitationCode(code, s.tokens)
+	if errors.Is(err, errTokenExpired) {
+		return nil, apiError(codeGone, "invitation is expired")
+	}
+	if err != nil {
+		log.Printf("reject invitation code: %s", err)
+		return nil, apiError(codeInvalidRequest, "invalid invitation code")
+	}
+
+	invitation, err := s.dbe.GetTeamInvitationById(claims.InvitationId)
+	if err != nil || invitation.TeamId != claims.TeamId {
+		return nil, apiError(codeGone, "invitation is cancelled")
+	}
+	if invitation.AcceptedAt != nil || invitation.DeclinedAt != nil || time.Now().After(invitation.ExpiresAt) {
+		return nil, apiError(codeGone, "invitation is answered or expired")
+	}
+	return invitation, nil
+}
+
+func invitationResponse(invitation *TeamInvitationModel, teamName string) TeamInvitationResponse {
+	return TeamInvitationResponse{
+		Id:        invitation.Id,
+		TeamId:    invitation.TeamId,
+		TeamName:  teamName,
+		UserId:    invitation.UserId,
+		Username:  invitation.Username,
+		Email:     invitation.Email,
+		Role:      invitation.Role,
+		CreatedAt: invitation.CreatedAt,
+		ExpiresAt: invitation.ExpiresAt,
+	}
+}
+
+func invitationResponses(invitations []TeamInvitation) []TeamInvitationResponse {
+	response := make([]TeamInvitationResponse, 0, len(invitations))
+	for i := range invitations {
+		response = append(response, invitationResponse(&invitations[i].TeamInvitationModel, invitations[i].TeamName))
+	}
+	return response
+}
+
+// HandleInviteTeamMember invites user by username or email and returns invitation code,
+// it is the only time code is shown. Nobody can invite with role higher than their own
+func (s *Server) HandleInviteTeamMember(c *fiber.Ctx) error {
+	log.Printf("handle invite team member at %s", c.Path())
+
+	actor, err := s.teamMembership(c, teamRoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	var req teamInviteRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect username or email and role")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationError(err)
+	}
+	if !teamRoleAtLeast(actor.Role, req.Role) {
+		return apiError(codeForbidden, "team role is too low")
+	}
+
+	invitation := &TeamInvitationModel{
+		TeamId:    actor.TeamId,
+		Username:  req.Username,
+		Email:     strings.ToLower(strings.TrimSpace(req.Email)),
+		InvitedBy: actor.UserId,
+		Role:      req.Role,
+	}
+	// username invites existing user, people not signed up yet are invited by email
+	if invitation.Username != "" {
+		user, err := s.dbe.GetUserByUsername(invitation.Username)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return apiError(codeNotFound, "no such user, invite by email instead")
+		}
+		if err != nil {
+			return apiError(codeInternal, "can't get user")
+		}
+		if _, err := s.dbe.GetTeamMembership(actor.TeamId, user.Id); err == nil {
+			return apiError(codeConflict, "user is already a team member")
+		}
+		invitation.UserId = user.Id
+	}
+	pending, err := s.dbe.CheckPendingInvitation(invitation)
+	if err != nil {
+		return apiError(codeInternal, "can't check invitations")
+	}
+	if pending {
+		return apiError(codeConflict, "already invited")
+	}
+
+	ttl := teamInvitationTTL
+	if req.ExpiresIn > 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+	}
+	invitation, err = s.dbe.CreateTeamInvitation(invitation, ttl)
+	if err != nil {
+		return apiError(codeInternal, "can't create invitation")
+	}
+	team, err := s.dbe.GetTeamById(actor.TeamId)
+	if err != nil {
+		return apiError(codeInternal, "can't get team")
+	}
+	code, err := generateInvitationCode(invitation, s.tokens)
+	if err != nil {
+		return apiError(codeInternal, "can't create invitation code")
+	}
+
+	response := invitationResponse(invitation, team.Name)
+	response.Code = code
+	response.Link = frontendLink(s.invitationLink, "code", code)
+	return c.Status(fiber.StatusCreated).JSON(response)
+}
+
+// HandleGetTeamInvitations returns pending invitations of team
+func (s *Server) HandleGetTeamInvitations(c *fiber.Ctx) error {
+	log.Printf("handle get team invitations at %s", c.Path())
+
+	actor, err := s.teamMembership(c, teamRoleAdmin)
+	if err != nil {
+		return err
+	}
+	invitations, err := s.dbe.GetTeamInvitations(actor.TeamId)
+	if err != nil {
+		return apiError(codeInternal, "can't get invitations")
+	}
+	return c.JSON(invitationResponses(invitations))
+}
+
+// HandleCancelTeamInvitation deletes invitation, so that its code stops working
+func (s *Server) HandleCancelTeamInvitation(c *fiber.Ctx) error {
+	log.Printf("handle cancel team invitation at %s", c.Path())
+
+	actor, err := s.teamMembership(c, teamRoleAdmin)
+	if err != nil {
+		return err
+	}
+	invitationId, err := idParam(c, "invitationId")
+	if err != nil {
+		return err
+	}
+	invitation, err := s.dbe.GetTeamInvitationById(invitationId)
+	if err != nil || invitation.TeamId != actor.TeamId {
+		return apiError(codeNotFound, "no such invitation")
+	}
+
+	if err := s.dbe.DeleteTeamInvitation(invitation.Id); err != nil {
+		return apiError(codeInternal, "can't cancel invitation")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// HandleGetInvitations returns pending invitations of current user
+func (s *Server) HandleGetInvitations(c *fiber.Ctx) error {
+	log.Printf("handle get invitations at %s", c.Path())
+
+	invitations, err := s.dbe.GetUserInvitations(userClaims(c).UserInfo.Id)
+	if err != nil {
+		return apiError(codeInternal, "can't get invitations")
+	}
+	return c.JSON(invitationResponses(invitations))
+}
+
+// userInvitation finds invitation of :invitationId parameter addressed to current user
+func (s *Server) userInvitation(c *fiber.Ctx) (*TeamInvitationModel, error) {
+	invitationId, err := idParam(c, "invitationId")
+	if err != nil {
+		return nil, err
+	}
+	invitation, err := s.dbe.GetTeamInvitationById(invitationId)
+	if err != nil || invitation.UserId != userClaims(c).UserInfo.Id {
+		return nil, apiError(codeNotFound, "no such invitation")
+	}
+	return invitation, nil
+}
+
+// acceptInvitation makes user a member of invitation team
+func (s *Server) acceptInvitation(c *fiber.Ctx, invitation *TeamInvitationModel, userId uint) error {
+	err := s.dbe.AcceptTeamInvitation(invitation, userId)
+	if errors.Is(err, errInvitationUnavailable) {
+		return apiError(codeGone, "invitation is answered or expired")
+	}
+	if err != nil {
+		return apiError(codeInternal, "can't accept invitation")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *Server) HandleAcceptInvitation(c *fiber.Ctx) error {
+	log.Printf("handle accept invitation at %s", c.Path())
+
+	invitation, err := s.userInvitation(c)
+	if err != nil {
+		return err
+	}
+	return s.acceptInvitation(c, invitation, invitation.UserId)
+}
+
+func (s *Server) HandleDeclineInvitation(c *fiber.Ctx) error {
+	log.Printf("handle decline invitation at %s", c.Path())
+
+	invitation, err := s.userInvitation(c)
+	if err != nil {
+		return err
+	}
+	declined, err := s.dbe.DeclineTeamInvitation(invitation.Id)
+	if err != nil {
+		return apiError(codeInternal, "can't decline invitation")
+	}
+	if !declined {
+		return apiError(codeGone, "invitation is already answered")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// HandleAcceptInvitationCode lets signed-in user accept invitation by its code.
+// Invitation by username can be accepted only by that user, by email - by code holder
+func (s *Server) HandleAcceptInvitationCode(c *fiber.Ctx) error {
+	log.Printf("handle accept invitation code at %s", c.Path())
+
+	var req invitationCodeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect code")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationError(err)
+	}
+
+	invitation, err := s.invitationByCode(req.Code)
+	if err != nil {
+		return err
+	}
+	user, err := s.dbe.GetUserById(userClaims(c).UserInfo.Id)
+	if err != nil {
+		return apiError(codeTokenInvalid, "no such user")
+	}
+	if invitation.UserId != 0 && invitation.UserId != user.Id {
+		return apiError(codeForbidden, "invitation is addressed to another user")
+	}
+	return s.acceptInvitation(c, invitation, user.Id)
+}
+
+// HandleSignUpWithInvitation signs up new user joining team of invitation code
+func (s *Server) HandleSignUpWithInvitation(c *fiber.Ctx) error {
+	log.Printf("handle sign-up with invitation at %s", c.Path())
+
+	var req invitationSignUpRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect code, username and password")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationError(err)
+	}
+
+	invitation, err := s.invitationByCode(req.Code)
+	if err != nil {
+		return err
+	}
+	if invitation.UserId != 0 {
+		return apiError(codeUserExists, "invited user exists, sign in to accept invitation")
+	}
+
+	// email invitation gives email to verify, other ones may need it from request
+	email := normalizeEmail(req.Email)
+	if invitation.Email != "" {
+		email = invitation.Email
+	} else if s.requireVerifiedEmail && email == "" {
+		return fieldError("email", "required", "email is required")
+	}
+	if violations := s.passwordViolations("password", req.Password, req.Username, email); len(violations) > 0 {
+		return rejectPassword(violations)
+	}
+
+	exist, err := s.dbe.CheckUserByUsername(req.Username)
+	if err != nil {
+		return apiError(codeInternal, "can't check username")
+	}
+	if exist {
+		return apiError(codeUserExists, "such user already exists")
+	}
+	if email != "" {
+		err = s.emailAvailable(email, 0)
+		if errors.Is(err, errEmailUsed) {
+			return apiError(codeEmailTaken, "email is already used, sign in to accept invitation")
+		}
+		if err != nil {
+			return apiError(codeInternal, "can't check email")
+		}
+	}
+
+	user, err := s.dbe.CreateInvitedUser(req.Username, req.Password, email, invitation)
+	if errors.Is(err, errInvitationUnavailable) {
+		return apiError(codeGone, "invitation is answered or expired")
+	}
+	if errors.Is(err, errDuplicate) {
+		return apiError(codeUserExists, "such user already exists")
+	}
+	if err != nil {
+		return apiError(codeInternal, "can't create such user")
+	}
+	if email != "" {
+		if err := s.sendEmailVerification(user, email); err != nil {
+			log.Printf("can't send verification to user %d: %s", user.Id, err)
+		}
+	}
+
+	return s.signUpResponse(c, user)
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pemCreatedHeader = "Created"
+	pemRetiredHeader = "Retired"
+)
+
+// SigningKey is a RSA key pair identified by kid.
+// Active key signs new tokens, retired keys only verify already issued ones
+type SigningKey struct {
+	Kid        string
+	PrivateKey *rsa.PrivateKey
+	CreatedAt  time.Time
+	RetiredAt  *time.Time
+}
+
+func (sk *SigningKey) Retired() bool {
+	return sk.RetiredAt != nil
+}
+
+func (sk *SigningKey) PublicKey() *rsa.PublicKey {
+	return &sk.PrivateKey.PublicKey
+}
+
+func newSigningKey(bits int) (*SigningKey, error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{
+		Kid:        rsaThumbprint(&privateKey.PublicKey),
+		PrivateKey: privateKey,
+		CreatedAt:  time.Now().UTC(),
+	}, nil
+}
+
+func b64url(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func rsaModulus(key *rsa.PublicKey) string {
+	return b64url(key.N.Bytes())
+}
+
+func rsaExponent(key *rsa.PublicKey) string {
+	return b64url(big.NewInt(int64(key.E)).Bytes())
+}
+
+// rsaThumbprint computes RFC 7638 JWK thumbprint used as kid
+func rsaThumbprint(key *rsa.PublicKey) string {
+	canonical := fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, rsaExponent(key), rsaModulus(key))
+	digest := sha256.Sum256([]byte(canonical))
+	return b64url(digest[:])
+}
+
+func encodeSigningKey(sk *SigningKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(sk.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]string{pemCreatedHeader: sk.CreatedAt.Format(time.RFC3339)}
+	if sk.RetiredAt != nil {
+		headers[pemRetiredHeader] = sk.RetiredAt.Format(time.RFC3339)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Headers: headers, Bytes: der}), nil
+}
+
+func decodeSigningKey(data []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no pem block found")
+	}
+
+	var privateKey *rsa.PrivateKey
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if privateKey, ok = parsed.(*rsa.PrivateKey); !ok {
+			return nil, fmt.Errorf("expect RSA private key")
+		}
+	case "RSA PRIVATE KEY":
+		parsed, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		privateKey = parsed
+	default:
+		return nil, fmt.Errorf("unexpected pem block %q", block.Type)
+	}
+
+	sk := &SigningKey{Kid: rsaThumbprint(&privateKey.PublicKey), PrivateKey: privateKey}
+	if created, ok := block.Headers[pemCreatedHeader]; ok {
+		t, err := time.Parse(time.RFC3339, created)
+		if err != nil {
+			return nil, err
+		}
+		sk.CreatedAt = t
+	}
+	if retired, ok := block.Headers[pemRetiredHeader]; ok {
+		t, err := time.Parse(time.RFC3339, retired)
+		if err != nil {
+			return nil, err
+		}
+		sk.RetiredAt = &t
+	}
+	return sk, nil
+}
+
+// KeyStore persists signing keys, so that tokens survive restarts
+// and are verifiable by every replica
+type KeyStore interface {
+	LoadKeys() ([]*SigningKey, error)
+	SaveKey(sk *SigningKey) error
+	DeleteKey(kid string) error
+}
+
+// fileKeyStore keeps every key in its own <kid>.pem file
+type fileKeyStore struct {
+	dir string
+}
+
+func NewFileKeyStore(dir string) (KeyStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileKeyStore{dir: dir}, nil
+}
+
+func (fks *fileKeyStore) LoadKeys() ([]*SigningKey, error) {
+	paths, err := filepath.Glob(filepath.Join(fks.dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*SigningKey, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		sk, err := decodeSigningKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if sk.CreatedAt.IsZero() {
+			if stat, err := os.Stat(path); err == nil {
+				sk.CreatedAt = stat.ModTime().UTC()
+			}
+		}
+		keys = append(keys, sk)
+	}
+	return keys, nil
+}
+
+func (fks *fileKeyStore) SaveKey(sk *SigningKey) error {
+	data, err := encodeSigningKey(sk)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(fks.dir, ".key-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fks.path(sk.Kid))
+}
+
+func (fks *fileKeyStore) DeleteKey(kid string) error {
+	err := os.Remove(fks.path(kid))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (fks *fileKeyStore) path(kid string) string {
+	return filepath.Join(fks.dir, kid+".pem")
+}
+
+// dbKeyStore keeps keys in signing_key_models table
+type dbKeyStore struct {
+	dbe *DBEngine
+}
+
+func NewDBKeyStore(dbe *DBEngine) KeyStore {
+	return &dbKeyStore{dbe: dbe}
+}
+
+func (dks *dbKeyStore) LoadKeys() ([]*SigningKey, error) {
+	models, err := dks.dbe.GetSigningKeys()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*SigningKey, 0, len(models))
+	for _, model := range models {
+		sk, err := decodeSigningKey([]byte(model.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", model.Kid, err)
+		}
+		sk.CreatedAt = model.CreatedAt
+		sk.RetiredAt = model.RetiredAt
+		keys = append(keys, sk)
+	}
+	return keys, nil
+}
+
+func (dks *dbKeyStore) SaveKey(sk *SigningKey) error {
+	data, err := encodeSigningKey(sk)
+	if err != nil {
+		return err
+	}
+	return dks.dbe.SaveSigningKey(&SigningKeyModel{
+		Kid:        sk.Kid,
+		PrivateKey: string(data),
+		CreatedAt:  sk.CreatedAt,
+		RetiredAt:  sk.RetiredAt,
+	})
+}
+
+func (dks *dbKeyStore) DeleteKey(kid string) error {
+	return dks.dbe.DeleteSigningKey(kid)
+}
+
+// keyReloadInterval limits reloads of keys on tokens signed by unknown key
+const keyReloadInterval = 10 * time.Second
+
+type KeyRingConfig struct {
+	KeyBits int
+	// Rotation is how long a key signs new tokens
+	Rotation time.Duration
+	// Publish is how long a new key is only published for verification before it signs,
+	// must be greater than JWKS cache age plus key check interval of replicas
+	Publish time.Duration
+	// Overlap is how long a retired key is still accepted,
+	// must be greater than the longest token lifetime
+	Overlap time.Duration
+}
+
+// KeyRing holds the active signing key and all keys still valid for verification
+type KeyRing struct {
+	store KeyStore
+	conf  KeyRingConfig
+
+	mu     sync.RWMutex
+	active *SigningKey
+	keys   map[string]*SigningKey
+
+	// maintainMu serializes Maintain of background loop and reloads
+	maintainMu sync.Mutex
+	reloadMu   sync.Mutex
+	reloadedAt time.Time
+}
+
+func NewKeyRing(store KeyStore, krc KeyRingConfig) (*KeyRing, error) {
+	if krc.Rotation <= 0 || krc.Overlap < 0 || krc.Publish < 0 {
+		return nil, fmt.Errorf("invalid key rotation period")
+	}
+	kr := &KeyRing{store: store, conf: krc, keys: map[string]*SigningKey{}}
+	if err := kr.Maintain(); err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+// SigningKey returns key which new tokens must be signed with
+func (kr *KeyRing) SigningKey() *SigningKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.active
+}
+
+// VerifyKey finds public key by kid among active and retired keys
+func (kr *KeyRing) VerifyKey(kid string) (*rsa.PublicKey, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	sk, ok := kr.keys[kid]
+	if !ok {
+		return nil, false
+	}
+	return sk.PublicKey(), true
+}
+
+// Keys returns all known keys, newest first
+func (kr *KeyRing) Keys() []*SigningKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	keys := make([]*SigningKey, 0, len(kr.keys))
+	for _, sk := range kr.keys {
+		keys = append(keys, sk)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.After(keys[j].CreatedAt)
+	})
+	return keys
+}
+
+// keyFunc resolves verification key for jwt.Parse by kid header
+func (kr *KeyRing) keyFunc(token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() != jwt.SigningMethodRS256.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+	kid, _ := token.Header["kid"].(string)
+	key, ok := kr.VerifyKey(kid)
+	if !ok && kr.reload() {
+		key, ok = kr.VerifyKey(kid)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+// reload runs Maintain for key another replica may have just created,
+// at most once per keyReloadInterval. It reports whether keys were reloaded
+func (kr *KeyRing) reload() bool {
+	kr.reloadMu.Lock()
+	defer kr.reloadMu.Unlock()
+	now := time.Now()
+	if now.Sub(kr.reloadedAt) < keyReloadInterval {
+		return false
+	}
+	kr.reloadedAt = now
+	if err := kr.Maintain(); err != nil {
+		log.Printf("can't reload signing keys: %s", err)
+		return false
+	}
+	return true
+}
+
+// Rotate creates a new key, it is published at once and
+// replaces active key after publish period
+func (kr *KeyRing) Rotate() error {
+	kr.maintainMu.Lock()
+	defer kr.maintainMu.Unlock()
+	return kr.rotate()
+}
+
+func (kr *KeyRing) rotate() error {
+	sk, err := newSigningKey(kr.conf.KeyBits)
+	if err != nil {
+		return err
+	}
+	if err := kr.store.SaveKey(sk); err != nil {
+		return err
+	}
+	log.Printf("created signing key %s", sk.Kid)
+	return kr.maintain()
+}
+
+// Maintain reloads keys from the store (other replicas may have rotated them),
+// rotates stale active key and removes retired keys behind overlap window
+func (kr *KeyRing) Maintain() error {
+	kr.maintainMu.Lock()
+	defer kr.maintainMu.Unlock()
+	return kr.maintain()
+}
+
+func (kr *KeyRing) maintain() error {
+	keys, err := kr.store.LoadKeys()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+
+	// newest non retired key past publish period signs, older ones get retired
+	// and newer ones wait. Without published keys, like on the first start,
+	// the oldest key signs at once since nobody has tokens to verify yet
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.After(keys[j].CreatedAt)
+	})
+	active, pending := -1, -1
+	for i, sk := range keys {
+		if sk.Retired() {
+			continue
+		}
+		if now.Sub(sk.CreatedAt) >= kr.conf.Publish {
+			active = i
+			break
+		}
+		if pending < 0 {
+			pending = i
+		}
+		active = i
+	}
+	if active < 0 {
+		return kr.rotate()
+	}
+	if pending == active {
+		pending = -1
+	}
+
+	actual := make(map[string]*SigningKey, len(keys))
+	for i, sk := range keys {
+		// keys sorted before active one are waiting for publish period
+		if i == active || (i < active && !sk.Retired()) {
+			actual[sk.Kid] = sk
+			continue
+		}
+		if !sk.Retired() {
+			retiredAt := now
+			sk.RetiredAt = &retiredAt
+			if err := kr.store.SaveKey(sk); err != nil {
+				return err
+			}
+			log.Printf("retired signing key %s", sk.Kid)
+		}
+		if now.Sub(*sk.RetiredAt) > kr.conf.Overlap {
+			if err := kr.store.DeleteKey(sk.Kid); err != nil {
+				return err
+			}
+			log.Printf("removed signing key %s", sk.Kid)
+			continue
+		}
+		actual[sk.Kid] = sk
+	}
+
+	if pending < 0 && now.Sub(keys[active].CreatedAt) > kr.conf.Rotation {
+		return kr.rotate()
+	}
+
+	kr.mu.Lock()
+	kr.active = keys[active]
+	kr.keys = actual
+	kr.mu.Unlock()
+	return nil
+}
+
+// Run calls Maintain every interval, it is meant to be run in its own goroutine
+func (kr *KeyRing) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := kr.Maintain(); err != nil {
+			log.Printf("can't maintain signing keys: %s", err)
+		}
+	}
+}
+
+func NewKeyStore(kind string, dir string, dbe *DBEngine) (KeyStore, error) {
+	switch strings.ToLower(kind) {
+	case "file":
+		return NewFileKeyStore(dir)
+	case "postgres":
+		return NewDBKeyStore(dbe), nil
+	default:
+		return nil, fmt.Errorf("unknown key store %q", kind)
+	}
+}
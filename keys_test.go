@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/rsa"
+	"github.com/golang-jwt/jwt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// test keys are short to keep rotations fast
+const testKeyBits = 1024
+
+// memoryKeyStore is KeyStore shared by test key rings like database is by replicas
+type memoryKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]SigningKey
+}
+
+func newMemoryKeyStore(keys ...*SigningKey) *memoryKeyStore {
+	mks := &memoryKeyStore{keys: map[string]SigningKey{}}
+	for _, sk := range keys {
+		mks.keys[sk.Kid] = *sk
+	}
+	return mks
+}
+
+func (mks *memoryKeyStore) LoadKeys() ([]*SigningKey, error) {
+	mks.mu.Lock()
+	defer mks.mu.Unlock()
+	keys := make([]*SigningKey, 0, len(mks.keys))
+	for _, sk := range mks.keys {
+		sk := sk
+		keys = append(keys, &sk)
+	}
+	return keys, nil
+}
+
+func (mks *memoryKeyStore) SaveKey(sk *SigningKey) error {
+	mks.mu.Lock()
+	defer mks.mu.Unlock()
+	mks.keys[sk.Kid] = *sk
+	return nil
+}
+
+func (mks *memoryKeyStore) DeleteKey(kid string) error {
+	mks.mu.Lock()
+	defer mks.mu.Unlock()
+	delete(mks.keys, kid)
+	return nil
+}
+
+func (mks *memoryKeyStore) key(kid string) (SigningKey, bool) {
+	mks.mu.Lock()
+	defer mks.mu.Unlock()
+	sk, ok := mks.keys[kid]
+	return sk, ok
+}
+
+// testSigningKey makes key created age ago, retired retiredAgo ago when it is positive
+func testSigningKey(t *testing.T, age time.Duration, retiredAgo time.Duration) *SigningKey {
+	t.Helper()
+	sk, err := newSigningKey(testKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk.CreatedAt = time.Now().UTC().Add(-age)
+	if retiredAgo > 0 {
+		retiredAt := time.Now().UTC().Add(-retiredAgo)
+		sk.RetiredAt = &retiredAt
+	}
+	return sk
+}
+
+var testKeyRingConfig = KeyRingConfig{
+	KeyBits:  testKeyBits,
+	Rotation: 30 * 24 * time.Hour,
+	Publish:  10 * time.Minute,
+	Overlap:  48 * time.Hour,
+}
+
+func TestKeyRingFirstStart(t *testing.T) {
+	store := newMemoryKeyStore()
+	kr, err := NewKeyRing(store, testKeyRingConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.keys) != 1 {
+		t.Fatalf("store has %d keys, want 1", len(store.keys))
+	}
+	// nobody has tokens to verify yet, so the only key signs at once
+	if kr.SigningKey() == nil || kr.SigningKey().Retired() {
+		t.Fatalf("no active key")
+	}
+	if _, ok := kr.VerifyKey(kr.SigningKey().Kid); !ok {
+		t.Errorf("active key is not published")
+	}
+}
+
+func TestKeyRingMaintain(t *testing.T) {
+	const day = 24 * time.Hour
+
+	tests := []struct {
+		name string
+		keys []*SigningKey
+		// active is index of key expected to sign
+		active int
+		// published are indexes of keys expected to verify
+		published []int
+		// retired are indexes of keys expected to be retired in store
+		retired []int
+		// deleted are indexes of keys expected to be removed from store
+		deleted []int
+		// created is number of keys expected to be created by rotation
+		created int
+	}{
+		{
+			name:      "fresh key is published before it signs",
+			keys:      []*SigningKey{testSigningKey(t, 10*day, 0), testSigningKey(t, time.Minute, 0)},
+			active:    0,
+			published: []int{0, 1},
+		},
+		{
+			name:      "key past publish period signs and retires older one",
+			keys:      []*SigningKey{testSigningKey(t, 31*day, 0), testSigningKey(t, time.Hour, 0)},
+			active:    1,
+			published: []int{0, 1},
+			retired:   []int{0},
+		},
+		{
+			name:      "retired key verifies within overlap",
+			keys:      []*SigningKey{testSigningKey(t, 31*day, day), testSigningKey(t, day, 0)},
+			active:    1,
+			published: []int{0, 1},
+			retired:   []int{0},
+		},
+		{
+			name:      "retired key is removed behind overlap",
+			keys:      []*SigningKey{testSigningKey(t, 40*day, 3*day), testSigningKey(t, 10*day, 0)},
+			active:    1,
+			published: []int{1},
+			deleted:   []int{0},
+		},
+		{
+			name:      "stale key is rotated but signs until new one is published",
+			keys:      []*SigningKey{testSigningKey(t, 31*day, 0)},
+			active:    0,
+			published: []int{0},
+			created:   1,
+		},
+		{
+			name:      "stale key isn't rotated again while new one waits",
+			keys:      []*SigningKey{testSigningKey(t, 31*day, 0), testSigningKey(t, time.Minute, 0)},
+			active:    0,
+			published: []int{0, 1},
+		},
+		{
+			name:      "only retired keys are replaced",
+			keys:      []*SigningKey{testSigningKey(t, 31*day, time.Hour)},
+			active:    -1,
+			published: []int{0},
+			retired:   []int{0},
+			created:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryKeyStore(tt.keys...)
+			kr, err := NewKeyRing(store, testKeyRingConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.active >= 0 && kr.SigningKey().Kid != tt.keys[tt.active].Kid {
+				t.Errorf("active key %s, want key %d", kr.SigningKey().Kid, tt.active)
+			}
+			if kr.SigningKey().Retired() {
+				t.Errorf("active key is retired")
+			}
+			if len(kr.Keys()) != len(tt.published)+tt.created {
+				t.Errorf("%d keys are published, want %d", len(kr.Keys()), len(tt.published)+tt.created)
+			}
+			for _, i := range tt.published {
+				if _, ok := kr.VerifyKey(tt.keys[i].Kid); !ok {
+					t.Errorf("key %d is not published", i)
+				}
+			}
+			for _, i := range tt.retired {
+				if sk, ok := store.key(tt.keys[i].Kid); !ok || !sk.Retired() {
+					t.Errorf("key %d is not retired in store", i)
+				}
+			}
+			for _, i := range tt.deleted {
+				if _, ok := store.key(tt.keys[i].Kid); ok {
+					t.Errorf("key %d is not removed from store", i)
+				}
+			}
+			if want := len(tt.keys) - len(tt.deleted) + tt.created; len(store.keys) != want {
+				t.Errorf("store has %d keys, want %d", len(store.keys), want)
+			}
+		})
+	}
+}
+
+func testKeyToken(t *testing.T, sk *SigningKey) *jwt.Token {
+	t.Helper()
+	token := jwt.New(jwt.SigningMethodRS256)
+	token.Header["kid"] = sk.Kid
+	return token
+}
+
+func TestKeyRingKeyFunc(t *testing.T) {
+	store := newMemoryKeyStore(testSigningKey(t, time.Hour, 0))
+	kr, err := NewKeyRing(store, testKeyRingConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := kr.keyFunc(testKeyToken(t, kr.SigningKey()))
+	if err != nil {
+		t.Fatalf("known key is rejected: %s", err)
+	}
+	if !key.(*rsa.PublicKey).Equal(kr.SigningKey().PublicKey()) {
+		t.Errorf("wrong key of kid")
+	}
+
+	hmac := jwt.New(jwt.SigningMethodHS256)
+	hmac.Header["kid"] = kr.SigningKey().Kid
+	if _, err := kr.keyFunc(hmac); err == nil {
+		t.Errorf("hmac token is accepted")
+	}
+
+	// another replica rotates, its key is loaded on first token signed by it
+	other := testSigningKey(t, time.Minute, 0)
+	if err := store.SaveKey(other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kr.keyFunc(testKeyToken(t, other)); err != nil {
+		t.Fatalf("key of other replica is rejected: %s", err)
+	}
+
+	// reloads are rate limited, unknown kids can't hammer the store
+	unknown := testSigningKey(t, time.Minute, 0)
+	if err := store.SaveKey(unknown); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kr.keyFunc(testKeyToken(t, unknown)); err == nil {
+		t.Errorf("key is reloaded within reload interval")
+	}
+	kr.reloadedAt = time.Now().Add(-keyReloadInterval)
+	if _, err := kr.keyFunc(testKeyToken(t, unknown)); err != nil {
+		t.Errorf("key isn't reloaded after reload interval: %s", err)
+	}
+}
+
+func TestNewKeyRingRejectsPeriods(t *testing.T) {
+	for _, conf := range []KeyRingConfig{
+		{KeyBits: testKeyBits, Rotation: 0, Overlap: time.Hour},
+		{KeyBits: testKeyBits, Rotation: time.Hour, Overlap: -time.Second},
+		{KeyBits: testKeyBits, Rotation: time.Hour, Publish: -time.Second},
+	} {
+		if _, err := NewKeyRing(newMemoryKeyStore(), conf); err == nil {
+			t.Errorf("config %+v is accepted", conf)
+		}
+	}
+}
+
+func TestSigningKeyEncoding(t *testing.T) {
+	sk := testSigningKey(t, time.Hour, time.Minute)
+	data, err := encodeSigningKey(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeSigningKey(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Kid != sk.Kid || !decoded.CreatedAt.Equal(sk.CreatedAt.Truncate(time.Second)) ||
+		decoded.RetiredAt == nil || !decoded.RetiredAt.Equal(sk.RetiredAt.Truncate(time.Second)) {
+		t.Errorf("decoded key %s created %s retired %v, want %s created %s retired %s",
+			decoded.Kid, decoded.CreatedAt, decoded.RetiredAt, sk.Kid, sk.CreatedAt, sk.RetiredAt)
+	}
+	if _, err := decodeSigningKey([]byte("not a pem")); err == nil {
+		t.Errorf("garbage is decoded")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"log"
+)
+
+// HandleGetLockouts lists accounts and ips locked after failed sign-in attempts
+func (s *Server) HandleGetLockouts(c *fiber.Ctx) error {
+	log.Printf("handle get lockouts at %s", c.Path())
+
+	locked, err := s.attempts.Locked()
+	if err != nil {
+		return apiError(codeInternal, "can't get lockouts")
+	}
+	response := make([]LockoutResponse, 0, len(locked))
+	for _, record := range locked {
+		response = append(response, LockoutResponse{
+			Key:         record.AttemptKey,
+			Failures:    record.Failures,
+			LockedUntil: record.LockedUntil,
+		})
+	}
+	return c.JSON(response)
+}
+
+// HandleUnlock forgets failed attempts of username, service or ip
+func (s *Server) HandleUnlock(c *fiber.Ctx) error {
+	log.Printf("handle unlock at %s", c.Path())
+
+	var req unlockRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect username, service or ip")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationError(err)
+	}
+
+	var keys []string
+	if req.Username != "" {
+		keys = append(keys, userAttemptKey(req.Username))
+	}
+	if req.Service != "" {
+		keys = append(keys, serviceAttemptKey(req.Service))
+	}
+	if req.Ip != "" {
+		keys = append(keys, ipAttemptKey(req.Ip))
+	}
+	for _, key := range keys {
+		if err := s.attempts.Unlock(key); err != nil {
+			return apiError(codeInternal, "can't unlock "+key)
+		}
+		log.Printf("user %d unlocked %s", userClaims(c).UserInfo.Id, key)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
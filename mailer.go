@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Mail is a plain text email message
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers mail to users
+type Mailer interface {
+	Send(mail Mail) error
+}
+
+type MailerConfig struct {
+	// From is sender address of all mail
+	From string
+	// Smtp* configure "smtp" mailer, auth is skipped without username
+	SmtpHost     string
+	SmtpPort     string
+	SmtpUsername string
+	SmtpPassword string
+	// Dir is directory of "file" mailer
+	Dir string
+}
+
+// NewMailer creates mailer of given kind: "smtp", "file" (writes .eml files
+// for development and tests) or "stdout"
+func NewMailer(kind string, config MailerConfig) (Mailer, error) {
+	switch kind {
+	case "smtp":
+		if config.SmtpHost == "" {
+			return nil, fmt.Errorf("smtp mailer needs host")
+		}
+		return &smtpMailer{config: config}, nil
+	case "file":
+		if err := os.MkdirAll(config.Dir, 0o700); err != nil {
+			return nil, err
+		}
+		return &fileMailer{from: config.From, dir: config.Dir}, nil
+	case "stdout":
+		return &writerMailer{from: config.From, out: os.Stdout}, nil
+	default:
+		return nil, fmt.Errorf("unknown mailer %q", kind)
+	}
+}
+
+// formatMail renders mail as RFC 5322 message
+func formatMail(from string, mail Mail) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", mail.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", mail.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(mail.Body, "\n", "\r\n"))
+	return buf.Bytes()
+}
+
+// validRecipient rejects addresses that could inject headers
+func validRecipient(to string) error {
+	if to == "" || strings.ContainsAny(to, "\r\n") {
+		return fmt.Errorf("invalid recipient %q", to)
+	}
+	return nil
+}
+
+type smtpMailer struct {
+	config MailerConfig
+}
+
+func (sm *smtpMailer) Send(mail Mail) error {
+	if err := validRecipient(mail.To); err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if sm.config.SmtpUsername != "" {
+		auth = smtp.PlainAuth("", sm.config.SmtpUsername, sm.config.SmtpPassword, sm.config.SmtpHost)
+	}
+	addr := net.JoinHostPort(sm.config.SmtpHost, sm.config.SmtpPort)
+	// SendMail switches to TLS if server supports STARTTLS
+	return smtp.SendMail(addr, auth, sm.config.From, []string{mail.To}, formatMail(sm.config.From, mail))
+}
+
+type fileMailer struct {
+	from string
+	dir  string
+}
+
+func (fm *fileMailer) Send(mail Mail) error {
+	if err := validRecipient(mail.To); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.NewReplacer("@", "_at_", "/", "_").Replace(mail.To))
+	return os.WriteFile(filepath.Join(fm.dir, name), formatMail(fm.from, mail), 0o600)
+}
+
+type writerMailer struct {
+	from string
+	out  io.Writer
+}
+
+func (wm *writerMailer) Send(mail Mail) error {
+	if err := validRecipient(mail.To); err != nil {
+		return err
+	}
+	log.Printf("send mail to %s", mail.To)
+	_, err := wm.out.Write(append(formatMail(wm.from, mail), '\r', '\n'))
+	return err
+}
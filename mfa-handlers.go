@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"log"
+	"strconv"
+	"time"
+)
+
+var errMfaUnavailable = apiError(codeUnavailable, "two-factor authentication is not configured")
+
+// mfaRequired reports whether user has confirmed second factor
+func (s *Server) mfaRequired(userId uint) (bool, error) {
+	totp, err := s.dbe.GetTotp(userId)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return totp.ConfirmedAt != nil, nil
+}
+
+// mfaChallenge answers password sign-in of user with second factor enabled
+func (s *Server) mfaChallenge(c *fiber.Ctx, user *UserModel) error {
+	if s.secrets == nil {
+		return errMfaUnavailable
+	}
+	token, err := generateMfaToken(user.Id, s.tokens)
+	if err != nil {
+		return apiError(codeInternal, "can't create mfa token")
+	}
+	return c.Status(fiber.StatusAccepted).JSON(MfaChallengeResponse{
+		MfaRequired: true,
+		MfaToken:    token,
+		ExpiresIn:   int64(mfaChallengeTTL / time.Second),
+	})
+}
+
+// verifySecondFactor checks TOTP or recovery code of user with confirmed TOTP.
+// Wrong codes are counted and lock second factor for a while
+func (s *Server) verifySecondFactor(c *fiber.Ctx, user *UserModel, code string) error {
+	if s.secrets == nil {
+		return errMfaUnavailable
+	}
+	totp, err := s.dbe.GetTotp(user.Id)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && totp.ConfirmedAt == nil) {
+		return apiError(codeConflict, "two-factor authentication is not enabled")
+	}
+	if err != nil {
+		return apiError(codeInternal, "can't check two-factor authentication")
+	}
+	now := time.Now()
+	if totp.LockedUntil != nil && now.Before(*totp.LockedUntil) {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(totp.LockedUntil.Sub(now)/time.Second)+1))
+		return apiError(codeTooManyAttempts, "too many wrong codes, try again later")
+	}
+
+	var ok bool
+	if isTotpCode(code) {
+		secret, err := s.secrets.Open(totp.Secret, totpContext(user.Id))
+		if err != nil {
+			log.Printf("can't decrypt totp secret of user %d: %s", user.Id, err)
+			return apiError(codeInternal, "can't check code")
+		}
+		if step, match := matchTotp(secret, code, now); match {
+			ok, err = s.dbe.UseTotpStep(user.Id, step)
+		}
+		if err != nil {
+			return apiError(codeInternal, "can't check code")
+		}
+	} else {
+		ok, err = s.dbe.UseRecoveryCode(user.Id, hashRecoveryCode(code))
+		if err != nil {
+			return apiError(codeInternal, "can't check code")
+		}
+		if ok {
+			s.securityEvent(c, securityEventRecoveryCode, user.Id, 0, "signed in with recovery code")
+		}
+	}
+
+	if !ok {
+		if err := s.dbe.RecordMfaFailure(user.Id); err != nil {
+			log.Printf("can't record mfa failure of user %d: %s", user.Id, err)
+		}
+		return apiError(codeInvalidMfaCode, "invalid code")
+	}
+	return nil
+}
+
+// newRecoveryCodeHashes returns recovery codes to show and their digests to store
+func newRecoveryCodeHashes() ([]string, []string, error) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes := make([]string, 0, len(codes))
+	for _, code := range codes {
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// HandleAuthSignInMfa finishes sign-in of user with second factor,
+// exchanging MFA challenge token and code for tokens
+func (s *Server) HandleAuthSignInMfa(c *fiber.Ctx) error {
+	log.Printf("handle sign-in mfa at %s", c.Path())
+
+	var req mfaSignInRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect mfa token and code")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationError(err)
+	}
+
+	claims, err := parseMfaToken(req.MfaToken, s.tokens)
+	if err != nil {
+		return tokenError(err, tokenUseMfaChallenge)
+	}
+	user, err := s.dbe.GetUserById(claims.UserId)
+	if err != nil {
+		return apiError(codeTokenInvalid, "no such user")
+	}
+	if err := s.verifySecondFactor(c, user, req.Code); err != nil {
+		return err
+	}
+
+	info, err := s.userInfo(user)
+	if err != nil {
+		return apiError(codeInternal, "can't get user roles")
+	}
+	response, _, err := s.startSession(c, info, "", "")
+	if err != nil {
+		return apiError(codeInternal, "error while create tokens")
+	}
+	return c.JSON(response)
+}
+
+func (s *Server) HandleGetMfa(c *fiber.Ctx) error {
+	log.Printf("handle get mfa at %s", c.Path())
+
+	userId := userClaims(c).UserInfo.Id
+	enabled, err := s.mfaRequired(userId)
+	if err != nil {
+		return apiError(codeInternal, "can't check two-factor authentication")
+	}
+	response := MfaStatusResponse{Totp: enabled}
+	if enabled {
+		if response.RecoveryCodes, err = s.dbe.CountRecoveryCodes(userId); err != nil {
+			return apiError(codeInternal, "can't count recovery codes")
+		}
+	}
+	return c.JSON(response)
+}
+
+// HandleEnrollTotp generates TOTP secret of signed-in user. It protects sign-in
+// only after HandleConfirmTotp, so that user can't lock themselves out
+func (s *Server) HandleEnrollTotp(c *fiber.Ctx) error {
+	log.Printf("handle enroll totp at %s", c.Path())
+
+	if s.secrets == nil {
+		return errMfaUnavailable
+	}
+	var req currentPasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect current password")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationError(err)
+	}
+
+	user, err := s.currentUser(c, req.CurrentPassword)
+	if err != nil {
+		return err
+	}
+	secret, err := newTotpSecret()
+	if err != nil {
+		return apiError(codeInternal, "can't generate secret")
+	}
+	sealed, err := s.secrets.Seal(secret, totpContext(user.Id))
+	if err != nil {
+		return apiError(codeInternal, "can't encrypt secret")
+	}
+	err = s.dbe.SetTotp(user.Id, sealed)
+	if errors.Is(err, errMfaEnabled) {
+		return apiError(codeConflict, err.Error())
+	}
+	if err != nil {
+		return apiError(codeInternal, "can't save secret")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(TotpEnrollmentResponse{
+		Secret: totpEncoding.EncodeToString(secret),
+		Uri:    totpURI(s.totpIssuer, user.Username, secret),
+	})
+}
+
+// HandleConfirmTotp enables TOTP by the first code from authenticator app
+// and returns recovery codes, it is the only time they are shown
+func (s *Server) HandleConfirmTotp(c *fiber.Ctx) error {
+	log.Printf("handle confirm totp at %s", c.Path())
+
+	if s.secrets == nil {
+		return errMfaUnavailable
+	}
+	var req mfaCodeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect code")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationError(err)
+	}
+
+	userId := userClaims(c).UserInfo.Id
+	totp, err := s.dbe.GetTotp(userId)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return apiError(codeConflict, "totp enrollment is not started")
+	}
+	if err != nil {
+		return apiError(codeInternal, "can't get totp")
+	}
+	if totp.ConfirmedAt != nil {
+		return apiError(codeConflict, errMfaEnabled.Error())
+	}
+	secret, err := s.secrets.Open(totp.Secret, totpContext(userId))
+	if err != nil {
+		log.Printf("can't decrypt totp secret of user %d: %s", userId, err)
+		return apiError(codeInternal, "can't check code")
+	}
+	step, match := matchTotp(secret, req.Code, time.Now())
+	if !match {
+		return apiError(codeInvalidMfaCode, "invalid code")
+	}
+
+	codes, hashes, err := newRecoveryCodeHashes()
+	if err != nil {
+		return apiError(codeInternal, "can't generate recovery codes")
+	}
+	confirmed, err := s.dbe.ConfirmTotp(userId, step, hashes)
+	if err != nil {
+		return apiError(codeInternal, "can't enable totp")
+	}
+	if !confirmed {
+		return apiError(codeInvalidMfaCode, "invalid code")
+	}
+
+	s.securityEvent(c, securityEventMfaEnabled, userId, userClaims(c).SessionId, "totp enabled")
+	return c.JSON(RecoveryCodesResponse{Codes: codes})
+}
+
+// HandleDisableTotp turns second factor off, it needs both password and code
+func (s *Server) HandleDisableTotp(c *fiber.Ctx) error {
+	log.Printf("handle disable totp at %s", c.Path())
+
+	var req mfaDisableRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect current password and code")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationError(err)
+	}
+
+	user, err := s.currentUser(c, req.CurrentPassword)
+	if err != nil {
+		return err
+	}
+	if err := s.verifySecondFactor(c, user, req.Code); err != nil {
+		return err
+	}
+	if err := s.dbe.DeleteTotp(user.Id); err != nil {
+		return apiError(codeInternal, "can't disable totp")
+	}
+
+	s.securityEvent(c, securityEventMfaDisabled, user.Id, userClaims(c).SessionId, "totp disabled")
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// HandleRegenerateRecoveryCodes replaces recovery codes, old ones stop working
+func (s *Server) HandleRegenerateRecoveryCodes(c *fiber.Ctx) error {
+	log.Printf("handle regenerate recovery codes at %s", c.Path())
+
+	var req currentPasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect current password")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationError(err)
+	}
+
+	user, err := s.currentUser(c, req.CurrentPassword)
+	if err != nil {
+		return err
+	}
+	enabled, err := s.mfaRequired(user.Id)
+	if err != nil {
+		return apiError(codeInternal, "can't check two-factor authentication")
+	}
+	if !enabled {
+		return apiError(codeConflict, "two-factor authentication is not enabled")
+	}
+
+	codes, hashes, err := newRecoveryCodeHashes()
+	if err != nil {
+		return apiError(codeInternal, "can't generate recovery codes")
+	}
+	if err := s.dbe.ReplaceRecoveryCodes(user.Id, hashes); err != nil {
+		return apiError(codeInternal, "can't save recovery codes")
+	}
+
+	s.securityEvent(c, securityEventRecoveryReset, user.Id, userClaims(c).SessionId, "recovery codes regenerated")
+	return c.JSON(RecoveryCodesResponse{Codes: codes})
+}
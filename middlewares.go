@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"net"
+	"strings"
+)
+
+// localsClaims is fiber.Ctx locals key of authenticated user claims
+const localsClaims = "claims"
+
+// bearerToken extracts token from Authorization header
+func bearerToken(c *fiber.Ctx) string {
+	header := c.Get(fiber.HeaderAuthorization)
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(header[7:])
+}
+
+// parseTrustedProxies reads addresses and CIDR ranges of proxies allowed to set proxy header
+func parseTrustedProxies(items []string) ([]*net.IPNet, error) {
+	proxies := make([]*net.IPNet, 0, len(items))
+	for _, item := range items {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", item)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (s *Server) trustedProxy(ip net.IP) bool {
+	for _, network := range s.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is address of client, taken from proxy header when request comes from trusted proxy.
+// Header is read right to left up to the first untrusted address, as entries
+// on the left of X-Forwarded-For come from client and may be forged
+func (s *Server) clientIP(c *fiber.Ctx) string {
+	remote := c.Context().RemoteIP()
+	if s.proxyHeader == "" || !s.trustedProxy(remote) {
+		return remote.String()
+	}
+	entries := strings.Split(c.Get(s.proxyHeader), ",")
+	for i := len(entries) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(entries[i]))
+		if ip == nil {
+			break
+		}
+		if i == 0 || !s.trustedProxy(ip) {
+			return ip.String()
+		}
+	}
+	return remote.String()
+}
+
+// RequireUser lets through only requests with a valid user access token
+func (s *Server) RequireUser(c *fiber.Ctx) error {
+	token := bearerToken(c)
+	if token == "" {
+		return apiError(codeAuthenticationRequired, "expect bearer token")
+	}
+	claims, err := s.authenticate(token)
+	if err != nil {
+		return tokenError(err, tokenUseAccess)
+	}
+	c.Locals(localsClaims, claims)
+	return c.Next()
+}
+
+// authenticate checks user access token, including whether it
+// or its session has been revoked
+func (s *Server) authenticate(token string) (*CustomClaims, error) {
+	claims, err := ParseJWT(token, s.tokens)
+	if err != nil {
+		return nil, err
+	}
+	if err := validate.Struct(claims.UserInfo); err != nil {
+		return nil, errTokenInvalid
+	}
+
+	revoked, err := s.dbe.IsTokenRevoked(claims.StandardClaims.Id)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, errTokenRevoked
+	}
+	if claims.SessionId != 0 {
+		session, err := s.dbe.GetSessionById(claims.SessionId)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errTokenRevoked
+		}
+		if err != nil {
+			return nil, err
+		}
+		if session.RevokedAt != nil {
+			return nil, errTokenRevoked
+		}
+	}
+	return claims, nil
+}
+
+// authenticateService checks service access token
+func (s *Server) authenticateService(token string) (*ServiceCustomClaims, error) {
+	claims, err := ParseServiceJWT(token, s.tokens)
+	if err != nil {
+		return nil, err
+	}
+	if err := validate.Struct(claims.ServiceInfo); err != nil {
+		return nil, errTokenInvalid
+	}
+
+	revoked, err := s.dbe.IsTokenRevoked(claims.StandardClaims.Id)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, errTokenRevoked
+	}
+	return claims, nil
+}
+
+// RequirePermission lets through only users having permission, it must follow RequireUser.
+// Permission is checked in database, as token claims may be stale
+func (s *Server) RequirePermission(permission string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		allowed, err := s.dbe.UserHasPermission(userClaims(c).UserInfo.Id, permission)
+		if err != nil {
+			return apiError(codeInternal, "can't check permissions")
+		}
+		if !allowed {
+			return apiError(codeForbidden, permission+" permission required")
+		}
+		return c.Next()
+	}
+}
+
+// userClaims returns claims stored by RequireUser
+func userClaims(c *fiber.Ctx) *CustomClaims {
+	return c.Locals(localsClaims).(*CustomClaims)
+}
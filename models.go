@@ -1,21 +1,169 @@
 package main
 
-import "gorm.io/gorm"
+import (
+	"gorm.io/gorm"
+	"time"
+)
 
 type UserModel struct {
 	gorm.Model
-	Id           uint `gorm:"primaryKey"`
-	Username     string
-	Password     string
-	RefreshToken string
+	Id uint `gorm:"primaryKey"`
+	// Username is unique among soft deleted users too, names of deleted accounts aren't reused
+	Username string `gorm:"uniqueIndex"`
+	Password string
+	// Email is nil until user sets it, lowercase
+	Email           *string `gorm:"uniqueIndex"`
+	EmailVerifiedAt *time.Time
+}
+
+// EmailVerified reports whether current email of user has been verified
+func (um *UserModel) EmailVerified() bool {
+	return um.Email != nil && um.EmailVerifiedAt != nil
+}
+
+// EmailAddress returns email of user or empty string if user has none
+func (um *UserModel) EmailAddress() string {
+	if um.Email == nil {
+		return ""
+	}
+	return *um.Email
 }
 
 type ServiceModel struct {
 	gorm.Model
-	Id           uint `gorm:"primaryKey"`
-	Name         string
-	SecretKey    string
-	RefreshToken string
+	Id uint `gorm:"primaryKey"`
+	// Name is OAuth client_id
+	Name      string `gorm:"uniqueIndex"`
+	SecretKey string
+	Scopes    string
+	// RedirectUris are space separated, authorization code is sent only to them
+	RedirectUris string
+	// Public clients (like browser apps) can't keep secrets and use PKCE only
+	Public                bool
+	RefreshTokenHash      string `gorm:"index"`
+	RefreshTokenExpiresAt time.Time
+	// RefreshTokenScope is scope granted with refresh token, refreshing can't widen it
+	RefreshTokenScope string
+}
+
+// RoleModel is a named set of permissions, roles are assigned to users
+type RoleModel struct {
+	Id          uint   `gorm:"primaryKey"`
+	Name        string `gorm:"uniqueIndex"`
+	Description string
+	CreatedAt   time.Time
+}
+
+// PermissionModel is an action other services check in tokens, like "services:create"
+type PermissionModel struct {
+	Id          uint   `gorm:"primaryKey"`
+	Name        string `gorm:"uniqueIndex"`
+	Description string
+	CreatedAt   time.Time
+}
+
+type RolePermission struct {
+	RoleId       uint `gorm:"primaryKey"`
+	PermissionId uint `gorm:"primaryKey;index"`
+}
+
+type UserRole struct {
+	UserId uint `gorm:"primaryKey"`
+	RoleId uint `gorm:"primaryKey;index"`
+}
+
+type TeamModel struct {
+	Id        uint `gorm:"primaryKey"`
+	Name      string
+	CreatedAt time.Time
+}
+
+// TeamMembership is user membership in team with team role (owner, admin or member)
+type TeamMembership struct {
+	TeamId    uint `gorm:"primaryKey"`
+	UserId    uint `gorm:"primaryKey;index"`
+	Role      string
+	CreatedAt time.Time
+}
+
+// TeamInvitationModel is an invitation into team, it is pending until accepted,
+// declined or expired. Invitee is known by username or email, UserId is
+// zero until the invitation is accepted unless invitee has already signed up
+type TeamInvitationModel struct {
+	Id         uint `gorm:"primaryKey"`
+	TeamId     uint `gorm:"index"`
+	UserId     uint `gorm:"index"`
+	Username   string
+	Email      string
+	InvitedBy  uint
+	Role       string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	AcceptedAt *time.Time
+	DeclinedAt *time.Time
+}
+
+// EmailVerificationModel is a verification token sent to email, only its digest is stored.
+// Token verifies the email only while user still has it
+type EmailVerificationModel struct {
+	Id        uint `gorm:"primaryKey"`
+	UserId    uint `gorm:"index"`
+	Email     string
+	TokenHash string `gorm:"uniqueIndex"`
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// PasswordResetModel is a single use password reset token sent to verified email,
+// only its digest is stored
+type PasswordResetModel struct {
+	Id        uint   `gorm:"primaryKey"`
+	UserId    uint   `gorm:"index"`
+	TokenHash string `gorm:"uniqueIndex"`
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// TotpModel is TOTP second factor of user, secret is encrypted with SecretBox.
+// It protects sign-in only after user confirms it with a code
+type TotpModel struct {
+	UserId      uint `gorm:"primaryKey"`
+	Secret      string
+	CreatedAt   time.Time
+	ConfirmedAt *time.Time
+	// LastStep is time step of the last accepted code, so codes can't be replayed
+	LastStep int64
+	// FailedAttempts counts wrong TOTP and recovery codes since the last lockout
+	FailedAttempts int
+	LockedUntil    *time.Time
+}
+
+// RecoveryCodeModel is a single use code replacing TOTP code, only its digest is stored
+type RecoveryCodeModel struct {
+	Id        uint   `gorm:"primaryKey"`
+	UserId    uint   `gorm:"index"`
+	CodeHash  string `gorm:"index"`
+	CreatedAt time.Time
+	UsedAt    *time.Time
+}
+
+// WebAuthnCredentialModel is passkey of user, PublicKey is COSE encoded
+type WebAuthnCredentialModel struct {
+	Id     uint `gorm:"primaryKey"`
+	UserId uint `gorm:"index"`
+	// CredentialId is base64url encoded, as authenticators send it
+	CredentialId string `gorm:"uniqueIndex"`
+	PublicKey    []byte
+	// SignCount is the last signature counter, authenticators which don't count keep it zero
+	SignCount int64
+	AAGUID    string
+	Name      string
+	// Transports are space separated hints like "internal hybrid"
+	Transports string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
 }
 
 type UserServiceRelation struct {
@@ -25,17 +173,209 @@ type UserServiceRelation struct {
 	ServiceUsername string
 }
 
+// SessionModel is a signed in device. It is also a refresh token family:
+// all tokens rotated from the one issued at sign-in belong to the session
+type SessionModel struct {
+	Id        uint `gorm:"primaryKey"`
+	UserId    uint `gorm:"index"`
+	UserAgent string
+	IP        string
+	// ClientId and Scope are set for sessions started by OAuth clients
+	ClientId string
+	Scope    string
+	// ActiveTeamId is team user acts in, zero if none is selected
+	ActiveTeamId uint
+	CreatedAt    time.Time
+	LastUsedAt   time.Time
+	ExpiresAt    time.Time
+	RevokedAt    *time.Time
+}
+
+func (sm *SessionModel) Active(now time.Time) bool {
+	return sm.RevokedAt == nil && now.Before(sm.ExpiresAt)
+}
+
+func (sm *SessionModel) grant() TokenGrant {
+	return TokenGrant{SessionId: sm.Id, ClientId: sm.ClientId, Scope: sm.Scope}
+}
+
+// RefreshTokenModel is a refresh token of session. Every rotation marks
+// presented token as rotated and issues its child
+type RefreshTokenModel struct {
+	Id        uint `gorm:"primaryKey"`
+	SessionId uint `gorm:"index"`
+	ParentId  *uint
+	TokenHash string `gorm:"uniqueIndex"`
+	CreatedAt time.Time
+	RotatedAt *time.Time
+}
+
+// AuthorizationCodeModel is a short living single use code of
+// authorization code flow, only code digest is stored
+type AuthorizationCodeModel struct {
+	Id            uint   `gorm:"primaryKey"`
+	CodeHash      string `gorm:"uniqueIndex"`
+	ClientId      string
+	UserId        uint
+	RedirectUri   string
+	Scope         string
+	Nonce         string
+	CodeChallenge string
+	AuthTime      time.Time
+	CreatedAt     time.Time
+	ExpiresAt     time.Time
+	UsedAt        *time.Time
+	// SessionId is session started by exchanging the code
+	SessionId uint
+}
+
+// OAuthConsentModel remembers scope user has granted to client
+type OAuthConsentModel struct {
+	Id        uint   `gorm:"primaryKey"`
+	UserId    uint   `gorm:"uniqueIndex:idx_consent_user_client"`
+	ClientId  string `gorm:"uniqueIndex:idx_consent_user_client"`
+	Scope     string
+	UpdatedAt time.Time
+}
+
+// SecurityEventModel is an audit record of suspicious or sensitive account activity
+type SecurityEventModel struct {
+	Id        uint `gorm:"primaryKey"`
+	UserId    uint `gorm:"index"`
+	SessionId uint
+	Type      string
+	IP        string
+	UserAgent string
+	Details   string
+	CreatedAt time.Time
+}
+
+// RevokedTokenModel is a denylist entry of access token revoked before expiration,
+// it is pruned once token expires by itself
+type RevokedTokenModel struct {
+	Jti       string    `gorm:"primaryKey"`
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+// LoginAttemptModel counts failed sign-in attempts of account or client ip
+type LoginAttemptModel struct {
+	AttemptKey    string `gorm:"primaryKey"`
+	Failures      int
+	LastFailureAt time.Time `gorm:"index"`
+	LockedUntil   time.Time
+}
+
+// RateLimitBucketModel is token bucket of rate limit policy and principal
+type RateLimitBucketModel struct {
+	BucketKey string `gorm:"primaryKey"`
+	Tokens    float64
+	UpdatedAt time.Time `gorm:"index;autoUpdateTime:false"`
+}
+
+type SigningKeyModel struct {
+	Kid        string `gorm:"primaryKey"`
+	PrivateKey string
+	CreatedAt  time.Time
+	RetiredAt  *time.Time
+}
+
 func (dbe *DBEngine) initTables() error {
 
+	if err := dbe.renameDuplicateUsernames(); err != nil {
+		return err
+	}
 	if err := dbe.DB.AutoMigrate(&UserModel{}); err != nil {
 		return err
 	}
+	if err := dbe.checkDuplicateServiceNames(); err != nil {
+		return err
+	}
 	if err := dbe.DB.AutoMigrate(&ServiceModel{}); err != nil {
 		return err
 	}
+	if err := dbe.DB.AutoMigrate(&EmailVerificationModel{}); err != nil {
+		return err
+	}
+	if err := dbe.DB.AutoMigrate(&PasswordResetModel{}); err != nil {
+		return err
+	}
+	if err := dbe.DB.AutoMigrate(&TotpModel{}); err != nil {
+		return err
+	}
+	if err := dbe.DB.AutoMigrate(&RecoveryCodeModel{}); err != nil {
+		return err
+	}
+	if err := dbe.DB.AutoMigrate(&WebAuthnCredentialModel{}); err != nil {
+		return err
+	}
 	if err := dbe.DB.AutoMigrate(&UserServiceRelation{}); err != nil {
 		return err
 	}
+	if err := dbe.DB.AutoMigrate(&TeamModel{}); err != nil {
+		return err
+	}
+	if err := dbe.DB.AutoMigrate(&TeamMembership{}); err != nil {
+		return err
+	}
+	if err := dbe.DB.AutoMigrate(&TeamInvitationModel{}); err != nil {
+		return err
+	}
+	if err := dbe.DB.AutoMigrate(&RoleModel{}); err != nil {
+		return err
+	}
+	if err := dbe.DB.AutoMigrate(&PermissionModel{}); err != nil {
+		return err
+	}
+	if err := dbe.DB.AutoMigrate(&RolePermission{}); err != nil {
+		return err
+	}
+	if err := dbe.DB.AutoMigrate(&UserRole{}); err != nil {
+		return err
+	}
+	if err := dbe.DB.AutoMigrate(&SessionModel{}); err != nil {
+		return err
+	}
+	if err := dbe.DB.AutoMigrate(&RefreshTokenModel{}); err != nil {
+		return err
+	}
+	if err := dbe.DB.AutoMigrate(&AuthorizationCodeModel{}); err != nil {
+		return err
+	}
+	if err := dbe.DB.AutoMigrate(&OAuthConsentModel{}); err != nil {
+		return err
+	}
+	if err := dbe.DB.AutoMigrate(&SecurityEventModel{}); err != nil {
+		return err
+	}
+	if err := dbe.DB.AutoMigrate(&LoginAttemptModel{}); err != nil {
+		return err
+	}
+	if err := dbe.DB.AutoMigrate(&RateLimitBucketModel{}); err != nil {
+		return err
+	}
+	if err := dbe.DB.AutoMigrate(&RevokedTokenModel{}); err != nil {
+		return err
+	}
+	if err := dbe.DB.AutoMigrate(&SigningKeyModel{}); err != nil {
+		return err
+	}
+
+	// refresh tokens used to be stored in plaintext, only their digests are kept now
+	plaintextTokens := []struct {
+		model  interface{}
+		column string
+	}{
+		{&UserModel{}, "refresh_token"},
+		{&ServiceModel{}, "refresh_token"},
+	}
+	for _, plaintext := range plaintextTokens {
+		if !dbe.DB.Migrator().HasColumn(plaintext.model, plaintext.column) {
+			continue
+		}
+		if err := dbe.DB.Migrator().DropColumn(plaintext.model, plaintext.column); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
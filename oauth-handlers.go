@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// OAuth 2.0 error codes (RFC 6749 section 5.2)
+const (
+	oauthInvalidRequest       = "invalid_request"
+	oauthInvalidClient        = "invalid_client"
+	oauthInvalidGrant         = "invalid_grant"
+	oauthInvalidScope         = "invalid_scope"
+	oauthUnsupportedGrantType = "unsupported_grant_type"
+	oauthServerError          = "server_error"
+)
+
+var errNoClientCredentials = errors.New("no client credentials")
+
+// oauthError writes OAuth 2.0 error response. Unlike the rest of api
+// OAuth endpoints must answer with {"error": ..., "error_description": ...}
+func oauthError(c *fiber.Ctx, status int, code string, description string) error {
+	if status == fiber.StatusUnauthorized {
+		c.Set(fiber.HeaderWWWAuthenticate, `Basic realm="oauth"`)
+	}
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	c.Set("Pragma", "no-cache")
+	return c.Status(status).JSON(OAuthErrorResponse{Error: code, ErrorDescription: description})
+}
+
+// clientCredentials extracts client id and secret either from
+// Authorization header (client_secret_basic) or from body (client_secret_post)
+func clientCredentials(c *fiber.Ctx, req *clientAuth) (string, string, error) {
+	header := c.Get(fiber.HeaderAuthorization)
+	if len(header) > 6 && strings.EqualFold(header[:6], "Basic ") {
+		if req.ClientSecret != "" {
+			return "", "", errors.New("multiple client authentication methods")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[6:]))
+		if err != nil {
+			return "", "", err
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return "", "", errors.New("malformed basic credentials")
+		}
+		// RFC 6749 section 2.3.1: credentials are form-urlencoded before base64
+		clientId, err := url.QueryUnescape(parts[0])
+		if err != nil {
+			return "", "", err
+		}
+		clientSecret, err := url.QueryUnescape(parts[1])
+		if err != nil {
+			return "", "", err
+		}
+		return clientId, clientSecret, nil
+	}
+	if req.ClientId != "" && req.ClientSecret != "" {
+		return req.ClientId, req.ClientSecret, nil
+	}
+	return "", "", errNoClientCredentials
+}
+
+// authenticateClient checks client credentials against registered services
+func (s *Server) authenticateClient(c *fiber.Ctx, req *clientAuth) (*ServiceModel, error) {
+	clientId, clientSecret, err := clientCredentials(c, req)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := s.dbe.CheckService(clientId, clientSecret)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("invalid client credentials")
+	}
+	return s.dbe.GetServiceByName(clientId)
+}
+
+// HandleOAuthToken is OAuth 2.0 token endpoint
+func (s *Server) HandleOAuthToken(c *fiber.Ctx) error {
+	log.Printf("handle oauth token at %s", c.Path())
+
+	var req tokenRequest
+	if err := c.BodyParser(&req); err != nil {
+		return oauthError(c, fiber.StatusBadRequest, oauthInvalidRequest, "malformed request body")
+	}
+
+	switch req.GrantType {
+	case "authorization_code":
+		return s.authorizationCodeGrant(c, &req)
+	case "client_credentials":
+		return s.clientCredentialsGrant(c, &req)
+	case "refresh_token":
+		return s.refreshTokenGrant(c, &req)
+	case "":
+		return oauthError(c, fiber.StatusBadRequest, oauthInvalidRequest, "grant_type is required")
+	default:
+		return oauthError(c, fiber.StatusBadRequest, oauthUnsupportedGrantType, "unsupported grant_type")
+	}
+}
+
+func (s *Server) clientCredentialsGrant(c *fiber.Ctx, req *tokenRequest) error {
+	service, err := s.authenticateClient(c, &req.clientAuth)
+	if err != nil {
+		log.Printf("reject client: %s", err)
+		return oauthError(c, fiber.StatusUnauthorized, oauthInvalidClient, "client authentication failed")
+	}
+
+	scope, ok := grantScope(req.Scope, service.Scopes)
+	if !ok {
+		return oauthError(c, fiber.StatusBadRequest, oauthInvalidScope, "requested scope is not allowed for client")
+	}
+
+	return s.serviceTokenResponse(c, service, scope)
+}
+
+func (s *Server) refreshTokenGrant(c *fiber.Ctx, req *tokenRequest) error {
+	if req.RefreshToken == "" {
+		return oauthError(c, fiber.StatusBadRequest, oauthInvalidRequest, "refresh_token is required")
+	}
+
+	// user session token issued by authorization code grant
+	digest := hashOpaqueToken(req.RefreshToken)
+	token, err := s.dbe.GetRefreshToken(digest)
+	if err == nil {
+		return s.userRefreshTokenGrant(c, req, token)
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return oauthError(c, fiber.StatusInternalServerError, oauthServerError, "can't check refresh token")
+	}
+
+	service, err := s.authenticateClient(c, &req.clientAuth)
+	if err != nil {
+		log.Printf("reject client: %s", err)
+		return oauthError(c, fiber.StatusUnauthorized, oauthInvalidClient, "client authentication failed")
+	}
+
+	// refresh token must be issued to the authenticated client
+	if !sameDigest(service.RefreshTokenHash, digest) || time.Now().After(service.RefreshTokenExpiresAt) {
+		return oauthError(c, fiber.StatusBadRequest, oauthInvalidGrant, "invalid refresh token")
+	}
+
+	// scope may only narrow the one granted with token, as RFC 6749 §6 asks
+	scope, ok := grantScope(req.Scope, intersectScope(service.RefreshTokenScope, service.Scopes))
+	if !ok {
+		return oauthError(c, fiber.StatusBadRequest, oauthInvalidScope, "requested scope exceeds scope of refresh token")
+	}
+
+	return s.serviceTokenResponse(c, service, scope)
+}
+
+func (s *Server) serviceTokenResponse(c *fiber.Ctx, service *ServiceModel, scope string) error {
+	info := ServiceInfo{Name: service.Name, Id: service.Id}
+	tokens, err := s.refreshServiceToken(info, scope)
+	if err != nil {
+		log.Printf("can't create service tokens: %s", err)
+		return oauthError(c, fiber.StatusInternalServerError, oauthServerError, "can't create tokens")
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	c.Set("Pragma", "no-cache")
+	return c.JSON(TokenResponse{
+		AccessToken:  tokens.JWT,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(serviceAccessTokenTTL / time.Second),
+		RefreshToken: tokens.RefreshToken,
+		Scope:        scope,
+	})
+}
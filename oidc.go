@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// firstPartyScope is granted to tokens from sign-in endpoints, not obtained by OAuth clients
+const firstPartyScope = "openid profile email"
+
+// OIDCUserClaims are standard claims about user, released according to scope
+type OIDCUserClaims struct {
+	// profile scope
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	UpdatedAt         int64  `json:"updated_at,omitempty"`
+	// email scope
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+}
+
+// IdTokenClaims are OpenID Connect id token claims, audience is client id
+type IdTokenClaims struct {
+	*jwt.StandardClaims
+	TokenUse string `json:"token_use"`
+	AuthTime int64  `json:"auth_time,omitempty"`
+	Nonce    string `json:"nonce,omitempty"`
+	OIDCUserClaims
+}
+
+// releaseUserClaims returns only claims covered by scope
+func releaseUserClaims(user *UserModel, scope string) OIDCUserClaims {
+	var claims OIDCUserClaims
+	if hasScope(scope, "profile") {
+		claims.PreferredUsername = user.Username
+		claims.UpdatedAt = user.UpdatedAt.Unix()
+	}
+	if hasScope(scope, "email") && user.Email != nil {
+		verified := user.EmailVerified()
+		claims.Email = *user.Email
+		claims.EmailVerified = &verified
+	}
+	return claims
+}
+
+func subject(user *UserModel) string {
+	return strconv.FormatUint(uint64(user.Id), 10)
+}
+
+// generateIdToken makes id token for client, nonce is empty outside of authorization code exchange
+func generateIdToken(user *UserModel, clientId string, scope string, authTime time.Time, nonce string, tc *TokenConfig) (string, error) {
+	standard := tc.standardClaims(tokenUseId, idTokenTTL)
+	standard.Subject = subject(user)
+	standard.Audience = clientId
+
+	token := jwt.New(jwt.GetSigningMethod("RS256"))
+	token.Claims = &IdTokenClaims{
+		standard,
+		tokenUseId,
+		authTime.Unix(),
+		nonce,
+		releaseUserClaims(user, scope),
+	}
+	return signToken(token, tokenUseId, tc)
+}
+
+// accessScope is scope user access token grants
+func accessScope(claims *CustomClaims) string {
+	if claims.ClientId == "" {
+		return firstPartyScope
+	}
+	return claims.Scope
+}
+
+// HandleUserinfo is OpenID Connect userinfo endpoint for access token holders
+func (s *Server) HandleUserinfo(c *fiber.Ctx) error {
+	log.Printf("handle userinfo at %s", c.Path())
+
+	claims := userClaims(c)
+	scope := accessScope(claims)
+	if !hasScope(scope, "openid") {
+		c.Set(fiber.HeaderWWWAuthenticate, `Bearer error="insufficient_scope", scope="openid"`)
+		return apiError(codeForbidden, "openid scope required")
+	}
+
+	user, err := s.dbe.GetUserById(claims.UserInfo.Id)
+	if err != nil {
+		c.Set(fiber.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+		return apiError(codeTokenInvalid, "no such user")
+	}
+
+	return c.JSON(UserinfoResponse{Sub: subject(user), OIDCUserClaims: releaseUserClaims(user, scope)})
+}
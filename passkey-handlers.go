@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"log"
+	"strings"
+	"time"
+)
+
+// webAuthnUserHandle is user.id of credentials, it must not contain personal data
+func webAuthnUserHandle(userId uint) string {
+	return b64url([]byte(fmt.Sprint(userId)))
+}
+
+func passkeyResponses(credentials []WebAuthnCredentialModel) []PasskeyResponse {
+	response := make([]PasskeyResponse, 0, len(credentials))
+	for _, credential := range credentials {
+		response = append(response, PasskeyResponse{
+			Id:         credential.Id,
+			Name:       credential.Name,
+			CreatedAt:  credential.CreatedAt,
+			LastUsedAt: credential.LastUsedAt,
+		})
+	}
+	return response
+}
+
+// useCeremony parses ceremony token and marks it used, so that challenge is answered once
+func (s *Server) useCeremony(token string, tokenUse string) (*WebAuthnClaims, error) {
+	claims, err := parseWebAuthnCeremony(token, tokenUse, s.tokens)
+	if err != nil {
+		log.Printf("reject webauthn ceremony: %s", err)
+		return nil, apiError(codeTokenInvalid, "invalid or expired ceremony, start again")
+	}
+	fresh, err := s.dbe.ConsumeToken(claims.StandardClaims.Id, time.Unix(claims.StandardClaims.ExpiresAt, 0))
+	if err != nil {
+		return nil, apiError(codeInternal, "can't check ceremony")
+	}
+	if !fresh {
+		return nil, apiError(codeTokenInvalid, "ceremony is already used, start again")
+	}
+	return claims, nil
+}
+
+// HandlePasskeyRegistrationOptions starts registration of passkey for signed-in user
+func (s *Server) HandlePasskeyRegistrationOptions(c *fiber.Ctx) error {
+	log.Printf("handle passkey registration options at %s", c.Path())
+
+	user, err := s.dbe.GetUserById(userClaims(c).UserInfo.Id)
+	if err != nil {
+		return apiError(codeTokenInvalid, "no such user")
+	}
+	credentials, err := s.dbe.GetWebAuthnCredentials(user.Id)
+	if err != nil {
+		return apiError(codeInternal, "can't get passkeys")
+	}
+	challenge, ceremony, err := generateWebAuthnCeremony(tokenUseWebAuthnRegistration, user.Id, s.tokens)
+	if err != nil {
+		return apiError(codeInternal, "can't start registration")
+	}
+
+	options := PublicKeyCredentialCreationOptions{
+		Rp:        WebAuthnRelyingParty{Id: s.webAuthn.RPId, Name: s.webAuthn.RPName},
+		User:      WebAuthnUser{Id: webAuthnUserHandle(user.Id), Name: user.Username, DisplayName: user.Username},
+		Challenge: challenge,
+		Timeout:   webAuthnCeremonyTTL.Milliseconds(),
+		AuthenticatorSelection: WebAuthnAuthenticatorSelection{
+			ResidentKey:        "required",
+			RequireResidentKey: true,
+			UserVerification:   "required",
+		},
+		Attestation:        "none",
+		ExcludeCredentials: []WebAuthnCredentialDescriptor{},
+	}
+	for _, alg := range webAuthnAlgorithms {
+		options.PubKeyCredParams = append(options.PubKeyCredParams, WebAuthnCredentialParameter{Type: "public-key", Alg: alg})
+	}
+	// authenticator holding one of user passkeys refuses to create another one
+	for _, credential := range credentials {
+		options.ExcludeCredentials = append(options.ExcludeCredentials, WebAuthnCredentialDescriptor{
+			Type:       "public-key",
+			Id:         credential.CredentialId,
+			Transports: strings.Fields(credential.Transports),
+		})
+	}
+
+	return c.JSON(PasskeyOptionsResponse{Ceremony: ceremony, PublicKey: options})
+}
+
+// HandleRegisterPasskey verifies attestation of created credential and stores it
+func (s *Server) HandleRegisterPasskey(c *fiber.Ctx) error {
+	log.Printf("handle register passkey at %s", c.Path())
+
+	var req passkeyRegisterRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect ceremony and credential")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationError(err)
+	}
+
+	claims, err := s.useCeremony(req.Ceremony, tokenUseWebAuthnRegistration)
+	if err != nil {
+		return err
+	}
+	userId := userClaims(c).UserInfo.Id
+	if claims.UserId != userId {
+		return apiError(codeForbidden, "ceremony belongs to another user")
+	}
+
+	clientDataJSON, err := decodeWebAuthnBytes(req.Credential.Response.ClientDataJSON)
+	if err != nil {
+		return apiError(codeInvalidRequest, "malformed clientDataJSON")
+	}
+	attestationObject, err := decodeWebAuthnBytes(req.Credential.Response.AttestationObject)
+	if err != nil {
+		return apiError(codeInvalidRequest, "malformed attestationObject")
+	}
+	registered, err := s.webAuthn.VerifyRegistration(claims.Challenge, clientDataJSON, attestationObject)
+	if err != nil {
+		log.Printf("reject passkey registration of user %d: %s", userId, err)
+		return apiError(codeInvalidRequest, err.Error())
+	}
+	credentialId := b64url(registered.Id)
+	if strings.TrimRight(req.Credential.Id, "=") != credentialId {
+		return apiError(codeInvalidRequest, "credential id mismatch")
+	}
+
+	name := req.Name
+	if name == "" {
+		name = "Passkey"
+	}
+	credential := &WebAuthnCredentialModel{
+		UserId:       userId,
+		CredentialId: credentialId,
+		PublicKey:    registered.PublicKey,
+		SignCount:    int64(registered.SignCount),
+		AAGUID:       hex.EncodeToString(registered.AAGUID),
+		Name:         name,
+		Transports:   strings.Join(req.Credential.Response.Transports, " "),
+	}
+	err = s.dbe.CreateWebAuthnCredential(credential)
+	if errors.Is(err, errDuplicate) {
+		return apiError(codeConflict, "passkey is already registered")
+	}
+	if err != nil {
+		return apiError(codeInternal, "can't save passkey")
+	}
+
+	s.securityEvent(c, securityEventPasskeyAdded, userId, userClaims(c).SessionId,
+		fmt.Sprintf("passkey %d %q added, %s attestation", credential.Id, name, registered.Attestation))
+	return c.Status(fiber.StatusCreated).JSON(passkeyResponses([]WebAuthnCredentialModel{*credential})[0])
+}
+
+func (s *Server) HandleGetPasskeys(c *fiber.Ctx) error {
+	log.Printf("handle get passkeys at %s", c.Path())
+
+	credentials, err := s.dbe.GetWebAuthnCredentials(userClaims(c).UserInfo.Id)
+	if err != nil {
+		return apiError(codeInternal, "can't get passkeys")
+	}
+	return c.JSON(passkeyResponses(credentials))
+}
+
+func (s *Server) HandleDeletePasskey(c *fiber.Ctx) error {
+	log.Printf("handle delete passkey at %s", c.Path())
+
+	passkeyId, err := idParam(c, "passkeyId")
+	if err != nil {
+		return err
+	}
+	userId := userClaims(c).UserInfo.Id
+	deleted, err := s.dbe.DeleteWebAuthnCredential(userId, passkeyId)
+	if err != nil {
+		return apiError(codeInternal, "can't delete passkey")
+	}
+	if !deleted {
+		return apiError(codeNotFound, "no such passkey")
+	}
+
+	s.securityEvent(c, securityEventPasskeyRemoved, userId, userClaims(c).SessionId, fmt.Sprintf("passkey %d removed", passkeyId))
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// HandlePasskeySignInOptions starts usernameless sign-in, authenticator offers passkeys it holds
+func (s *Server) HandlePasskeySignInOptions(c *fiber.Ctx) error {
+	log.Printf("handle passkey sign-in options at %s", c.Path())
+
+	challenge, ceremony, err := generateWebAuthnCeremony(tokenUseWebAuthnAuthentication, 0, s.tokens)
+	if err != nil {
+		return apiError(codeInternal, "can't start sign-in")
+	}
+	return c.JSON(PasskeyOptionsResponse{Ceremony: ceremony, PublicKey: PublicKeyCredentialRequestOptions{
+		Challenge:        challenge,
+		Timeout:          webAuthnCeremonyTTL.Milliseconds(),
+		RpId:             s.webAuthn.RPId,
+		AllowCredentials: []WebAuthnCredentialDescriptor{},
+		UserVerification: "required",
+	}})
+}
+
+// HandlePasskeySignIn verifies assertion and starts session like HandleAuthSignIn.
+// Passkey with user verification is itself multi-factor, so TOTP is not asked
+func (s *Server) HandlePasskeySignIn(c *fiber.Ctx) error {
+	log.Printf("handle passkey sign-in at %s", c.Path())
+
+	var req passkeySignInRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect ceremony and credential")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationError(err)
+	}
+
+	claims, err := s.useCeremony(req.Ceremony, tokenUseWebAuthnAuthentication)
+	if err != nil {
+		return err
+	}
+	credential, err := s.dbe.GetWebAuthnCredential(strings.TrimRight(req.Credential.Id, "="))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return apiError(codeInvalidCredentials, "unknown passkey")
+	}
+	if err != nil {
+		return apiError(codeInternal, "can't find passkey")
+	}
+	assertion := req.Credential.Response
+	if assertion.UserHandle != "" && strings.TrimRight(assertion.UserHandle, "=") != webAuthnUserHandle(credential.UserId) {
+		return apiError(codeInvalidCredentials, "passkey belongs to another user")
+	}
+
+	clientDataJSON, errClientData := decodeWebAuthnBytes(assertion.ClientDataJSON)
+	authData, errAuthData := decodeWebAuthnBytes(assertion.AuthenticatorData)
+	signature, errSignature := decodeWebAuthnBytes(assertion.Signature)
+	if errClientData != nil || errAuthData != nil || errSignature != nil {
+		return apiError(codeInvalidRequest, "malformed credential response")
+	}
+	signCount, err := s.webAuthn.VerifyAssertion(claims.Challenge, credential.PublicKey, clientDataJSON, authData, signature)
+	if err != nil {
+		log.Printf("reject passkey %d: %s", credential.Id, err)
+		return apiError(codeInvalidCredentials, err.Error())
+	}
+
+	if signCountRegressed(signCount, credential.SignCount) {
+		s.securityEvent(c, securityEventPasskeyClone, credential.UserId, 0,
+			fmt.Sprintf("passkey %d presented sign count %d, stored %d", credential.Id, signCount, credential.SignCount))
+		return apiError(codeInvalidCredentials, "passkey sign count mismatch")
+	}
+	used, err := s.dbe.UseWebAuthnCredential(credential.Id, credential.SignCount, int64(signCount))
+	if err != nil {
+		return apiError(codeInternal, "can't update passkey")
+	}
+	if !used && signCount != 0 {
+		return apiError(codeInvalidCredentials, "passkey sign count mismatch")
+	}
+
+	user, err := s.dbe.GetUserById(credential.UserId)
+	if err != nil {
+		return apiError(codeInternal, "can't find such user")
+	}
+	if s.requireVerifiedEmail && !user.EmailVerified() {
+		return apiError(codeEmailNotVerified, "email is not verified")
+	}
+	info, err := s.userInfo(user)
+	if err != nil {
+		return apiError(codeInternal, "can't get user roles")
+	}
+
+	response, _, err := s.startSession(c, info, "", "")
+	if err != nil {
+		return apiError(codeInternal, "error while create tokens")
+	}
+	return c.JSON(response)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"log"
+	"time"
+)
+
+const (
+	passwordResetTTL = time.Hour
+	// passwordResetInterval is the least time between reset emails to one user
+	passwordResetInterval = time.Minute
+)
+
+// sendPasswordReset mails reset token to verified email of user
+func (s *Server) sendPasswordReset(user *UserModel) error {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return err
+	}
+	if err := s.dbe.CreatePasswordReset(user.Id, hashOpaqueToken(token)); err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Hello, %s!\n\nReset your password with code:\n\n%s\n", user.Username, token)
+	if link := frontendLink(s.passwordResetLink, "token", token); link != "" {
+		body = fmt.Sprintf("Hello, %s!\n\nReset your password by opening the link:\n\n%s\n", user.Username, link)
+	}
+	body += fmt.Sprintf("\nThe code expires in %s and works once. If you didn't ask for it, ignore this email, "+
+		"your password stays the same.\n", passwordResetTTL)
+
+	return s.mailer.Send(Mail{To: *user.Email, Subject: "Reset your password", Body: body})
+}
+
+// HandleForgotPassword sends password reset token to verified email. It answers 202
+// whether or not email is registered, and throttled requests are dropped silently
+func (s *Server) HandleForgotPassword(c *fiber.Ctx) error {
+	log.Printf("handle forgot password at %s", c.Path())
+
+	var req emailRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect email")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationError(err)
+	}
+
+	user, err := s.dbe.GetUserByEmail(normalizeEmail(req.Email))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.SendStatus(fiber.StatusAccepted)
+	}
+	if err != nil {
+		return apiError(codeInternal, "can't check email")
+	}
+	// unverified email may belong to someone else
+	if !user.EmailVerified() {
+		log.Printf("skip password reset of user %d: email is not verified", user.Id)
+		return c.SendStatus(fiber.StatusAccepted)
+	}
+
+	last, err := s.dbe.GetLastPasswordReset(user.Id)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return apiError(codeInternal, "can't check password resets")
+	}
+	if err == nil && time.Since(last.CreatedAt) < passwordResetInterval {
+		log.Printf("throttle password reset of user %d", user.Id)
+		return c.SendStatus(fiber.StatusAccepted)
+	}
+
+	if err := s.sendPasswordReset(user); err != nil {
+		log.Printf("can't send password reset to user %d: %s", user.Id, err)
+		return apiError(codeUnavailable, "can't send password reset email")
+	}
+	return c.SendStatus(fiber.StatusAccepted)
+}
+
+// passwordViolations checks password of user against password policy,
+// errors are reported for request field
+func (s *Server) passwordViolations(field string, password string, username string, email string) []FieldError {
+	violations := s.passwordPolicy.Check(password, username, email)
+	for i := range violations {
+		violations[i].Field = field
+	}
+	return violations
+}
+
+// rejectPassword answers that password doesn't satisfy policy
+func rejectPassword(violations []FieldError) error {
+	err := apiError(codeWeakPassword, "password doesn't satisfy policy")
+	err.Errors = violations
+	return err
+}
+
+// HandleResetPassword sets new password by reset token and signs user out everywhere
+func (s *Server) HandleResetPassword(c *fiber.Ctx) error {
+	log.Printf("handle reset password at %s", c.Path())
+
+	var req passwordResetRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect token and password")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationError(err)
+	}
+
+	tokenHash := hashOpaqueToken(req.Token)
+	reset, err := s.dbe.GetPasswordReset(tokenHash)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return apiError(codeTokenInvalid, "invalid or expired reset token")
+	}
+	if err != nil {
+		return apiError(codeInternal, "can't check reset token")
+	}
+	user, err := s.dbe.GetUserById(reset.UserId)
+	if err != nil {
+		return apiError(codeInternal, "can't find such user")
+	}
+	if violations := s.passwordViolations("password", req.Password, user.Username, user.EmailAddress()); len(violations) > 0 {
+		return rejectPassword(violations)
+	}
+
+	userId, err := s.dbe.ResetPassword(tokenHash, req.Password)
+	if err != nil {
+		return apiError(codeInternal, "can't reset password")
+	}
+	if userId == 0 {
+		return apiError(codeTokenInvalid, "invalid or expired reset token")
+	}
+
+	s.securityEvent(c, securityEventPasswordReset, userId, 0, "password reset by emailed token, all sessions revoked")
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// currentUser loads signed-in user and checks their current password
+func (s *Server) currentUser(c *fiber.Ctx, password string) (*UserModel, error) {
+	user, err := s.dbe.GetUserById(userClaims(c).UserInfo.Id)
+	if err != nil {
+		return nil, apiError(codeTokenInvalid, "no such user")
+	}
+	ok, err := s.dbe.CheckUserPassword(user, password)
+	if err != nil {
+		return nil, apiError(codeInternal, "can't check password")
+	}
+	if !ok {
+		return nil, apiError(codeInvalidCurrentPassword, "invalid current password")
+	}
+	return user, nil
+}
+
+// HandleChangePassword sets new password of signed-in user, their other sessions are revoked
+func (s *Server) HandleChangePassword(c *fiber.Ctx) error {
+	log.Printf("handle change password at %s", c.Path())
+
+	var req passwordChangeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect current and new password")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationError(err)
+	}
+
+	user, err := s.currentUser(c, req.CurrentPassword)
+	if err != nil {
+		return err
+	}
+	if violations := s.passwordViolations("newPassword", req.NewPassword, user.Username, user.EmailAddress()); len(violations) > 0 {
+		return rejectPassword(violations)
+	}
+	sessionId := userClaims(c).SessionId
+	if err := s.dbe.ChangeUserPassword(user.Id, req.NewPassword, sessionId); err != nil {
+		return apiError(codeInternal, "can't change password")
+	}
+
+	s.securityEvent(c, securityEventPasswordChange, user.Id, sessionId, "password changed, other sessions revoked")
+	return c.SendStatus(fiber.StatusNoContent)
+}
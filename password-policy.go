@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Rules of password policy, reported in field errors
+const (
+	passwordRuleMinLength = "min_length"
+	passwordRuleMaxLength = "max_length"
+	passwordRuleClasses   = "character_classes"
+	passwordRuleUsername  = "similar_to_username"
+	passwordRuleBreached  = "breached"
+)
+
+type PasswordPolicyConfig struct {
+	// MinLength and MaxLength are counted in characters
+	MinLength int
+	MaxLength int
+	// MinClasses is how many of lowercase, uppercase, digits and symbols
+	// password must mix, zero disables the rule
+	MinClasses int
+	// RejectUsername rejects passwords containing username or email name or contained in them
+	RejectUsername bool
+	// BreachedFile is SHA-1 list of breached passwords, see LoadBreachedPasswords. Optional
+	BreachedFile string
+}
+
+type PasswordPolicy struct {
+	config   PasswordPolicyConfig
+	breached *BreachedPasswords
+}
+
+func NewPasswordPolicy(config PasswordPolicyConfig) (*PasswordPolicy, error) {
+	if config.MinLength < 1 || (config.MaxLength > 0 && config.MaxLength < config.MinLength) {
+		return nil, fmt.Errorf("invalid password length limits %d..%d", config.MinLength, config.MaxLength)
+	}
+	if config.MinClasses < 0 || config.MinClasses > 4 {
+		return nil, fmt.Errorf("invalid password character classes %d", config.MinClasses)
+	}
+	policy := &PasswordPolicy{config: config}
+	if config.BreachedFile != "" {
+		breached, err := LoadBreachedPasswords(config.BreachedFile)
+		if err != nil {
+			return nil, err
+		}
+		policy.breached = breached
+	}
+	return policy, nil
+}
+
+// characterClasses counts kinds of characters in password
+func characterClasses(password string) int {
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			classes++
+		}
+	}
+	return classes
+}
+
+// similar reports whether password and name contain one another, ignoring case.
+// Names shorter than 3 characters are ignored
+func similar(password string, name string) bool {
+	if utf8.RuneCountInString(name) < 3 {
+		return false
+	}
+	password = strings.ToLower(password)
+	name = strings.ToLower(name)
+	return strings.Contains(password, name) || strings.Contains(name, password)
+}
+
+// Check returns violated rules of password of user with username and email (both may be empty)
+func (pp *PasswordPolicy) Check(password string, username string, email string) []FieldError {
+	var violations []FieldError
+	violation := func(rule string, message string) {
+		violations = append(violations, FieldError{Rule: rule, Message: message})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if length < pp.config.MinLength {
+		violation(passwordRuleMinLength, fmt.Sprintf("password must be at least %d characters long", pp.config.MinLength))
+	}
+	if pp.config.MaxLength > 0 && length > pp.config.MaxLength {
+		violation(passwordRuleMaxLength, fmt.Sprintf("password must be at most %d characters long", pp.config.MaxLength))
+	}
+	if characterClasses(password) < pp.config.MinClasses {
+		violation(passwordRuleClasses, fmt.Sprintf(
+			"password must mix at least %d of lowercase letters, uppercase letters, digits and symbols", pp.config.MinClasses))
+	}
+	if pp.config.RejectUsername {
+		emailName := email
+		if at := strings.LastIndex(email, "@"); at >= 0 {
+			emailName = email[:at]
+		}
+		if similar(password, username) || similar(password, emailName) {
+			violation(passwordRuleUsername, "password must not be similar to username or email")
+		}
+	}
+	if pp.breached != nil && pp.breached.Contains(password) {
+		violation(passwordRuleBreached, "password has appeared in a data breach, choose another one")
+	}
+	return violations
+}
+
+// hashPrefixLength is length of hex prefix passwords are bucketed by,
+// the same as in Pwned Passwords range API
+const hashPrefixLength = 5
+
+// BreachedPasswords is a set of SHA-1 digests of breached passwords, bucketed by
+// digest prefix like k-anonymity range API. Lookup touches only one bucket,
+// and the same interface may later be backed by a remote range API
+type BreachedPasswords struct {
+	ranges map[string][]string
+}
+
+// LoadBreachedPasswords reads file of upper or lower case hex SHA-1 digests, one per line,
+// optionally followed by ":count" as in Pwned Passwords downloads. Blank lines and # comments are skipped
+func LoadBreachedPasswords(path string) (*BreachedPasswords, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	bp := &BreachedPasswords{ranges: map[string][]string{}}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if colon := strings.IndexByte(text, ':'); colon >= 0 {
+			text = text[:colon]
+		}
+		if _, err := hex.DecodeString(text); err != nil || len(text) != 2*sha1.Size {
+			return nil, fmt.Errorf("%s:%d: expect SHA-1 hex digest", path, line)
+		}
+		text = strings.ToUpper(text)
+		prefix := text[:hashPrefixLength]
+		bp.ranges[prefix] = append(bp.ranges[prefix], text[hashPrefixLength:])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, suffixes := range bp.ranges {
+		sort.Strings(suffixes)
+	}
+	return bp, nil
+}
+
+// Range returns sorted digest suffixes of bucket with prefix
+func (bp *BreachedPasswords) Range(prefix string) []string {
+	return bp.ranges[strings.ToUpper(prefix)]
+}
+
+func (bp *BreachedPasswords) Contains(password string) bool {
+	digest := sha1.Sum([]byte(password))
+	hexDigest := strings.ToUpper(hex.EncodeToString(digest[:]))
+	suffixes := bp.Range(hexDigest[:hashPrefixLength])
+	suffix := hexDigest[hashPrefixLength:]
+	i := sort.SearchStrings(suffixes, suffix)
+	return i < len(suffixes) && suffixes[i] == suffix
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+	"strings"
+)
+
+var errMalformedHash = errors.New("malformed password hash")
+
+// PasswordHasher produces and checks PHC-style encoded hashes
+// such as $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+type PasswordHasher interface {
+	// Owns reports whether encoded hash was produced by this algorithm
+	Owns(encoded string) bool
+	Hash(password string) (string, error)
+	Verify(password string, encoded string) (bool, error)
+	// NeedsRehash reports whether encoded hash uses outdated parameters
+	NeedsRehash(encoded string) bool
+}
+
+// PasswordHashing hashes new secrets with the preferred hasher
+// and verifies secrets hashed by any known one (or stored in plaintext)
+type PasswordHashing struct {
+	preferred PasswordHasher
+	known     []PasswordHasher
+}
+
+type PasswordHashingConfig struct {
+	Algorithm string
+
+	// argon2 parameters are ints, so that out of range values are reported rather than wrapped
+	Argon2Memory      int
+	Argon2Iterations  int
+	Argon2Parallelism int
+
+	BcryptCost int
+
+	ScryptLogN int
+	ScryptR    int
+	ScryptP    int
+}
+
+func NewPasswordHashing(phc PasswordHashingConfig) (*PasswordHashing, error) {
+	argon := &argon2idHasher{}
+	bcr := &bcryptHasher{cost: phc.BcryptCost}
+	scr := &scryptHasher{logN: phc.ScryptLogN, r: phc.ScryptR, p: phc.ScryptP}
+
+	ph := &PasswordHashing{known: []PasswordHasher{argon, bcr, scr}}
+	switch phc.Algorithm {
+	case "argon2id":
+		if phc.Argon2Parallelism < 1 || phc.Argon2Parallelism > 255 || phc.Argon2Iterations < 0 || phc.Argon2Memory < 0 ||
+			!validArgon2Params(uint64(phc.Argon2Memory), uint64(phc.Argon2Iterations), uint8(phc.Argon2Parallelism)) {
+			return nil, fmt.Errorf("invalid argon2 parameters m=%d,t=%d,p=%d", phc.Argon2Memory, phc.Argon2Iterations, phc.Argon2Parallelism)
+		}
+		argon.memory, argon.iterations, argon.parallelism = uint32(phc.Argon2Memory), uint32(phc.Argon2Iterations), uint8(phc.Argon2Parallelism)
+		ph.preferred = argon
+	case "bcrypt":
+		if bcr.cost < bcrypt.MinCost || bcr.cost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be in [%d, %d]", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		ph.preferred = bcr
+	case "scrypt":
+		if !validScryptParams(scr.logN, scr.r, scr.p) {
+			return nil, fmt.Errorf("invalid scrypt parameters ln=%d,r=%d,p=%d", scr.logN, scr.r, scr.p)
+		}
+		ph.preferred = scr
+	default:
+		return nil, fmt.Errorf("unknown password hashing algorithm %q", phc.Algorithm)
+	}
+	return ph, nil
+}
+
+func (ph *PasswordHashing) Hash(password string) (string, error) {
+	return ph.preferred.Hash(password)
+}
+
+// Verify checks password against encoded hash. Rehash is true when password matches
+// but encoded hash should be replaced: it is a legacy plaintext value,
+// made by not preferred algorithm or with outdated parameters
+func (ph *PasswordHashing) Verify(password string, encoded string) (ok bool, rehash bool, err error) {
+	for _, hasher := range ph.known {
+		if !hasher.Owns(encoded) {
+			continue
+		}
+		if ok, err = hasher.Verify(password, encoded); err != nil || !ok {
+			return false, false, err
+		}
+		return true, hasher != ph.preferred || hasher.NeedsRehash(encoded), nil
+	}
+
+	// legacy rows store secret as is
+	ok = subtle.ConstantTimeCompare([]byte(password), []byte(encoded)) == 1
+	return ok, ok, nil
+}
+
+// Burn spends the same time as a real verification,
+// so that absent accounts can't be told apart by response time
+func (ph *PasswordHashing) Burn(password string) {
+	if encoded, err := ph.preferred.Hash(password); err == nil {
+		_, _ = ph.preferred.Verify(password, encoded)
+	}
+}
+
+func newSalt(size int) ([]byte, error) {
+	salt := make([]byte, size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+var b64 = base64.RawStdEncoding
+
+// argon2id
+
+type argon2idHasher struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+}
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+	// argon2MaxMemory and argon2MaxIterations bound cost of hashes read from database
+	argon2MaxMemory     = 4 * 1024 * 1024
+	argon2MaxIterations = 1024
+)
+
+// validArgon2Params checks parameters argon2.IDKey accepts without panic,
+// memory is in KiB and has to hold at least 8 blocks per lane
+func validArgon2Params(memory uint64, iterations uint64, parallelism uint8) bool {
+	return parallelism >= 1 &&
+		iterations >= 1 && iterations <= argon2MaxIterations &&
+		memory >= 8*uint64(parallelism) && memory <= argon2MaxMemory
+}
+
+type argon2idParams struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	hash        []byte
+}
+
+func (h *argon2idHasher) Owns(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (h *argon2idHasher) Hash(password string) (string, error) {
+	salt, err := newSalt(argon2SaltLen)
+	if err != nil {
+		return "", err
+	}
+	hash := argon2.IDKey([]byte(password), salt, h.iterations, h.memory, h.parallelism, argon2KeyLen)
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.memory,
+		h.iterations,
+		h.parallelism,
+		b64.EncodeToString(salt),
+		b64.EncodeToString(hash)), nil
+}
+
+func (h *argon2idHasher) decode(encoded string) (*argon2idParams, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return nil, errMalformedHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, errMalformedHash
+	}
+	params := &argon2idParams{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism); err != nil {
+		return nil, errMalformedHash
+	}
+	if !validArgon2Params(uint64(params.memory), uint64(params.iterations), params.parallelism) {
+		return nil, errMalformedHash
+	}
+	var err error
+	if params.salt, err = b64.DecodeString(parts[4]); err != nil {
+		return nil, errMalformedHash
+	}
+	if params.hash, err = b64.DecodeString(parts[5]); err != nil || len(params.hash) == 0 {
+		return nil, errMalformedHash
+	}
+	return params, nil
+}
+
+func (h *argon2idHasher) Verify(password string, encoded string) (bool, error) {
+	params, err := h.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	hash := argon2.IDKey([]byte(password), params.salt, params.iterations, params.memory, params.parallelism, uint32(len(params.hash)))
+	return subtle.ConstantTimeCompare(hash, params.hash) == 1, nil
+}
+
+func (h *argon2idHasher) NeedsRehash(encoded string) bool {
+	params, err := h.decode(encoded)
+	if err != nil {
+		return true
+	}
+	return params.memory != h.memory ||
+		params.iterations != h.iterations ||
+		params.parallelism != h.parallelism ||
+		len(params.salt) != argon2SaltLen ||
+		len(params.hash) != argon2KeyLen
+}
+
+// bcrypt keeps its own modular crypt format: $2b$<cost>$<salt+hash>
+
+type bcryptHasher struct {
+	cost int
+}
+
+func (h *bcryptHasher) Owns(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") ||
+		strings.HasPrefix(encoded, "$2b$") ||
+		strings.HasPrefix(encoded, "$2y$")
+}
+
+func (h *bcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (h *bcryptHasher) Verify(password string, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (h *bcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.cost
+}
+
+// scrypt
+
+type scryptHasher struct {
+	logN int
+	r    int
+	p    int
+}
+
+const (
+	scryptSaltLen = 16
+	scryptKeyLen  = 32
+	// scryptMaxMemory bounds 128*r*N bytes of hashes read from database
+	scryptMaxMemory = 4 << 30
+)
+
+// validScryptParams checks parameters scrypt.Key accepts without panic or error
+func validScryptParams(logN int, r int, p int) bool {
+	if logN < 1 || logN > 30 || r < 1 || p < 1 || r*p >= 1<<30 {
+		return false
+	}
+	return uint64(r) <= scryptMaxMemory/128>>logN
+}
+
+type scryptParams struct {
+	logN int
+	r    int
+	p    int
+	salt []byte
+	hash []byte
+}
+
+func (h *scryptHasher) Owns(encoded string) bool {
+	return strings.HasPrefix(encoded, "$scrypt$")
+}
+
+func (h *scryptHasher) Hash(password string) (string, error) {
+	salt, err := newSalt(scryptSaltLen)
+	if err != nil {
+		return "", err
+	}
+	hash, err := scrypt.Key([]byte(password), salt, 1<<h.logN, h.r, h.p, scryptKeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(
+		"$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+		h.logN,
+		h.r,
+		h.p,
+		b64.EncodeToString(salt),
+		b64.EncodeToString(hash)), nil
+}
+
+func (h *scryptHasher) decode(encoded string) (*scryptParams, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 {
+		return nil, errMalformedHash
+	}
+	params := &scryptParams{}
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &params.logN, &params.r, &params.p); err != nil {
+		return nil, errMalformedHash
+	}
+	if !validScryptParams(params.logN, params.r, params.p) {
+		return nil, errMalformedHash
+	}
+	var err error
+	if params.salt, err = b64.DecodeString(parts[3]); err != nil {
+		return nil, errMalformedHash
+	}
+	if params.hash, err = b64.DecodeString(parts[4]); err != nil || len(params.hash) == 0 {
+		return nil, errMalformedHash
+	}
+	return params, nil
+}
+
+func (h *scryptHasher) Verify(password string, encoded string) (bool, error) {
+	params, err := h.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	hash, err := scrypt.Key([]byte(password), params.salt, 1<<params.logN, params.r, params.p, len(params.hash))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(hash, params.hash) == 1, nil
+}
+
+func (h *scryptHasher) NeedsRehash(encoded string) bool {
+	params, err := h.decode(encoded)
+	if err != nil {
+		return true
+	}
+	return params.logN != h.logN ||
+		params.r != h.r ||
+		params.p != h.p ||
+		len(params.salt) != scryptSaltLen ||
+		len(params.hash) != scryptKeyLen
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRateLimits are policies by name, each is overridden by RATE_LIMIT_<NAME>
+var defaultRateLimits = map[string]string{
+	"global":      "300/1m",
+	"sign-in":     "20/1m",
+	"sign-up":     "10/1h",
+	"refresh":     "60/1m",
+	"email":       "10/1h",
+	"oauth-token": "120/1m",
+	"get-user":    "120/1m",
+}
+
+// RateLimitPolicy is token bucket of Limit requests refilled evenly over Period,
+// so that Limit requests may come in a burst
+type RateLimitPolicy struct {
+	Name   string
+	Limit  int
+	Period time.Duration
+}
+
+// parseRateLimit reads policy like "10/1m", zero limit disables it
+func parseRateLimit(name string, value string) (RateLimitPolicy, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return RateLimitPolicy{}, fmt.Errorf("invalid rate limit %q, expect like 10/1m", value)
+	}
+	limit, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || limit < 0 {
+		return RateLimitPolicy{}, fmt.Errorf("invalid rate limit %q, expect like 10/1m", value)
+	}
+	period, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+	if err != nil || period <= 0 {
+		return RateLimitPolicy{}, fmt.Errorf("invalid rate limit %q, expect like 10/1m", value)
+	}
+	return RateLimitPolicy{Name: name, Limit: limit, Period: period}, nil
+}
+
+// getEnvRateLimit reads policy from RATE_LIMIT_<NAME> variable
+func getEnvRateLimit(name string, fallback string) (RateLimitPolicy, error) {
+	envName := "RATE_LIMIT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+	return parseRateLimit(name, getEnv(envName, fallback))
+}
+
+// interval is time one token takes to refill
+func (rlp RateLimitPolicy) interval() time.Duration {
+	return rlp.Period / time.Duration(rlp.Limit)
+}
+
+// RateLimitResult tells whether request is allowed and what is left of bucket
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	// Reset is time until bucket is full again
+	Reset time.Duration
+	// RetryAfter is time until the next token, zero if request is allowed
+	RetryAfter time.Duration
+}
+
+// take refills bucket since its last update and takes one token from it
+func (rlp RateLimitPolicy) take(bucket *RateLimitBucketModel, now time.Time) RateLimitResult {
+	limit := float64(rlp.Limit)
+	if bucket.UpdatedAt.IsZero() {
+		bucket.Tokens = limit
+	} else if elapsed := now.Sub(bucket.UpdatedAt); elapsed > 0 {
+		bucket.Tokens = math.Min(limit, bucket.Tokens+float64(elapsed)/float64(rlp.interval()))
+	}
+	bucket.UpdatedAt = now
+
+	result := RateLimitResult{}
+	if bucket.Tokens >= 1 {
+		bucket.Tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - bucket.Tokens) * float64(rlp.interval()))
+	}
+	result.Remaining = int(bucket.Tokens)
+	result.Reset = time.Duration((limit - bucket.Tokens) * float64(rlp.interval()))
+	return result
+}
+
+// RateLimitStore keeps token buckets by key
+type RateLimitStore interface {
+	// Take takes token from bucket of key atomically
+	Take(key string, now time.Time, policy RateLimitPolicy) (RateLimitResult, error)
+	// Prune drops buckets not used since before, they are full by then
+	Prune(before time.Time) (int64, error)
+}
+
+// memoryRateLimitStore limits each replica on its own
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]RateLimitBucketModel
+}
+
+func NewMemoryRateLimitStore() RateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]RateLimitBucketModel{}}
+}
+
+func (mrs *memoryRateLimitStore) Take(key string, now time.Time, policy RateLimitPolicy) (RateLimitResult, error) {
+	mrs.mu.Lock()
+	defer mrs.mu.Unlock()
+	bucket := mrs.buckets[key]
+	bucket.BucketKey = key
+	result := policy.take(&bucket, now)
+	mrs.buckets[key] = bucket
+	return result, nil
+}
+
+func (mrs *memoryRateLimitStore) Prune(before time.Time) (int64, error) {
+	mrs.mu.Lock()
+	defer mrs.mu.Unlock()
+	var pruned int64
+	for key, bucket := range mrs.buckets {
+		if bucket.UpdatedAt.Before(before) {
+			delete(mrs.buckets, key)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// dbRateLimitStore keeps buckets in rate_limit_bucket_models table, limits hold across replicas
+type dbRateLimitStore struct {
+	dbe *DBEngine
+}
+
+func NewDBRateLimitStore(dbe *DBEngine) RateLimitStore {
+	return &dbRateLimitStore{dbe: dbe}
+}
+
+func (drs *dbRateLimitStore) Take(key string, now time.Time, policy RateLimitPolicy) (RateLimitResult, error) {
+	var result RateLimitResult
+	err := drs.dbe.UpdateRateLimitBucket(key, func(bucket *RateLimitBucketModel) {
+		result = policy.take(bucket, now)
+	})
+	return result, err
+}
+
+func (drs *dbRateLimitStore) Prune(before time.Time) (int64, error) {
+	return drs.dbe.PruneRateLimitBuckets(before)
+}
+
+func NewRateLimitStore(kind string, dbe *DBEngine) (RateLimitStore, error) {
+	switch strings.ToLower(kind) {
+	case "memory":
+		return NewMemoryRateLimitStore(), nil
+	case "postgres":
+		return NewDBRateLimitStore(dbe), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit store %q", kind)
+	}
+}
+
+// rateLimit returns middleware of configured policy
+func (s *Server) rateLimit(name string) fiber.Handler {
+	policy, ok := s.rateLimitPolicies[name]
+	if !ok {
+		panic("unknown rate limit policy " + name)
+	}
+	if name == "global" {
+		return s.RateLimit(policy, s.globalRateLimits)
+	}
+	return s.RateLimit(policy, s.rateLimits)
+}
+
+// pruneRateLimits periodically drops buckets idle longer than the longest period,
+// it is meant to be run in its own goroutine
+func (s *Server) pruneRateLimits(interval time.Duration) {
+	var longestPeriod time.Duration
+	for _, policy := range s.rateLimitPolicies {
+		if policy.Period > longestPeriod {
+			longestPeriod = policy.Period
+		}
+	}
+	stores := []RateLimitStore{s.rateLimits}
+	if s.globalRateLimits != s.rateLimits {
+		stores = append(stores, s.globalRateLimits)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, store := range stores {
+			pruned, err := store.Prune(time.Now().Add(-longestPeriod))
+			if err != nil {
+				log.Printf("can't prune rate limit buckets: %s", err)
+				continue
+			}
+			if pruned > 0 {
+				log.Printf("pruned %d rate limit buckets", pruned)
+			}
+		}
+	}
+}
+
+// rateLimitPrincipal identifies caller by user or service id of bearer token, or by ip.
+// Only token signature is checked, revoked tokens still identify their owner
+func (s *Server) rateLimitPrincipal(c *fiber.Ctx) string {
+	if token := bearerToken(c); token != "" {
+		if claims, err := ParseJWT(token, s.tokens); err == nil {
+			return "user:" + strconv.FormatUint(uint64(claims.UserInfo.Id), 10)
+		}
+		if claims, err := ParseServiceJWT(token, s.tokens); err == nil {
+			return "service:" + strconv.FormatUint(uint64(claims.ServiceInfo.Id), 10)
+		}
+	}
+	return "ip:" + s.clientIP(c)
+}
+
+// localsRateLimit is fiber.Ctx locals key of rateLimitReport
+const localsRateLimit = "rateLimit"
+
+// rateLimitReport is the most restrictive bucket of policies request has passed so far
+type rateLimitReport struct {
+	Limit    int
+	Result   RateLimitResult
+	Policies []string
+}
+
+// add takes bucket of policy into report, it replaces reported one when fewer requests are left
+func (rlr *rateLimitReport) add(policy RateLimitPolicy, result RateLimitResult) {
+	if len(rlr.Policies) == 0 || !result.Allowed ||
+		result.Remaining < rlr.Result.Remaining ||
+		(result.Remaining == rlr.Result.Remaining && result.Reset > rlr.Result.Reset) {
+		rlr.Limit, rlr.Result = policy.Limit, result
+	}
+	rlr.Policies = append(rlr.Policies, fmt.Sprintf("%d;w=%d", policy.Limit, int(math.Ceil(policy.Period.Seconds()))))
+}
+
+// RateLimit limits requests of every principal by policy and reports bucket in RateLimit
+// headers of IETF draft. Of several policies of route the most restrictive one is reported,
+// all are listed in RateLimit-Policy. Store failures are logged and let requests through
+func (s *Server) RateLimit(policy RateLimitPolicy, store RateLimitStore) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if policy.Limit == 0 {
+			return c.Next()
+		}
+		key := policy.Name + ":" + s.rateLimitPrincipal(c)
+		result, err := store.Take(key, time.Now(), policy)
+		if err != nil {
+			log.Printf("can't check rate limit of %s: %s", key, err)
+			return c.Next()
+		}
+
+		report, _ := c.Locals(localsRateLimit).(*rateLimitReport)
+		if report == nil {
+			report = &rateLimitReport{}
+			c.Locals(localsRateLimit, report)
+		}
+		report.add(policy, result)
+		c.Set("RateLimit-Limit", strconv.Itoa(report.Limit))
+		c.Set("RateLimit-Remaining", strconv.Itoa(report.Result.Remaining))
+		c.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(report.Result.Reset.Seconds()))))
+		c.Set("RateLimit-Policy", strings.Join(report.Policies, ", "))
+		if !result.Allowed {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
+			return apiError(codeRateLimited, "rate limit exceeded, try again later")
+		}
+		return c.Next()
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		value  string
+		limit  int
+		period time.Duration
+		ok     bool
+	}{
+		{"10/1m", 10, time.Minute, true},
+		{" 300 / 1h ", 300, time.Hour, true},
+		{"0/1m", 0, time.Minute, true},
+		{"10", 0, 0, false},
+		{"10/", 0, 0, false},
+		{"/1m", 0, 0, false},
+		{"-1/1m", 0, 0, false},
+		{"ten/1m", 0, 0, false},
+		{"10/minute", 0, 0, false},
+		{"10/0s", 0, 0, false},
+		{"10/-1m", 0, 0, false},
+	}
+	for _, tt := range tests {
+		policy, err := parseRateLimit("test", tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseRateLimit(%q) error %v, want ok %t", tt.value, err, tt.ok)
+			continue
+		}
+		if tt.ok && (policy.Name != "test" || policy.Limit != tt.limit || policy.Period != tt.period) {
+			t.Errorf("parseRateLimit(%q) = %+v, want %d per %s", tt.value, policy, tt.limit, tt.period)
+		}
+	}
+}
+
+func TestRateLimitTake(t *testing.T) {
+	// one token refills every second
+	policy := RateLimitPolicy{Name: "test", Limit: 10, Period: 10 * time.Second}
+	now := time.Now()
+	var bucket RateLimitBucketModel
+
+	// new bucket is full, whole limit passes in a burst
+	for i := 0; i < policy.Limit; i++ {
+		result := policy.take(&bucket, now)
+		if !result.Allowed || result.Remaining != policy.Limit-i-1 {
+			t.Fatalf("request %d allowed %t with %d remaining", i+1, result.Allowed, result.Remaining)
+		}
+		if want := time.Duration(i+1) * time.Second; result.Reset != want {
+			t.Errorf("request %d resets in %s, want %s", i+1, result.Reset, want)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		after      time.Duration
+		allowed    bool
+		remaining  int
+		reset      time.Duration
+		retryAfter time.Duration
+	}{
+		{"empty bucket", 0, false, 0, 10 * time.Second, time.Second},
+		{"half token refilled", 500 * time.Millisecond, false, 0, 9500 * time.Millisecond, 500 * time.Millisecond},
+		{"one token refilled", 500 * time.Millisecond, true, 0, 10 * time.Second, 0},
+		{"three tokens refilled", 3 * time.Second, true, 2, 8 * time.Second, 0},
+		{"refill stops at limit", time.Hour, true, 9, time.Second, 0},
+	}
+	for _, tt := range tests {
+		now = now.Add(tt.after)
+		result := policy.take(&bucket, now)
+		want := RateLimitResult{Allowed: tt.allowed, Remaining: tt.remaining, Reset: tt.reset, RetryAfter: tt.retryAfter}
+		if result != want {
+			t.Errorf("%s: take = %+v, want %+v", tt.name, result, want)
+		}
+	}
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	policy := RateLimitPolicy{Name: "test", Limit: 1, Period: time.Minute}
+	now := time.Now()
+
+	if result, _ := store.Take("test:ip:10.0.0.1", now, policy); !result.Allowed {
+		t.Errorf("first request is limited")
+	}
+	if result, _ := store.Take("test:ip:10.0.0.1", now, policy); result.Allowed {
+		t.Errorf("request over limit is allowed")
+	}
+	// buckets are separate by key
+	if result, _ := store.Take("test:ip:10.0.0.2", now.Add(time.Minute), policy); !result.Allowed {
+		t.Errorf("request of other key is limited")
+	}
+
+	pruned, err := store.Prune(now.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 1 {
+		t.Errorf("pruned %d buckets, want 1", pruned)
+	}
+	// pruned bucket starts full
+	if result, _ := store.Take("test:ip:10.0.0.1", now, policy); !result.Allowed {
+		t.Errorf("request of pruned bucket is limited")
+	}
+}
+
+func TestRateLimitReport(t *testing.T) {
+	global := RateLimitPolicy{Name: "global", Limit: 300, Period: time.Minute}
+	signIn := RateLimitPolicy{Name: "sign-in", Limit: 20, Period: 90 * time.Second}
+
+	tests := []struct {
+		name   string
+		global RateLimitResult
+		signIn RateLimitResult
+		limit  int
+	}{
+		{
+			name:   "fewer remaining is reported",
+			global: RateLimitResult{Allowed: true, Remaining: 299, Reset: time.Second},
+			signIn: RateLimitResult{Allowed: true, Remaining: 19, Reset: 4 * time.Second},
+			limit:  20,
+		},
+		{
+			name:   "looser policy with fewer remaining is reported",
+			global: RateLimitResult{Allowed: true, Remaining: 5, Reset: time.Minute},
+			signIn: RateLimitResult{Allowed: true, Remaining: 19, Reset: 4 * time.Second},
+			limit:  300,
+		},
+		{
+			name:   "later reset is reported of same remaining",
+			global: RateLimitResult{Allowed: true, Remaining: 19, Reset: time.Second},
+			signIn: RateLimitResult{Allowed: true, Remaining: 19, Reset: 4 * time.Second},
+			limit:  20,
+		},
+		{
+			name:   "rejecting policy is reported",
+			global: RateLimitResult{Allowed: true, Remaining: 0, Reset: time.Minute},
+			signIn: RateLimitResult{Allowed: false, Remaining: 0, Reset: 90 * time.Second, RetryAfter: 4 * time.Second},
+			limit:  20,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var report rateLimitReport
+			report.add(global, tt.global)
+			report.add(signIn, tt.signIn)
+			want := tt.global
+			if tt.limit == signIn.Limit {
+				want = tt.signIn
+			}
+			if report.Limit != tt.limit || report.Result != want {
+				t.Errorf("reported %d %+v, want %d %+v", report.Limit, report.Result, tt.limit, want)
+			}
+			if len(report.Policies) != 2 || report.Policies[0] != "300;w=60" || report.Policies[1] != "20;w=90" {
+				t.Errorf("policies %v, want [300;w=60 20;w=90]", report.Policies)
+			}
+		})
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	s := &Server{rateLimits: NewMemoryRateLimitStore(), globalRateLimits: NewMemoryRateLimitStore()}
+	app := fiber.New(fiber.Config{ErrorHandler: s.handleError})
+	app.Use(s.RateLimit(RateLimitPolicy{Name: "global", Limit: 300, Period: time.Minute}, s.globalRateLimits))
+	app.Get("/limited", s.RateLimit(RateLimitPolicy{Name: "sign-in", Limit: 2, Period: time.Minute}, s.rateLimits),
+		func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusNoContent) })
+	app.Get("/disabled", s.RateLimit(RateLimitPolicy{Name: "off", Limit: 0, Period: time.Minute}, s.rateLimits),
+		func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusNoContent) })
+
+	tests := []struct {
+		path       string
+		status     int
+		remaining  string
+		retryAfter string
+	}{
+		{"/limited", fiber.StatusNoContent, "1", ""},
+		{"/limited", fiber.StatusNoContent, "0", ""},
+		{"/limited", fiber.StatusTooManyRequests, "0", "30"},
+		// disabled policy adds nothing to global one
+		{"/disabled", fiber.StatusNoContent, "296", ""},
+	}
+	for i, tt := range tests {
+		resp, err := app.Test(httptest.NewRequest("GET", tt.path, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Errorf("request %d status %d, want %d", i+1, resp.StatusCode, tt.status)
+		}
+		if got := resp.Header.Get("RateLimit-Remaining"); got != tt.remaining {
+			t.Errorf("request %d RateLimit-Remaining %q, want %q", i+1, got, tt.remaining)
+		}
+		if got := resp.Header.Get(fiber.HeaderRetryAfter); got != tt.retryAfter {
+			t.Errorf("request %d Retry-After %q, want %q", i+1, got, tt.retryAfter)
+		}
+		if tt.path == "/limited" && resp.Header.Get("RateLimit-Policy") != "300;w=60, 2;w=60" {
+			t.Errorf("request %d RateLimit-Policy %q", i+1, resp.Header.Get("RateLimit-Policy"))
+		}
+	}
+}
@@ -5,17 +5,122 @@ type userAuthRequest struct {
 	Password string `json:"password" validate:"required"`
 }
 
+type userSignUpRequest struct {
+	Username string `json:"username" validate:"required"`
+	Password string `json:"password" validate:"required"`
+	Email    string `json:"email" validate:"omitempty,email,max=254"`
+}
+
+type emailRequest struct {
+	Email string `json:"email" validate:"required,email,max=254"`
+}
+
+type emailVerifyRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type passwordResetRequest struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+type passwordChangeRequest struct {
+	CurrentPassword string `json:"currentPassword" validate:"required"`
+	NewPassword     string `json:"newPassword" validate:"required"`
+}
+
+type usernameChangeRequest struct {
+	CurrentPassword string `json:"currentPassword" validate:"required"`
+	Username        string `json:"username" validate:"required"`
+}
+
+type currentPasswordRequest struct {
+	CurrentPassword string `json:"currentPassword" validate:"required"`
+}
+
+// mfaCodeRequest takes TOTP code or recovery code
+type mfaCodeRequest struct {
+	Code string `json:"code" validate:"required,max=32"`
+}
+
+type mfaDisableRequest struct {
+	CurrentPassword string `json:"currentPassword" validate:"required"`
+	Code            string `json:"code" validate:"required,max=32"`
+}
+
+type mfaSignInRequest struct {
+	MfaToken string `json:"mfaToken" validate:"required"`
+	Code     string `json:"code" validate:"required,max=32"`
+}
+
+// attestationCredential is PublicKeyCredential of navigator.credentials.create(),
+// binary fields are base64url encoded
+type attestationCredential struct {
+	Id       string `json:"id" validate:"required,max=1400"`
+	Type     string `json:"type" validate:"eq=public-key"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON" validate:"required"`
+		AttestationObject string   `json:"attestationObject" validate:"required"`
+		Transports        []string `json:"transports" validate:"max=8,dive,max=32"`
+	} `json:"response"`
+}
+
+// assertionCredential is PublicKeyCredential of navigator.credentials.get()
+type assertionCredential struct {
+	Id       string `json:"id" validate:"required,max=1400"`
+	Type     string `json:"type" validate:"eq=public-key"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON" validate:"required"`
+		AuthenticatorData string `json:"authenticatorData" validate:"required"`
+		Signature         string `json:"signature" validate:"required"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+type passkeyRegisterRequest struct {
+	Ceremony   string                `json:"ceremony" validate:"required"`
+	Name       string                `json:"name" validate:"max=64"`
+	Credential attestationCredential `json:"credential"`
+}
+
+type passkeySignInRequest struct {
+	Ceremony   string              `json:"ceremony" validate:"required"`
+	Credential assertionCredential `json:"credential"`
+}
+
+// unlockRequest names keys to unlock, at least one of them
+type unlockRequest struct {
+	Username string `json:"username" validate:"required_without_all=Service Ip"`
+	Service  string `json:"service"`
+	Ip       string `json:"ip" validate:"omitempty,ip"`
+}
+
 type serviceAuthRequest struct {
 	Name      string `json:"name" validate:"required"`
 	SecretKey string `json:"secretKey" validate:"required"`
 }
 
+type serviceCreateRequest struct {
+	Name      string `json:"name" validate:"required"`
+	SecretKey string `json:"secretKey" validate:"required_unless=Public true"`
+	// Scopes service may request, space separated
+	Scopes string `json:"scopes"`
+	// RedirectUris of authorization code flow, space separated
+	RedirectUris string `json:"redirectUris"`
+	Public       bool   `json:"public"`
+}
+
 type serviceUserRequest struct {
 	JWT             string `json:"jwt" validate:"required"`
 	ServiceUsername string `json:"serviceUsername" validate:"required"`
 	UserId          uint   `json:"userId" validate:"required"`
 }
 
+type serviceLinkRequest struct {
+	Name            string `json:"name" validate:"required"`
+	ServiceUsername string `json:"serviceUsername" validate:"required"`
+}
+
 type userGetRequest struct {
 	Id uint `json:"id" validate:"required"`
 }
@@ -27,3 +132,117 @@ type AuthRequest struct {
 type RefreshRequest struct {
 	RefreshToken string `json:"refreshToken" validate:"required"`
 }
+
+type roleCreateRequest struct {
+	Name        string `json:"name" validate:"required,max=64"`
+	Description string `json:"description"`
+}
+
+type permissionCreateRequest struct {
+	Name        string `json:"name" validate:"required,max=64"`
+	Description string `json:"description"`
+}
+
+type teamCreateRequest struct {
+	Name string `json:"name" validate:"required,max=128"`
+}
+
+type teamRoleRequest struct {
+	Role string `json:"role" validate:"required,oneof=owner admin member"`
+}
+
+// teamInviteRequest invites either by username or by email
+type teamInviteRequest struct {
+	Username string `json:"username" validate:"required_without=Email,excluded_with=Email"`
+	Email    string `json:"email" validate:"omitempty,email,max=254"`
+	Role     string `json:"role" validate:"required,oneof=owner admin member"`
+	// ExpiresIn is invitation lifetime in seconds, a week by default
+	ExpiresIn int64 `json:"expiresIn" validate:"omitempty,min=60,max=2592000"`
+}
+
+type invitationCodeRequest struct {
+	Code string `json:"code" validate:"required"`
+}
+
+// invitationSignUpRequest needs no email for invitations sent to email
+type invitationSignUpRequest struct {
+	Code     string `json:"code" validate:"required"`
+	Username string `json:"username" validate:"required"`
+	Password string `json:"password" validate:"required"`
+	Email    string `json:"email" validate:"omitempty,email,max=254"`
+}
+
+// teamSelectRequest selects active team of session, zero TeamId unselects it
+type teamSelectRequest struct {
+	TeamId uint `json:"teamId"`
+}
+
+type signOutRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// revokeRequest is RFC 7009 token revocation request
+type revokeRequest struct {
+	Token         string `json:"token" form:"token" validate:"required"`
+	TokenTypeHint string `json:"token_type_hint" form:"token_type_hint"`
+}
+
+// oauthRevokeRequest is RFC 7009 revocation request of authenticated client
+type oauthRevokeRequest struct {
+	Token         string `json:"token" form:"token" validate:"required"`
+	TokenTypeHint string `json:"token_type_hint" form:"token_type_hint"`
+	clientAuth
+}
+
+// clientAuth are OAuth 2.0 client credentials sent in body (client_secret_post),
+// they may come in Authorization header instead (client_secret_basic)
+type clientAuth struct {
+	ClientId     string `json:"client_id" form:"client_id"`
+	ClientSecret string `json:"client_secret" form:"client_secret"`
+}
+
+// tokenRequest is OAuth 2.0 token endpoint request
+type tokenRequest struct {
+	GrantType    string `json:"grant_type" form:"grant_type"`
+	Scope        string `json:"scope" form:"scope"`
+	RefreshToken string `json:"refresh_token" form:"refresh_token"`
+	Code         string `json:"code" form:"code"`
+	RedirectUri  string `json:"redirect_uri" form:"redirect_uri"`
+	CodeVerifier string `json:"code_verifier" form:"code_verifier"`
+	clientAuth
+}
+
+// introspectRequest is RFC 7662 token introspection request
+type introspectRequest struct {
+	Token         string `json:"token" form:"token" validate:"required"`
+	TokenTypeHint string `json:"token_type_hint" form:"token_type_hint"`
+	clientAuth
+}
+
+// authorizeRequest is OAuth 2.0 authorization request with PKCE and OpenID Connect nonce
+type authorizeRequest struct {
+	ResponseType        string `json:"response_type" query:"response_type"`
+	ClientId            string `json:"client_id" query:"client_id"`
+	RedirectUri         string `json:"redirect_uri" query:"redirect_uri"`
+	Scope               string `json:"scope" query:"scope"`
+	State               string `json:"state" query:"state"`
+	Nonce               string `json:"nonce,omitempty" query:"nonce"`
+	CodeChallenge       string `json:"code_challenge" query:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method" query:"code_challenge_method"`
+}
+
+type authorizeLoginRequest struct {
+	Request  string `form:"request" validate:"required"`
+	Username string `form:"username" validate:"required"`
+	Password string `form:"password" validate:"required"`
+}
+
+type authorizeMfaRequest struct {
+	Mfa  string `form:"mfa" validate:"required"`
+	Code string `form:"code" validate:"required,max=32"`
+}
+
+type authorizeConsentRequest struct {
+	Consent  string `form:"consent" validate:"required"`
+	Decision string `form:"decision" validate:"required,oneof=allow deny"`
+}
@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 type JwtResponse struct {
 	Id           uint   `json:"id"`
 	JWT          string `json:"jwt"`
@@ -15,3 +17,236 @@ type SingleJwtResponse struct {
 	Id  uint   `json:"id"`
 	JWT string `json:"jwt"`
 }
+
+// TokenResponse is OAuth 2.0 successful token response
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	IdToken      string `json:"id_token,omitempty"`
+}
+
+// UserinfoResponse is OpenID Connect userinfo response
+type UserinfoResponse struct {
+	Sub string `json:"sub"`
+	OIDCUserClaims
+}
+
+// IntrospectionResponse is RFC 7662 introspection response,
+// inactive token is described by active field alone
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientId  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	Aud       string `json:"aud,omitempty"`
+	Iss       string `json:"iss,omitempty"`
+	Jti       string `json:"jti,omitempty"`
+}
+
+// MfaChallengeResponse asks to exchange MfaToken and second factor code for tokens
+type MfaChallengeResponse struct {
+	MfaRequired bool   `json:"mfaRequired"`
+	MfaToken    string `json:"mfaToken"`
+	ExpiresIn   int64  `json:"expiresIn"`
+}
+
+type MfaStatusResponse struct {
+	Totp          bool  `json:"totp"`
+	RecoveryCodes int64 `json:"recoveryCodes"`
+}
+
+// TotpEnrollmentResponse is shown once, Uri is rendered as QR code for authenticator apps
+type TotpEnrollmentResponse struct {
+	Secret string `json:"secret"`
+	Uri    string `json:"uri"`
+}
+
+type RecoveryCodesResponse struct {
+	Codes []string `json:"codes"`
+}
+
+type WebAuthnRelyingParty struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type WebAuthnUser struct {
+	Id          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type WebAuthnCredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type WebAuthnCredentialDescriptor struct {
+	Type       string   `json:"type"`
+	Id         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type WebAuthnAuthenticatorSelection struct {
+	ResidentKey        string `json:"residentKey"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification"`
+}
+
+// PublicKeyCredentialCreationOptions are options of navigator.credentials.create(),
+// binary values are base64url encoded and have to be decoded by frontend
+type PublicKeyCredentialCreationOptions struct {
+	Rp                     WebAuthnRelyingParty           `json:"rp"`
+	User                   WebAuthnUser                   `json:"user"`
+	Challenge              string                         `json:"challenge"`
+	PubKeyCredParams       []WebAuthnCredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                          `json:"timeout"`
+	ExcludeCredentials     []WebAuthnCredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection WebAuthnAuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                         `json:"attestation"`
+}
+
+// PublicKeyCredentialRequestOptions are options of navigator.credentials.get()
+type PublicKeyCredentialRequestOptions struct {
+	Challenge        string                         `json:"challenge"`
+	Timeout          int64                          `json:"timeout"`
+	RpId             string                         `json:"rpId"`
+	AllowCredentials []WebAuthnCredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                         `json:"userVerification"`
+}
+
+// PasskeyOptionsResponse carries ceremony token to send back with created or asserted credential
+type PasskeyOptionsResponse struct {
+	Ceremony  string      `json:"ceremony"`
+	PublicKey interface{} `json:"publicKey"`
+}
+
+type PasskeyResponse struct {
+	Id         uint       `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// LockoutResponse is locked key, like "user:bob" or "ip:10.0.0.1"
+type LockoutResponse struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"lockedUntil"`
+}
+
+// FieldError explains which rule request field has failed
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// ProblemResponse is RFC 7807 problem details of failed request, Code is one of errorCatalog
+type ProblemResponse struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Code     string       `json:"code"`
+	Errors   []FieldError `json:"errors,omitempty"`
+}
+
+// OAuthErrorResponse is OAuth 2.0 error response
+type OAuthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// JWK is a RFC 7517 public key
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type JWKSResponse struct {
+	Keys []JWK `json:"keys"`
+}
+
+// DiscoveryResponse is OpenID Connect provider metadata
+type DiscoveryResponse struct {
+	Issuer                           string   `json:"issuer"`
+	JwksUri                          string   `json:"jwks_uri"`
+	AuthorizationEndpoint            string   `json:"authorization_endpoint,omitempty"`
+	TokenEndpoint                    string   `json:"token_endpoint,omitempty"`
+	UserinfoEndpoint                 string   `json:"userinfo_endpoint,omitempty"`
+	RevocationEndpoint               string   `json:"revocation_endpoint,omitempty"`
+	IntrospectionEndpoint            string   `json:"introspection_endpoint,omitempty"`
+	ScopesSupported                  []string `json:"scopes_supported,omitempty"`
+	ResponseTypesSupported           []string `json:"response_types_supported"`
+	GrantTypesSupported              []string `json:"grant_types_supported,omitempty"`
+	SubjectTypesSupported            []string `json:"subject_types_supported"`
+	IdTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethods         []string `json:"token_endpoint_auth_methods_supported,omitempty"`
+	CodeChallengeMethodsSupported    []string `json:"code_challenge_methods_supported,omitempty"`
+	ClaimsSupported                  []string `json:"claims_supported,omitempty"`
+}
+
+type RoleResponse struct {
+	Id          uint     `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+type PermissionResponse struct {
+	Id          uint   `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type TeamResponse struct {
+	Id        uint      `json:"id"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type TeamMemberResponse struct {
+	UserId   uint      `json:"userId"`
+	Username string    `json:"username"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joinedAt"`
+}
+
+type TeamInvitationResponse struct {
+	Id        uint      `json:"id"`
+	TeamId    uint      `json:"teamId"`
+	TeamName  string    `json:"teamName"`
+	UserId    uint      `json:"userId,omitempty"`
+	Username  string    `json:"username,omitempty"`
+	Email     string    `json:"email,omitempty"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// Code and Link are returned only when invitation is created
+	Code string `json:"code,omitempty"`
+	Link string `json:"link,omitempty"`
+}
+
+type SessionResponse struct {
+	Id         uint      `json:"id"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Current    bool      `json:"current"`
+}
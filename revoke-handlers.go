@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"log"
+	"time"
+)
+
+// revokeAccessToken puts token jti into denylist until token expires
+func (s *Server) revokeAccessToken(jti string, expiresAt int64) error {
+	if jti == "" {
+		return nil
+	}
+	return s.dbe.RevokeToken(jti, time.Unix(expiresAt, 0))
+}
+
+// revokeRefreshToken ends session of user refresh token or forgets service refresh token.
+// Given client, only tokens issued to it are revoked. It returns false if token is unknown
+func (s *Server) revokeRefreshToken(refreshToken string, client *ServiceModel) (bool, error) {
+	digest := hashOpaqueToken(refreshToken)
+
+	token, err := s.dbe.GetRefreshToken(digest)
+	if err == nil && sameDigest(token.TokenHash, digest) {
+		session, err := s.dbe.GetSessionById(token.SessionId)
+		if err != nil {
+			return false, err
+		}
+		if client != nil && session.ClientId != client.Name {
+			return false, nil
+		}
+		_, err = s.dbe.RevokeSession(session.UserId, session.Id)
+		return true, err
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, err
+	}
+
+	service, err := s.dbe.GetServiceByRefreshToken(digest)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !sameDigest(service.RefreshTokenHash, digest) || (client != nil && service.Id != client.Id) {
+		return false, nil
+	}
+	return true, s.dbe.ClearServiceRefreshToken(service.Id)
+}
+
+// revokeJWT denylists user or service access token. Given client, only tokens issued
+// to it are revoked. It returns false if token is not valid
+func (s *Server) revokeJWT(tokenString string, client *ServiceModel) (bool, error) {
+	if claims, err := ParseJWT(tokenString, s.tokens); err == nil {
+		if client != nil && claims.ClientId != client.Name {
+			return false, nil
+		}
+		if claims.SessionId != 0 {
+			if _, err := s.dbe.RevokeSession(claims.UserInfo.Id, claims.SessionId); err != nil {
+				return false, err
+			}
+		}
+		return true, s.revokeAccessToken(claims.StandardClaims.Id, claims.ExpiresAt)
+	}
+
+	if claims, err := ParseServiceJWT(tokenString, s.tokens); err == nil {
+		if client != nil && claims.ClientId != client.Name {
+			return false, nil
+		}
+		return true, s.revokeAccessToken(claims.StandardClaims.Id, claims.ExpiresAt)
+	}
+	return false, nil
+}
+
+// HandleAuthSignOut ends current session: its refresh tokens stop working
+// and presented access token is denylisted
+func (s *Server) HandleAuthSignOut(c *fiber.Ctx) error {
+	log.Printf("handle sign-out at %s", c.Path())
+
+	var req signOutRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return apiError(codeInvalidRequest, "expect refresh token")
+		}
+	}
+
+	claims := userClaims(c)
+	if err := s.revokeAccessToken(claims.StandardClaims.Id, claims.ExpiresAt); err != nil {
+		return apiError(codeInternal, "can't revoke access token")
+	}
+	if claims.SessionId != 0 {
+		if _, err := s.dbe.RevokeSession(claims.UserInfo.Id, claims.SessionId); err != nil {
+			return apiError(codeInternal, "can't revoke session")
+		}
+	}
+	if req.RefreshToken != "" {
+		if _, err := s.revokeRefreshToken(req.RefreshToken, nil); err != nil {
+			return apiError(codeInternal, "can't revoke refresh token")
+		}
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// revokeToken revokes token of any kind, hint only decides which kind is tried first
+func (s *Server) revokeToken(token string, hint string, client *ServiceModel) error {
+	revokers := []func(string, *ServiceModel) (bool, error){s.revokeRefreshToken, s.revokeJWT}
+	if hint == "access_token" {
+		revokers = []func(string, *ServiceModel) (bool, error){s.revokeJWT, s.revokeRefreshToken}
+	}
+	for _, revoke := range revokers {
+		revoked, err := revoke(token, client)
+		if err != nil || revoked {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleAuthRevoke is revocation endpoint of first-party apps. It answers 200
+// for unknown and invalid tokens too, so that it can't be used to probe them
+func (s *Server) HandleAuthRevoke(c *fiber.Ctx) error {
+	log.Printf("handle revoke at %s", c.Path())
+
+	var req revokeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect token")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationError(err)
+	}
+
+	if err := s.revokeToken(req.Token, req.TokenTypeHint, nil); err != nil {
+		log.Printf("can't revoke token: %s", err)
+		return apiError(codeUnavailable, "can't revoke token")
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// HandleOAuthRevoke is RFC 7009 revocation endpoint for registered clients, public ones
+// identify themselves by client_id. Client revokes only tokens issued to it,
+// others are treated like unknown ones
+func (s *Server) HandleOAuthRevoke(c *fiber.Ctx) error {
+	log.Printf("handle oauth revoke at %s", c.Path())
+
+	var req oauthRevokeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return oauthError(c, fiber.StatusBadRequest, oauthInvalidRequest, "malformed request body")
+	}
+
+	client, err := s.oauthClient(c, &req.clientAuth)
+	if err != nil {
+		log.Printf("reject client: %s", err)
+		return oauthError(c, fiber.StatusUnauthorized, oauthInvalidClient, "client authentication failed")
+	}
+	if err := validate.Struct(req); err != nil {
+		return oauthError(c, fiber.StatusBadRequest, oauthInvalidRequest, "token is required")
+	}
+
+	if err := s.revokeToken(req.Token, req.TokenTypeHint, client); err != nil {
+		log.Printf("can't revoke token: %s", err)
+		return oauthError(c, fiber.StatusServiceUnavailable, oauthServerError, "can't revoke token")
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// pruneRevokedTokens periodically drops denylist entries of expired tokens,
+// it is meant to be run in its own goroutine
+func (s *Server) pruneRevokedTokens(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		pruned, err := s.dbe.PruneRevokedTokens()
+		if err != nil {
+			log.Printf("can't prune revoked tokens: %s", err)
+			continue
+		}
+		if pruned > 0 {
+			log.Printf("pruned %d revoked tokens", pruned)
+		}
+	}
+}
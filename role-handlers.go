@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// idParam parses positive id from route parameter
+func idParam(c *fiber.Ctx, name string) (uint, error) {
+	id, err := strconv.Atoi(c.Params(name, "not a number"))
+	if err != nil || id <= 0 {
+		return 0, apiError(codeInvalidRequest, "expect "+name)
+	}
+	return uint(id), nil
+}
+
+// validAccessName reports whether role or permission name fits into token claims
+func validAccessName(name string) bool {
+	return !strings.ContainsAny(name, " \t\r\n")
+}
+
+func roleResponse(role RoleModel, permissions []string) RoleResponse {
+	if permissions == nil {
+		permissions = []string{}
+	}
+	return RoleResponse{
+		Id:          role.Id,
+		Name:        role.Name,
+		Description: role.Description,
+		Permissions: permissions,
+	}
+}
+
+func (s *Server) HandleGetRoles(c *fiber.Ctx) error {
+	log.Printf("handle get roles at %s", c.Path())
+
+	roles, err := s.dbe.GetRoles()
+	if err != nil {
+		return apiError(codeInternal, "can't get roles")
+	}
+	permissions, err := s.dbe.GetRolesPermissions()
+	if err != nil {
+		return apiError(codeInternal, "can't get roles")
+	}
+
+	response := make([]RoleResponse, 0, len(roles))
+	for _, role := range roles {
+		response = append(response, roleResponse(role, permissions[role.Id]))
+	}
+	return c.JSON(response)
+}
+
+func (s *Server) HandleCreateRole(c *fiber.Ctx) error {
+	log.Printf("handle create role at %s", c.Path())
+
+	var req roleCreateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect name")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationError(err)
+	}
+	if !validAccessName(req.Name) {
+		return fieldError("name", "no_whitespace", "name must not contain whitespace")
+	}
+
+	if _, err := s.dbe.GetRoleByName(req.Name); err == nil {
+		return apiError(codeConflict, "such role already exists")
+	}
+	role, err := s.dbe.CreateRole(req.Name, req.Description)
+	if err != nil {
+		return apiError(codeInternal, "can't create role")
+	}
+	return c.Status(fiber.StatusCreated).JSON(roleResponse(*role, nil))
+}
+
+func (s *Server) HandleDeleteRole(c *fiber.Ctx) error {
+	log.Printf("handle delete role at %s", c.Path())
+
+	roleId, err := idParam(c, "roleId")
+	if err != nil {
+		return err
+	}
+	role, err := s.dbe.GetRoleById(roleId)
+	if err != nil {
+		return apiError(codeNotFound, "no such role")
+	}
+	if role.Name == roleAdmin {
+		return apiError(codeForbidden, "builtin role can't be deleted")
+	}
+
+	if err := s.dbe.DeleteRole(role.Id); err != nil {
+		return apiError(codeInternal, "can't delete role")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// rolePermission finds role and permission of route parameters
+func (s *Server) rolePermission(c *fiber.Ctx) (*RoleModel, *PermissionModel, error) {
+	roleId, err := idParam(c, "roleId")
+	if err != nil {
+		return nil, nil, err
+	}
+	permissionId, err := idParam(c, "permissionId")
+	if err != nil {
+		return nil, nil, err
+	}
+	role, err := s.dbe.GetRoleById(roleId)
+	if err != nil {
+		return nil, nil, apiError(codeNotFound, "no such role")
+	}
+	permission, err := s.dbe.GetPermissionById(permissionId)
+	if err != nil {
+		return nil, nil, apiError(codeNotFound, "no such permission")
+	}
+	return role, permission, nil
+}
+
+func (s *Server) HandleGrantPermission(c *fiber.Ctx) error {
+	log.Printf("handle grant permission at %s", c.Path())
+
+	role, permission, err := s.rolePermission(c)
+	if err != nil {
+		return err
+	}
+	if err := s.dbe.GrantPermission(role.Id, permission.Id); err != nil {
+		return apiError(codeInternal, "can't grant permission")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *Server) HandleRevokePermission(c *fiber.Ctx) error {
+	log.Printf("handle revoke permission at %s", c.Path())
+
+	role, permission, err := s.rolePermission(c)
+	if err != nil {
+		return err
+	}
+	// otherwise nobody may be left to manage roles
+	if role.Name == roleAdmin && builtinPermission(permission.Name) {
+		return apiError(codeForbidden, "builtin permission can't be taken from admin role")
+	}
+
+	revoked, err := s.dbe.RevokePermission(role.Id, permission.Id)
+	if err != nil {
+		return apiError(codeInternal, "can't revoke permission")
+	}
+	if !revoked {
+		return apiError(codeNotFound, "role has no such permission")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *Server) HandleGetPermissions(c *fiber.Ctx) error {
+	log.Printf("handle get permissions at %s", c.Path())
+
+	permissions, err := s.dbe.GetPermissions()
+	if err != nil {
+		return apiError(codeInternal, "can't get permissions")
+	}
+
+	response := make([]PermissionResponse, 0, len(permissions))
+	for _, permission := range permissions {
+		response = append(response, PermissionResponse{
+			Id:          permission.Id,
+			Name:        permission.Name,
+			Description: permission.Description,
+		})
+	}
+	return c.JSON(response)
+}
+
+func (s *Server) HandleCreatePermission(c *fiber.Ctx) error {
+	log.Printf("handle create permission at %s", c.Path())
+
+	var req permissionCreateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect name")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationError(err)
+	}
+	if !validAccessName(req.Name) {
+		return fieldError("name", "no_whitespace", "name must not contain whitespace")
+	}
+
+	if _, err := s.dbe.GetPermissionByName(req.Name); err == nil {
+		return apiError(codeConflict, "such permission already exists")
+	}
+	permission, err := s.dbe.CreatePermission(req.Name, req.Description)
+	if err != nil {
+		return apiError(codeInternal, "can't create permission")
+	}
+	return c.Status(fiber.StatusCreated).JSON(PermissionResponse{
+		Id:          permission.Id,
+		Name:        permission.Name,
+		Description: permission.Description,
+	})
+}
+
+func (s *Server) HandleDeletePermission(c *fiber.Ctx) error {
+	log.Printf("handle delete permission at %s", c.Path())
+
+	permissionId, err := idParam(c, "permissionId")
+	if err != nil {
+		return err
+	}
+	permission, err := s.dbe.GetPermissionById(permissionId)
+	if err != nil {
+		return apiError(codeNotFound, "no such permission")
+	}
+	if builtinPermission(permission.Name) {
+		return apiError(codeForbidden, "builtin permission can't be deleted")
+	}
+
+	if err := s.dbe.DeletePermission(permission.Id); err != nil {
+		return apiError(codeInternal, "can't delete permission")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *Server) HandleGetUserRoles(c *fiber.Ctx) error {
+	log.Printf("handle get user roles at %s", c.Path())
+
+	userId, err := idParam(c, "userId")
+	if err != nil {
+		return err
+	}
+	if _, err := s.dbe.GetUserById(userId); err != nil {
+		return apiError(codeNotFound, "no such user")
+	}
+
+	roles, err := s.dbe.GetUserRoles(userId)
+	if err != nil {
+		return apiError(codeInternal, "can't get roles")
+	}
+	permissions, err := s.dbe.GetRolesPermissions()
+	if err != nil {
+		return apiError(codeInternal, "can't get roles")
+	}
+
+	response := make([]RoleResponse, 0, len(roles))
+	for _, role := range roles {
+		response = append(response, roleResponse(role, permissions[role.Id]))
+	}
+	return c.JSON(response)
+}
+
+// userRole finds user and role of route parameters
+func (s *Server) userRole(c *fiber.Ctx) (*UserModel, *RoleModel, error) {
+	userId, err := idParam(c, "userId")
+	if err != nil {
+		return nil, nil, err
+	}
+	roleId, err := idParam(c, "roleId")
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := s.dbe.GetUserById(userId)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, apiError(codeNotFound, "no such user")
+	}
+	if err != nil {
+		return nil, nil, apiError(codeInternal, "can't get user")
+	}
+	role, err := s.dbe.GetRoleById(roleId)
+	if err != nil {
+		return nil, nil, apiError(codeNotFound, "no such role")
+	}
+	return user, role, nil
+}
+
+// HandleAssignRole gives role to user, tokens issued from now on carry it
+func (s *Server) HandleAssignRole(c *fiber.Ctx) error {
+	log.Printf("handle assign role at %s", c.Path())
+
+	user, role, err := s.userRole(c)
+	if err != nil {
+		return err
+	}
+	if err := s.dbe.AssignRole(user.Id, role.Id); err != nil {
+		return apiError(codeInternal, "can't assign role")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *Server) HandleUnassignRole(c *fiber.Ctx) error {
+	log.Printf("handle unassign role at %s", c.Path())
+
+	user, role, err := s.userRole(c)
+	if err != nil {
+		return err
+	}
+	if role.Name == roleAdmin && user.Id == userClaims(c).UserInfo.Id {
+		return apiError(codeForbidden, "admin can't take admin role from themselves")
+	}
+
+	unassigned, err := s.dbe.UnassignRole(user.Id, role.Id)
+	if err != nil {
+		return apiError(codeInternal, "can't unassign role")
+	}
+	if !unassigned {
+		return apiError(codeNotFound, "user has no such role")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
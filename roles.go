@@ -0,0 +1,42 @@
+package main
+
+// roleAdmin is the builtin role, it is given to ADMIN_USERNAMES at start
+const roleAdmin = "admin"
+
+// Builtin permissions checked by this server itself
+const (
+	permissionManageRoles    = "roles:manage"
+	permissionCreateServices = "services:create"
+	permissionManageLockouts = "lockouts:manage"
+)
+
+var builtinPermissions = []PermissionModel{
+	{Name: permissionManageRoles, Description: "manage roles, permissions and their assignments"},
+	{Name: permissionCreateServices, Description: "register services"},
+	{Name: permissionManageLockouts, Description: "view and lift sign-in lockouts"},
+}
+
+// builtinPermission reports whether permission is used by this server,
+// such permissions can't be deleted or taken from admin role
+func builtinPermission(name string) bool {
+	for _, permission := range builtinPermissions {
+		if permission.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// userInfo resolves roles and permissions of user, so that tokens carry them
+func (s *Server) userInfo(user *UserModel) (UserInfo, error) {
+	roles, permissions, err := s.dbe.GetUserAccess(user.Id)
+	if err != nil {
+		return UserInfo{}, err
+	}
+	return UserInfo{
+		Id:          user.Id,
+		Username:    user.Username,
+		Roles:       roles,
+		Permissions: permissions,
+	}, nil
+}
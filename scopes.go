@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// parseScope splits space separated scope into unique sorted scope tokens
+func parseScope(scope string) []string {
+	seen := map[string]bool{}
+	var scopes []string
+	for _, item := range strings.Fields(scope) {
+		if !seen[item] {
+			seen[item] = true
+			scopes = append(scopes, item)
+		}
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+func normalizeScope(scope string) string {
+	return strings.Join(parseScope(scope), " ")
+}
+
+// intersectScope keeps items of scope which allowed scope still has
+func intersectScope(scope string, allowed string) string {
+	var items []string
+	for _, item := range parseScope(scope) {
+		if hasScope(allowed, item) {
+			items = append(items, item)
+		}
+	}
+	return strings.Join(items, " ")
+}
+
+// hasScope reports whether space separated scope contains wanted
+func hasScope(scope string, wanted string) bool {
+	for _, item := range strings.Fields(scope) {
+		if item == wanted {
+			return true
+		}
+	}
+	return false
+}
+
+// grantScope narrows requested scope to allowed one. Empty request grants
+// everything allowed, ok is false if something not allowed is requested
+func grantScope(requested string, allowed string) (granted string, ok bool) {
+	if strings.TrimSpace(requested) == "" {
+		return normalizeScope(allowed), true
+	}
+	for _, item := range parseScope(requested) {
+		if !hasScope(allowed, item) {
+			return "", false
+		}
+	}
+	return normalizeScope(requested), true
+}
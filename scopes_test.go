@@ -0,0 +1,104 @@
+package main
+
+import "testing"
+
+func TestNormalizeScope(t *testing.T) {
+	tests := []struct {
+		scope string
+		want  string
+	}{
+		{"", ""},
+		{"  ", ""},
+		{"openid", "openid"},
+		{"profile openid", "openid profile"},
+		{"email\topenid  email\nprofile", "email openid profile"},
+	}
+	for _, tt := range tests {
+		if got := normalizeScope(tt.scope); got != tt.want {
+			t.Errorf("normalizeScope(%q) = %q, want %q", tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	tests := []struct {
+		scope  string
+		wanted string
+		want   bool
+	}{
+		{"openid profile", "profile", true},
+		{"openid profile", "email", false},
+		// items are matched whole, not as substrings
+		{"openid profile", "pro", false},
+		{"read:users", "read", false},
+		{"", "openid", false},
+	}
+	for _, tt := range tests {
+		if got := hasScope(tt.scope, tt.wanted); got != tt.want {
+			t.Errorf("hasScope(%q, %q) = %t, want %t", tt.scope, tt.wanted, got, tt.want)
+		}
+	}
+}
+
+func TestGrantScope(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested string
+		allowed   string
+		granted   string
+		ok        bool
+	}{
+		{"empty request grants allowed", "", "profile openid", "openid profile", true},
+		{"blank request grants allowed", "  ", "openid", "openid", true},
+		{"same scope", "openid profile", "openid profile", "openid profile", true},
+		{"narrower scope", "openid", "openid profile email", "openid", true},
+		{"duplicates are dropped", "openid openid", "openid", "openid", true},
+		{"wider scope", "openid admin", "openid profile", "", false},
+		{"nothing allowed", "openid", "", "", false},
+		{"prefix of allowed item", "read", "read:users", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			granted, ok := grantScope(tt.requested, tt.allowed)
+			if granted != tt.granted || ok != tt.ok {
+				t.Errorf("grantScope(%q, %q) = %q, %t, want %q, %t", tt.requested, tt.allowed, granted, ok, tt.granted, tt.ok)
+			}
+		})
+	}
+}
+
+func TestIntersectScope(t *testing.T) {
+	tests := []struct {
+		scope   string
+		allowed string
+		want    string
+	}{
+		{"openid profile", "openid profile", "openid profile"},
+		// scopes taken from service since token was issued are dropped
+		{"openid profile", "openid", "openid"},
+		{"profile openid", "email profile openid", "openid profile"},
+		{"openid", "", ""},
+		{"", "openid", ""},
+		{"read", "read:users", ""},
+	}
+	for _, tt := range tests {
+		if got := intersectScope(tt.scope, tt.allowed); got != tt.want {
+			t.Errorf("intersectScope(%q, %q) = %q, want %q", tt.scope, tt.allowed, got, tt.want)
+		}
+	}
+}
+
+// refreshing with granted scope of refresh token can't widen it back to scope of service
+func TestRefreshScopeNarrowing(t *testing.T) {
+	serviceScopes := "read write admin"
+	granted, ok := grantScope("read", serviceScopes)
+	if !ok {
+		t.Fatal("narrow scope is not granted")
+	}
+	if _, ok := grantScope("read write", intersectScope(granted, serviceScopes)); ok {
+		t.Errorf("refresh widens granted scope")
+	}
+	if refreshed, ok := grantScope("", intersectScope(granted, serviceScopes)); !ok || refreshed != "read" {
+		t.Errorf("refresh without scope grants %q, want %q", refreshed, "read")
+	}
+}
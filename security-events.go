@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"log"
+)
+
+// Types of security events
+const (
+	securityEventRefreshReuse   = "refresh_token_reuse"
+	securityEventPasswordReset  = "password_reset"
+	securityEventPasswordChange = "password_change"
+	securityEventUsernameChange = "username_change"
+	securityEventMfaEnabled     = "mfa_enabled"
+	securityEventMfaDisabled    = "mfa_disabled"
+	securityEventRecoveryCode   = "recovery_code_used"
+	securityEventRecoveryReset  = "recovery_codes_regenerated"
+	securityEventPasskeyAdded   = "passkey_added"
+	securityEventPasskeyRemoved = "passkey_removed"
+	securityEventPasskeyClone   = "passkey_sign_count_mismatch"
+)
+
+// securityEvent records event about user account, failures are only logged
+func (s *Server) securityEvent(c *fiber.Ctx, eventType string, userId uint, sessionId uint, details string) {
+	log.Printf("security event %s: user %d, session %d, ip %s: %s", eventType, userId, sessionId, s.clientIP(c), details)
+
+	event := &SecurityEventModel{
+		UserId:    userId,
+		SessionId: sessionId,
+		Type:      eventType,
+		IP:        s.clientIP(c),
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+		Details:   details,
+	}
+	if err := s.dbe.CreateSecurityEvent(event); err != nil {
+		log.Printf("can't record security event: %s", err)
+	}
+}
@@ -1,39 +1,98 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
+	"errors"
 	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
+	"log"
+	"net"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 )
 
 // Validator
 var validate = validator.New()
 
 type Server struct {
-	signKey   *rsa.PrivateKey
-	verifyKey *rsa.PublicKey
-	dbe       *DBEngine
+	tokens *TokenConfig
+	dbe    *DBEngine
+	// invitationLink is frontend page accepting invitation codes, optional
+	invitationLink string
+	mailer         Mailer
+	// requireVerifiedEmail forbids sign-in until user verifies email
+	requireVerifiedEmail bool
+	// emailVerifyLink is frontend page verifying email tokens, optional
+	emailVerifyLink string
+	// passwordResetLink is frontend page resetting password by token, optional
+	passwordResetLink string
+	passwordPolicy    *PasswordPolicy
+	// secrets encrypt TOTP secrets, two-factor authentication is unavailable without them
+	secrets    *SecretBox
+	totpIssuer string
+	webAuthn   *WebAuthnConfig
+	attempts   *AttemptTracker
+	rateLimits RateLimitStore
+	// globalRateLimits keep buckets of global policy, which every request takes from
+	globalRateLimits RateLimitStore
+	// rateLimitPolicies are policies by name, see defaultRateLimits
+	rateLimitPolicies map[string]RateLimitPolicy
+	// proxyHeader carries client address set by trustedProxies, like X-Forwarded-For
+	proxyHeader    string
+	trustedProxies []*net.IPNet
+	// periods of background loops
+	keyCheckInterval       time.Duration
+	denylistPruneInterval  time.Duration
+	attemptPruneInterval   time.Duration
+	rateLimitPruneInterval time.Duration
 }
 
-func genKeys() (*rsa.PrivateKey, *rsa.PublicKey, error) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return nil, nil, err
+// tokenError converts token parsing error into response error. Failures of
+// checking token, like database ones, don't mean the token is bad and are internal errors
+func tokenError(err error, expectedUse string) error {
+	if !inactiveToken(err) {
+		log.Printf("can't check token: %s", err)
+		return apiError(codeInternal, "can't check token")
+	}
+	log.Printf("reject token: %s", err)
+	switch {
+	case errors.Is(err, errTokenExpired):
+		return apiError(codeTokenExpired, "token expired")
+	case errors.Is(err, errTokenRevoked):
+		return apiError(codeTokenRevoked, "token revoked")
+	case errors.Is(err, errTokenWrongUse):
+		return apiError(codeWrongTokenType, "wrong token type, expect "+expectedUse+" token")
+	default:
+		return apiError(codeTokenInvalid, "invalid token")
 	}
-	publicKey := &privateKey.PublicKey
+}
 
-	return privateKey, publicKey, nil
+// frontendLink adds query parameter to configured frontend page,
+// it returns empty string if page is not configured
+func frontendLink(page string, key string, value string) string {
+	if page == "" {
+		return ""
+	}
+	link, err := url.Parse(page)
+	if err != nil {
+		log.Printf("invalid frontend link %q: %s", page, err)
+		return ""
+	}
+	query := link.Query()
+	query.Set(key, value)
+	link.RawQuery = query.Encode()
+	return link.String()
 }
 
 func CreateServer() (*Server, error) {
 	s := &Server{}
 
-	var err error
-	if s.signKey, s.verifyKey, err = genKeys(); err != nil {
-		return nil, err
+	s.tokens = &TokenConfig{
+		// public url of this server, downstream services check tokens against it
+		Issuer:   getEnv("ISSUER", "http://localhost"+os.Getenv("LISTEN_ON")),
+		Audience: getEnv("ACCESS_TOKEN_AUDIENCE", "tma"),
 	}
 
 	// configure content db engine
@@ -47,7 +106,32 @@ func CreateServer() (*Server, error) {
 		SSLMode:  "disable",
 		Tz:       os.Getenv("POSTGRES_TZ"),
 	}
-	dbe, err := NewDBEngine(aDBC)
+	passwords, err := NewPasswordHashing(PasswordHashingConfig{
+		Algorithm:         getEnv("PASSWORD_HASHER", "argon2id"),
+		Argon2Memory:      getEnvInt("ARGON2_MEMORY_KIB", 64*1024),
+		Argon2Iterations:  getEnvInt("ARGON2_ITERATIONS", 3),
+		Argon2Parallelism: getEnvInt("ARGON2_PARALLELISM", 2),
+		BcryptCost:        getEnvInt("BCRYPT_COST", 12),
+		ScryptLogN:        getEnvInt("SCRYPT_LOG_N", 15),
+		ScryptR:           getEnvInt("SCRYPT_R", 8),
+		ScryptP:           getEnvInt("SCRYPT_P", 1),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.passwordPolicy, err = NewPasswordPolicy(PasswordPolicyConfig{
+		MinLength:      getEnvInt("PASSWORD_MIN_LENGTH", 8),
+		MaxLength:      getEnvInt("PASSWORD_MAX_LENGTH", 128),
+		MinClasses:     getEnvInt("PASSWORD_MIN_CLASSES", 0),
+		RejectUsername: getEnvBool("PASSWORD_REJECT_USERNAME", true),
+		BreachedFile:   os.Getenv("BREACHED_PASSWORDS_FILE"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dbe, err := NewDBEngine(aDBC, passwords)
 	if err != nil {
 		return nil, err
 	}
@@ -55,32 +139,256 @@ func CreateServer() (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = dbe.SeedRoles(RoleModel{Name: roleAdmin, Description: "full access"}, builtinPermissions)
+	if err != nil {
+		return nil, err
+	}
+	if err = dbe.AssignRoleByUsernames(roleAdmin, getEnvList("ADMIN_USERNAMES")); err != nil {
+		return nil, err
+	}
 	s.dbe = dbe
 
+	// behind load balancer remote address is the balancer's one, clients are told by header
+	s.proxyHeader = os.Getenv("PROXY_HEADER")
+	if s.trustedProxies, err = parseTrustedProxies(getEnvList("TRUSTED_PROXIES")); err != nil {
+		return nil, err
+	}
+	if s.proxyHeader != "" && len(s.trustedProxies) == 0 {
+		return nil, errors.New("PROXY_HEADER requires TRUSTED_PROXIES")
+	}
+	s.invitationLink = getEnv("INVITATION_LINK", "")
+	s.requireVerifiedEmail = getEnvBool("REQUIRE_VERIFIED_EMAIL", false)
+	s.emailVerifyLink = getEnv("EMAIL_VERIFY_LINK", "")
+	s.passwordResetLink = getEnv("PASSWORD_RESET_LINK", "")
+
+	s.totpIssuer = getEnv("TOTP_ISSUER", "tma")
+	if key := os.Getenv("TOTP_ENCRYPTION_KEY"); key != "" {
+		if s.secrets, err = NewSecretBox(key); err != nil {
+			return nil, err
+		}
+	} else {
+		log.Printf("TOTP_ENCRYPTION_KEY is not set, two-factor authentication is unavailable")
+	}
+
+	// passkeys are bound to domain of frontend, issuer by default
+	issuer, err := url.Parse(s.tokens.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	s.webAuthn = &WebAuthnConfig{
+		RPId:    getEnv("WEBAUTHN_RP_ID", issuer.Hostname()),
+		RPName:  getEnv("WEBAUTHN_RP_NAME", "tma"),
+		Origins: getEnvList("WEBAUTHN_ORIGINS"),
+	}
+	if len(s.webAuthn.Origins) == 0 {
+		s.webAuthn.Origins = []string{issuer.Scheme + "://" + issuer.Host}
+	}
+
+	s.mailer, err = NewMailer(getEnv("MAILER", "stdout"), MailerConfig{
+		From:         getEnv("MAIL_FROM", "no-reply@localhost"),
+		SmtpHost:     os.Getenv("SMTP_HOST"),
+		SmtpPort:     getEnv("SMTP_PORT", "587"),
+		SmtpUsername: os.Getenv("SMTP_USERNAME"),
+		SmtpPassword: os.Getenv("SMTP_PASSWORD"),
+		Dir:          getEnv("MAILER_DIR", "mail"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	attemptStore, err := NewAttemptStore(getEnv("ATTEMPT_STORE", "postgres"), dbe)
+	if err != nil {
+		return nil, err
+	}
+	s.attempts = NewAttemptTracker(attemptStore, AttemptPolicy{
+		FreeAttempts: getEnvInt("LOGIN_FREE_ATTEMPTS", 5),
+		BaseLockout:  getEnvDuration("LOGIN_BASE_LOCKOUT", 30*time.Second),
+		MaxLockout:   getEnvDuration("LOGIN_MAX_LOCKOUT", time.Hour),
+		Window:       getEnvDuration("LOGIN_ATTEMPT_WINDOW", 24*time.Hour),
+	}, AttemptPolicy{
+		FreeAttempts: getEnvInt("LOGIN_IP_FREE_ATTEMPTS", 50),
+		BaseLockout:  getEnvDuration("LOGIN_IP_BASE_LOCKOUT", 30*time.Second),
+		MaxLockout:   getEnvDuration("LOGIN_IP_MAX_LOCKOUT", 15*time.Minute),
+		Window:       getEnvDuration("LOGIN_IP_ATTEMPT_WINDOW", time.Hour),
+	})
+
+	storeKind := getEnv("RATE_LIMIT_STORE", "postgres")
+	s.rateLimits, err = NewRateLimitStore(storeKind, dbe)
+	if err != nil {
+		return nil, err
+	}
+	// global policy is checked on every request, by default each replica counts it on its own
+	// rather than taking row lock in addition to the one of route policy
+	globalStoreKind := getEnv("RATE_LIMIT_GLOBAL_STORE", "memory")
+	s.globalRateLimits = s.rateLimits
+	if !strings.EqualFold(globalStoreKind, storeKind) {
+		if s.globalRateLimits, err = NewRateLimitStore(globalStoreKind, dbe); err != nil {
+			return nil, err
+		}
+	}
+	s.rateLimitPolicies = map[string]RateLimitPolicy{}
+	for name, fallback := range defaultRateLimits {
+		if s.rateLimitPolicies[name], err = getEnvRateLimit(name, fallback); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.denylistPruneInterval, err = getEnvInterval("DENYLIST_PRUNE_INTERVAL", 10*time.Minute); err != nil {
+		return nil, err
+	}
+	if s.attemptPruneInterval, err = getEnvInterval("ATTEMPT_PRUNE_INTERVAL", 10*time.Minute); err != nil {
+		return nil, err
+	}
+	if s.rateLimitPruneInterval, err = getEnvInterval("RATE_LIMIT_PRUNE_INTERVAL", 10*time.Minute); err != nil {
+		return nil, err
+	}
+
+	// signing keys are shared between restarts and replicas
+	keyStore, err := NewKeyStore(getEnv("KEY_STORE", "postgres"), getEnv("KEY_STORE_DIR", "keys"), dbe)
+	if err != nil {
+		return nil, err
+	}
+	if s.keyCheckInterval, err = getEnvInterval("KEY_CHECK_INTERVAL", time.Minute); err != nil {
+		return nil, err
+	}
+	s.tokens.Keys, err = NewKeyRing(keyStore, KeyRingConfig{
+		KeyBits:  getEnvInt("KEY_BITS", 2048),
+		Rotation: getEnvDuration("KEY_ROTATION_PERIOD", 30*24*time.Hour),
+		Overlap:  getEnvDuration("KEY_OVERLAP_PERIOD", 48*time.Hour),
+		// replicas and JWKS caches have to see new key before it signs
+		Publish: getEnvDuration("KEY_PUBLISH_PERIOD", keysCacheAge*time.Second+s.keyCheckInterval),
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	return s, nil
 }
 
 func (s *Server) StartApp() error {
-	app := fiber.New()
-	app.Use(cors.New())
+	go s.tokens.Keys.Run(s.keyCheckInterval)
+	go s.pruneRevokedTokens(s.denylistPruneInterval)
+	go s.attempts.Run(s.attemptPruneInterval)
+	go s.pruneRateLimits(s.rateLimitPruneInterval)
+
+	app := fiber.New(fiber.Config{
+		ErrorHandler: s.handleError,
+	})
+	app.Use(cors.New(cors.Config{
+		ExposeHeaders: "RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, RateLimit-Policy, Retry-After",
+	}))
+
+	// discovery and keys are public cacheable documents fetched by every relying party,
+	// they are registered before global limit and so aren't limited
+	wellKnownGroup := app.Group("/.well-known/")
+	wellKnownGroup.Get("/jwks.json", s.HandleJWKS)
+	wellKnownGroup.Get("/openid-configuration", s.HandleDiscovery)
+
+	app.Use(s.rateLimit("global"))
+	// policies shared by several routes
+	signInLimit := s.rateLimit("sign-in")
+	signUpLimit := s.rateLimit("sign-up")
+	refreshLimit := s.rateLimit("refresh")
+	emailLimit := s.rateLimit("email")
+
+	app.Get("/userinfo", s.RequireUser, s.HandleUserinfo)
+	app.Post("/userinfo", s.RequireUser, s.HandleUserinfo)
+
+	oauthGroup := app.Group("/oauth/")
+	oauthGroup.Get("/authorize", s.HandleAuthorize)
+	oauthGroup.Post("/authorize", signInLimit, s.HandleAuthorizeLogin)
+	oauthGroup.Post("/authorize/mfa", signInLimit, s.HandleAuthorizeMfa)
+	oauthGroup.Post("/authorize/consent", s.HandleAuthorizeConsent)
+	oauthGroup.Post("/token", s.rateLimit("oauth-token"), s.HandleOAuthToken)
+	oauthGroup.Post("/revoke", s.HandleOAuthRevoke)
+	oauthGroup.Post("/introspect", s.rateLimit("oauth-token"), s.HandleOAuthIntrospect)
 
 	apiGroup := app.Group("/api/v1/")
 
 	authGroup := apiGroup.Group("/auth/")
-	authGroup.Post("/sign-in/", s.HandleAuthSignIn)
-	authGroup.Post("/sign-up/", s.HandleAuthSignUp)
+	authGroup.Post("/sign-in/", signInLimit, s.HandleAuthSignIn)
+	authGroup.Post("/sign-in/mfa/", signInLimit, s.HandleAuthSignInMfa)
+	authGroup.Post("/sign-up/", signUpLimit, s.HandleAuthSignUp)
+	authGroup.Post("/sign-up/invitation/", signUpLimit, s.HandleSignUpWithInvitation)
 	authGroup.Post("/validate/", s.HandleAuthValidate)
-	authGroup.Post("/refresh/", s.HandleAuthRefresh)
+	authGroup.Post("/refresh/", refreshLimit, s.HandleAuthRefresh)
+	authGroup.Post("/sign-out/", s.RequireUser, s.HandleAuthSignOut)
+	authGroup.Post("/revoke/", s.HandleAuthRevoke)
+
+	emailGroup := authGroup.Group("/email/")
+	emailGroup.Put("/", s.RequireUser, emailLimit, s.HandleSetEmail)
+	emailGroup.Post("/verify/", s.HandleVerifyEmail)
+	emailGroup.Post("/resend/", emailLimit, s.HandleResendEmailVerification)
+
+	passwordGroup := authGroup.Group("/password/")
+	passwordGroup.Post("/forgot/", emailLimit, s.HandleForgotPassword)
+	passwordGroup.Post("/reset/", s.HandleResetPassword)
+	passwordGroup.Put("/", s.RequireUser, s.HandleChangePassword)
+
+	authGroup.Put("/username/", s.RequireUser, s.HandleChangeUsername)
+
+	passkeyGroup := authGroup.Group("/passkeys/")
+	passkeyGroup.Post("/sign-in/options/", s.HandlePasskeySignInOptions)
+	passkeyGroup.Post("/sign-in/", signInLimit, s.HandlePasskeySignIn)
+	passkeyGroup.Get("/", s.RequireUser, s.HandleGetPasskeys)
+	passkeyGroup.Post("/register/options/", s.RequireUser, s.HandlePasskeyRegistrationOptions)
+	passkeyGroup.Post("/register/", s.RequireUser, s.HandleRegisterPasskey)
+	passkeyGroup.Delete("/:passkeyId/", s.RequireUser, s.HandleDeletePasskey)
+
+	mfaGroup := authGroup.Group("/mfa/", s.RequireUser)
+	mfaGroup.Get("/", s.HandleGetMfa)
+	mfaGroup.Post("/totp/", s.HandleEnrollTotp)
+	mfaGroup.Post("/totp/confirm/", s.HandleConfirmTotp)
+	mfaGroup.Delete("/totp/", s.HandleDisableTotp)
+	mfaGroup.Post("/recovery-codes/", s.HandleRegenerateRecoveryCodes)
+
+	sessionGroup := authGroup.Group("/sessions/", s.RequireUser)
+	sessionGroup.Get("/", s.HandleGetSessions)
+	sessionGroup.Delete("/", s.HandleRevokeSessions)
+	sessionGroup.Delete("/:sessionId/", s.HandleRevokeSession)
+
+	serviceGroup := authGroup.Group("/service/")
+	serviceGroup.Post("/create/", s.RequireUser, s.RequirePermission(permissionCreateServices), s.HandleAuthServiceCreate)
+	serviceGroup.Post("/sign-in/", signInLimit, s.HandleAuthServiceSignIn)
+	serviceGroup.Post("/refresh/", refreshLimit, s.HandleAuthServiceRefresh)
+	serviceGroup.Post("/get-token/", s.HandleGetUserToken)
+	serviceGroup.Post("/link/", s.RequireUser, s.HandleLinkService)
+
+	teamGroup := apiGroup.Group("/teams/", s.RequireUser)
+	teamGroup.Get("/", s.HandleGetTeams)
+	teamGroup.Post("/", s.HandleCreateTeam)
+	teamGroup.Put("/active/", s.HandleSelectTeam)
+	teamGroup.Get("/invitations/", s.HandleGetInvitations)
+	teamGroup.Post("/invitations/accept/", s.HandleAcceptInvitationCode)
+	teamGroup.Post("/invitations/:invitationId/accept/", s.HandleAcceptInvitation)
+	teamGroup.Post("/invitations/:invitationId/decline/", s.HandleDeclineInvitation)
+	teamGroup.Delete("/:teamId/", s.HandleDeleteTeam)
+	teamGroup.Get("/:teamId/members/", s.HandleGetTeamMembers)
+	teamGroup.Put("/:teamId/members/:userId/", s.HandleUpdateTeamMember)
+	teamGroup.Delete("/:teamId/members/:userId/", s.HandleRemoveTeamMember)
+	teamGroup.Get("/:teamId/invitations/", s.HandleGetTeamInvitations)
+	teamGroup.Post("/:teamId/invitations/", s.HandleInviteTeamMember)
+	teamGroup.Delete("/:teamId/invitations/:invitationId/", s.HandleCancelTeamInvitation)
 
-	// Still not implemented completely
-	//serviceGroup := authGroup.Group("/service/")
-	//serviceGroup.Post("/create/", s.HandleAuthServiceCreate)
-	//serviceGroup.Post("/sign-in/", s.HandleAuthServiceSignIn)
-	//serviceGroup.Post("/refresh/", s.HandleAuthServiceRefresh)
-	//serviceGroup.Get("/get-token/:userId/")
+	adminGroup := apiGroup.Group("/admin/", s.RequireUser)
+	manageRoles := s.RequirePermission(permissionManageRoles)
+	adminGroup.Get("/roles/", manageRoles, s.HandleGetRoles)
+	adminGroup.Post("/roles/", manageRoles, s.HandleCreateRole)
+	adminGroup.Delete("/roles/:roleId/", manageRoles, s.HandleDeleteRole)
+	adminGroup.Put("/roles/:roleId/permissions/:permissionId/", manageRoles, s.HandleGrantPermission)
+	adminGroup.Delete("/roles/:roleId/permissions/:permissionId/", manageRoles, s.HandleRevokePermission)
+	adminGroup.Get("/permissions/", manageRoles, s.HandleGetPermissions)
+	adminGroup.Post("/permissions/", manageRoles, s.HandleCreatePermission)
+	adminGroup.Delete("/permissions/:permissionId/", manageRoles, s.HandleDeletePermission)
+	adminGroup.Get("/users/:userId/roles/", manageRoles, s.HandleGetUserRoles)
+	adminGroup.Put("/users/:userId/roles/:roleId/", manageRoles, s.HandleAssignRole)
+	adminGroup.Delete("/users/:userId/roles/:roleId/", manageRoles, s.HandleUnassignRole)
+	manageLockouts := s.RequirePermission(permissionManageLockouts)
+	adminGroup.Get("/lockouts/", manageLockouts, s.HandleGetLockouts)
+	adminGroup.Delete("/lockouts/", manageLockouts, s.HandleUnlock)
 
 	contentGroup := apiGroup.Group("/content/")
 	concreteUserGroup := contentGroup.Group("/user/:userId/")
-	concreteUserGroup.Get("/", s.HandleGetUser)
+	concreteUserGroup.Get("/", s.rateLimit("get-user"), s.HandleGetUser)
 	return app.Listen(os.Getenv("LISTEN_ON"))
 }
@@ -1,21 +1,24 @@
 package main
 
 import (
+	"errors"
 	"github.com/gofiber/fiber/v2"
 	"log"
-	"strconv"
+	"strings"
+	"time"
 )
 
-func (s *Server) refreshServiceToken(info ServiceInfo) (JwtResponse, error) {
-	token, err := generateAuthServiceJWT(info, s.signKey)
+// refreshServiceToken issues service tokens granting scope (space separated)
+func (s *Server) refreshServiceToken(info ServiceInfo, scope string) (JwtResponse, error) {
+	token, err := generateAuthServiceJWT(info, scope, s.tokens)
 	if err != nil {
 		return JwtResponse{}, err
 	}
-	refreshToken, err := generateServiceRefreshJWT(info, s.signKey)
+	refreshToken, err := newOpaqueToken()
 	if err != nil {
 		return JwtResponse{}, err
 	}
-	if err := s.dbe.UpdateServiceRefreshToken(info.Id, refreshToken); err != nil {
+	if err := s.dbe.UpdateServiceRefreshToken(info.Id, hashOpaqueToken(refreshToken), scope); err != nil {
 		return JwtResponse{}, err
 	}
 
@@ -27,28 +30,38 @@ func (s *Server) HandleAuthServiceSignIn(c *fiber.Ctx) error {
 
 	var req serviceAuthRequest
 	if err := c.BodyParser(&req); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "expect name and secretKey")
+		return apiError(codeInvalidRequest, "expect name and secretKey")
 	}
 	if err := validate.Struct(req); err != nil {
 		log.Printf(err.Error())
-		return fiber.NewError(fiber.StatusBadRequest, "validation error")
+		return validationError(err)
 	}
 
+	account := serviceAttemptKey(req.Name)
+	if err := s.reserveAttempt(c, account); err != nil {
+		return err
+	}
 	exist, err := s.dbe.CheckService(req.Name, req.SecretKey)
-	if err != nil || !exist {
-		return fiber.NewError(fiber.StatusBadRequest, "invalid name or secretKey")
+	if err != nil {
+		s.refundAttempt(c, account)
+		log.Printf("can't check service %s: %s", req.Name, err)
+		return apiError(codeInternal, "can't check credentials")
 	}
+	if !exist {
+		return apiError(codeInvalidCredentials, "invalid name or secretKey")
+	}
+	s.succeededAttempt(c, account)
 	service := &ServiceModel{}
 	service, err = s.dbe.GetServiceByName(req.Name)
 	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "can't find such service")
+		return apiError(codeInternal, "can't find such service")
 	}
 
 	info := ServiceInfo{Name: service.Name, Id: service.Id}
 
-	response, err := s.refreshServiceToken(info)
+	response, err := s.refreshServiceToken(info, service.Scopes)
 	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "error while create tokens")
+		return apiError(codeInternal, "error while create tokens")
 	}
 	return c.JSON(response)
 }
@@ -56,33 +69,34 @@ func (s *Server) HandleAuthServiceSignIn(c *fiber.Ctx) error {
 func (s *Server) HandleAuthServiceCreate(c *fiber.Ctx) error {
 	log.Printf("handle create service at %s", c.Path())
 
-	var req serviceAuthRequest
+	var req serviceCreateRequest
 	if err := c.BodyParser(&req); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "expect name and secretKey")
+		return apiError(codeInvalidRequest, "expect name and secretKey")
 	}
 	if err := validate.Struct(req); err != nil {
 		log.Printf(err.Error())
-		return fiber.NewError(fiber.StatusBadRequest, "validation error")
+		return validationError(err)
 	}
 
-	exist, err := s.dbe.CheckServiceByName(req.Name)
-	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "invalid name or secretKey")
-	}
-	if exist {
-		return fiber.NewError(fiber.StatusBadRequest, "such service already exists")
+	for _, uri := range strings.Fields(req.RedirectUris) {
+		if !validRedirectUri(uri) {
+			return apiError(codeInvalidRequest, "invalid redirect uri "+uri)
+		}
 	}
 
-	service, err := s.dbe.CreateService(req.Name, req.SecretKey)
+	service, err := s.dbe.CreateService(req.Name, req.SecretKey, normalizeScope(req.Scopes), req.RedirectUris, req.Public)
+	if errors.Is(err, errDuplicate) {
+		return apiError(codeConflict, "such service already exists")
+	}
 	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "can't create such service")
+		return apiError(codeInternal, "can't create such service")
 	}
 
 	info := ServiceInfo{Name: service.Name, Id: service.Id}
 
-	response, err := s.refreshServiceToken(info)
+	response, err := s.refreshServiceToken(info, service.Scopes)
 	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "error while create tokens")
+		return apiError(codeInternal, "error while create tokens")
 	}
 	return c.JSON(response)
 }
@@ -92,31 +106,25 @@ func (s *Server) HandleAuthServiceRefresh(c *fiber.Ctx) error {
 
 	var req RefreshRequest
 	if err := c.BodyParser(&req); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "expect refresh token")
+		return apiError(codeInvalidRequest, "expect refresh token")
 	}
 	if err := validate.Struct(req); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "validation error")
+		return validationError(err)
 	}
 
-	service, err := ParseServiceJWT(req.RefreshToken, s.verifyKey)
-	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "error while validate jwt")
+	digest := hashOpaqueToken(req.RefreshToken)
+	serviceModel, err := s.dbe.GetServiceByRefreshToken(digest)
+	if err != nil || !sameDigest(serviceModel.RefreshTokenHash, digest) {
+		return apiError(codeTokenInvalid, "invalid refresh token")
 	}
-	if err = validate.Struct(service); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "error while validate jwt")
+	if time.Now().After(serviceModel.RefreshTokenExpiresAt) {
+		return apiError(codeTokenExpired, "refresh token expired")
 	}
 
-	serviceModel, err := s.dbe.GetServiceById(service.Id)
+	service := ServiceInfo{Name: serviceModel.Name, Id: serviceModel.Id}
+	response, err := s.refreshServiceToken(service, intersectScope(serviceModel.RefreshTokenScope, serviceModel.Scopes))
 	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "can't find service")
-	}
-	if serviceModel.RefreshToken != req.RefreshToken {
-		return fiber.NewError(fiber.StatusBadRequest, "invalid refresh token")
-	}
-
-	response, err := s.refreshServiceToken(service)
-	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "error while create tokens")
+		return apiError(codeInternal, "error while create tokens")
 	}
 
 	return c.JSON(response)
@@ -126,44 +134,67 @@ func (s *Server) HandleGetUserToken(c *fiber.Ctx) error {
 	log.Printf("handle get user token at %s", c.Path())
 
 	var req serviceUserRequest
-	userId, err := strconv.Atoi(c.Params("userId", "not a number"))
-	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "expect userId")
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect jwt, serviceUsername and userId")
 	}
-	req.UserId = uint(userId)
-
 	if err := validate.Struct(req); err != nil {
 		log.Printf(err.Error())
-		return fiber.NewError(fiber.StatusBadRequest, "validation error")
+		return validationError(err)
 	}
 
-	service, err := ParseServiceJWT(req.JWT, s.verifyKey)
+	claims, err := s.authenticateService(req.JWT)
 	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "error while validate jwt")
-	}
-	if err = validate.Struct(service); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "error while validate jwt")
+		return tokenError(err, tokenUseServiceAccess)
 	}
+	service := claims.ServiceInfo
 
 	inService, err := s.dbe.CheckUserInService(req.UserId, req.ServiceUsername, service.Id)
 	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "no such user in service")
+		return apiError(codeNotFound, "no such user in service")
 	}
 
 	if !inService {
-		return fiber.NewError(fiber.StatusBadRequest, "no such user in service")
+		return apiError(codeNotFound, "no such user in service")
 	}
 
 	user, err := s.dbe.GetUserById(req.UserId)
 	if err != nil {
-		return err
+		return apiError(codeNotFound, "no such user")
 	}
 
-	info := UserInfo{Username: user.Username, Id: user.Id}
-	token, err := generateAuthJWT(info, s.signKey)
+	info, err := s.userInfo(user)
+	if err != nil {
+		return apiError(codeInternal, "can't get user roles")
+	}
+	token, err := generateAuthJWT(info, TokenGrant{ClientId: service.Name}, s.tokens)
 	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "can't generate user token")
+		return apiError(codeInternal, "can't generate user token")
 	}
 
 	return c.JSON(SingleJwtResponse{Id: user.Id, JWT: token})
 }
+
+// HandleLinkService lets signed-in user allow service to get tokens on their behalf
+func (s *Server) HandleLinkService(c *fiber.Ctx) error {
+	log.Printf("handle link service at %s", c.Path())
+
+	var req serviceLinkRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect name and serviceUsername")
+	}
+	if err := validate.Struct(req); err != nil {
+		log.Printf(err.Error())
+		return validationError(err)
+	}
+
+	service, err := s.dbe.GetServiceByName(req.Name)
+	if err != nil {
+		return apiError(codeNotFound, "no such service")
+	}
+
+	claims := userClaims(c)
+	if err := s.dbe.CreateUserServiceRelation(claims.UserInfo.Id, req.ServiceUsername, service.Id); err != nil {
+		return apiError(codeInternal, "can't link service")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
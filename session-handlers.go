@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"log"
+)
+
+func (s *Server) HandleGetSessions(c *fiber.Ctx) error {
+	log.Printf("handle get sessions at %s", c.Path())
+
+	claims := userClaims(c)
+	sessions, err := s.dbe.GetActiveSessions(claims.UserInfo.Id)
+	if err != nil {
+		return apiError(codeInternal, "can't get sessions")
+	}
+
+	response := make([]SessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, SessionResponse{
+			Id:         session.Id,
+			UserAgent:  session.UserAgent,
+			IP:         session.IP,
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+			ExpiresAt:  session.ExpiresAt,
+			Current:    session.Id == claims.SessionId,
+		})
+	}
+	return c.JSON(response)
+}
+
+func (s *Server) HandleRevokeSession(c *fiber.Ctx) error {
+	log.Printf("handle revoke session at %s", c.Path())
+
+	sessionId, err := idParam(c, "sessionId")
+	if err != nil {
+		return err
+	}
+
+	claims := userClaims(c)
+	revoked, err := s.dbe.RevokeSession(claims.UserInfo.Id, sessionId)
+	if err != nil {
+		return apiError(codeInternal, "can't revoke session")
+	}
+	if !revoked {
+		return apiError(codeNotFound, "no such session")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// HandleRevokeSessions revokes all user sessions, or all but current one with ?others=true
+func (s *Server) HandleRevokeSessions(c *fiber.Ctx) error {
+	log.Printf("handle revoke sessions at %s", c.Path())
+
+	claims := userClaims(c)
+	var except uint
+	if c.Query("others") == "true" {
+		except = claims.SessionId
+	}
+	if err := s.dbe.RevokeUserSessions(claims.UserInfo.Id, except); err != nil {
+		return apiError(codeInternal, "can't revoke sessions")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
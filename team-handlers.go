@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"log"
+)
+
+func (s *Server) HandleCreateTeam(c *fiber.Ctx) error {
+	log.Printf("handle create team at %s", c.Path())
+
+	var req teamCreateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect name")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationError(err)
+	}
+
+	team, err := s.dbe.CreateTeam(req.Name, userClaims(c).UserInfo.Id)
+	if err != nil {
+		return apiError(codeInternal, "can't create team")
+	}
+	return c.Status(fiber.StatusCreated).JSON(TeamResponse{
+		Id:        team.Id,
+		Name:      team.Name,
+		Role:      teamRoleOwner,
+		CreatedAt: team.CreatedAt,
+	})
+}
+
+// HandleGetTeams returns teams of current user
+func (s *Server) HandleGetTeams(c *fiber.Ctx) error {
+	log.Printf("handle get teams at %s", c.Path())
+
+	teams, err := s.dbe.GetUserTeams(userClaims(c).UserInfo.Id)
+	if err != nil {
+		return apiError(codeInternal, "can't get teams")
+	}
+
+	response := make([]TeamResponse, 0, len(teams))
+	for _, team := range teams {
+		response = append(response, TeamResponse{
+			Id:        team.Id,
+			Name:      team.Name,
+			Role:      team.Role,
+			CreatedAt: team.CreatedAt,
+		})
+	}
+	return c.JSON(response)
+}
+
+func (s *Server) HandleDeleteTeam(c *fiber.Ctx) error {
+	log.Printf("handle delete team at %s", c.Path())
+
+	membership, err := s.teamMembership(c, teamRoleOwner)
+	if err != nil {
+		return err
+	}
+	if err := s.dbe.DeleteTeam(membership.TeamId); err != nil {
+		return apiError(codeInternal, "can't delete team")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *Server) HandleGetTeamMembers(c *fiber.Ctx) error {
+	log.Printf("handle get team members at %s", c.Path())
+
+	membership, err := s.teamMembership(c, teamRoleMember)
+	if err != nil {
+		return err
+	}
+	members, err := s.dbe.GetTeamMembers(membership.TeamId)
+	if err != nil {
+		return apiError(codeInternal, "can't get team members")
+	}
+
+	response := make([]TeamMemberResponse, 0, len(members))
+	for _, member := range members {
+		response = append(response, TeamMemberResponse{
+			UserId:   member.UserId,
+			Username: member.Username,
+			Role:     member.Role,
+			JoinedAt: member.CreatedAt,
+		})
+	}
+	return c.JSON(response)
+}
+
+// teamMember finds membership of :userId parameter in team of actor
+func (s *Server) teamMember(c *fiber.Ctx, actor *TeamMembership) (*TeamMembership, error) {
+	userId, err := idParam(c, "userId")
+	if err != nil {
+		return nil, err
+	}
+	member, err := s.dbe.GetTeamMembership(actor.TeamId, userId)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, apiError(codeNotFound, "no such team member")
+	}
+	if err != nil {
+		return nil, apiError(codeInternal, "can't get team member")
+	}
+	return member, nil
+}
+
+// lastOwner reports whether member is the only owner of team, team can't be left without owner
+func (s *Server) lastOwner(member *TeamMembership) (bool, error) {
+	if member.Role != teamRoleOwner {
+		return false, nil
+	}
+	owners, err := s.dbe.CountTeamOwners(member.TeamId)
+	if err != nil {
+		return false, err
+	}
+	return owners <= 1, nil
+}
+
+// HandleUpdateTeamMember changes member role. Admins manage members and admins, owners manage everyone
+func (s *Server) HandleUpdateTeamMember(c *fiber.Ctx) error {
+	log.Printf("handle update team member at %s", c.Path())
+
+	actor, err := s.teamMembership(c, teamRoleAdmin)
+	if err != nil {
+		return err
+	}
+	member, err := s.teamMember(c, actor)
+	if err != nil {
+		return err
+	}
+
+	var req teamRoleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect role")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationError(err)
+	}
+
+	if !teamRoleAtLeast(actor.Role, member.Role) || !teamRoleAtLeast(actor.Role, req.Role) {
+		return apiError(codeForbidden, "team role is too low")
+	}
+	if req.Role != teamRoleOwner {
+		last, err := s.lastOwner(member)
+		if err != nil {
+			return apiError(codeInternal, "can't update team member")
+		}
+		if last {
+			return apiError(codeConflict, "team must have an owner")
+		}
+	}
+
+	if err := s.dbe.UpdateTeamMemberRole(member.TeamId, member.UserId, req.Role); err != nil {
+		return apiError(codeInternal, "can't update team member")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// HandleRemoveTeamMember removes member from team, any member may leave team by removing themselves
+func (s *Server) HandleRemoveTeamMember(c *fiber.Ctx) error {
+	log.Printf("handle remove team member at %s", c.Path())
+
+	actor, err := s.teamMembership(c, teamRoleMember)
+	if err != nil {
+		return err
+	}
+	member, err := s.teamMember(c, actor)
+	if err != nil {
+		return err
+	}
+
+	if member.UserId != actor.UserId {
+		if !teamRoleAtLeast(actor.Role, teamRoleAdmin) || !teamRoleAtLeast(actor.Role, member.Role) {
+			return apiError(codeForbidden, "team role is too low")
+		}
+	}
+	last, err := s.lastOwner(member)
+	if err != nil {
+		return apiError(codeInternal, "can't remove team member")
+	}
+	if last {
+		return apiError(codeConflict, "team must have an owner")
+	}
+
+	if err := s.dbe.RemoveTeamMember(member.TeamId, member.UserId); err != nil {
+		return apiError(codeInternal, "can't remove team member")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// HandleSelectTeam selects team current session acts in and returns access token carrying it.
+// Refresh tokens of session keep working and will carry the team too
+func (s *Server) HandleSelectTeam(c *fiber.Ctx) error {
+	log.Printf("handle select team at %s", c.Path())
+
+	var req teamSelectRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect teamId")
+	}
+
+	claims := userClaims(c)
+	if claims.SessionId == 0 {
+		return apiError(codeInvalidRequest, "token has no session")
+	}
+	if req.TeamId != 0 {
+		_, err := s.dbe.GetTeamMembership(req.TeamId, claims.UserInfo.Id)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return apiError(codeNotFound, "no such team")
+		}
+		if err != nil {
+			return apiError(codeInternal, "can't get team")
+		}
+	}
+	if err := s.dbe.SetSessionTeam(claims.SessionId, req.TeamId); err != nil {
+		return apiError(codeInternal, "can't select team")
+	}
+
+	session, err := s.dbe.GetSessionById(claims.SessionId)
+	if err != nil {
+		return apiError(codeInternal, "can't get session")
+	}
+	user, err := s.dbe.GetUserById(claims.UserInfo.Id)
+	if err != nil {
+		return apiError(codeTokenInvalid, "no such user")
+	}
+	info, err := s.userInfo(user)
+	if err == nil {
+		info, err = s.withActiveTeam(info, session)
+	}
+	if err != nil {
+		return apiError(codeInternal, "can't get user roles")
+	}
+
+	token, err := generateAuthJWT(info, session.grant(), s.tokens)
+	if err != nil {
+		return apiError(codeInternal, "can't generate user token")
+	}
+	return c.JSON(SingleJwtResponse{Id: user.Id, JWT: token})
+}
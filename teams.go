@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"time"
+)
+
+// Roles of team members, each one can do everything the previous can
+const (
+	teamRoleMember = "member"
+	teamRoleAdmin  = "admin"
+	teamRoleOwner  = "owner"
+)
+
+var teamRoleRank = map[string]int{
+	teamRoleMember: 1,
+	teamRoleAdmin:  2,
+	teamRoleOwner:  3,
+}
+
+const teamInvitationTTL = 7 * 24 * time.Hour
+
+// teamRoleAtLeast reports whether role is the same or higher than wanted
+func teamRoleAtLeast(role string, wanted string) bool {
+	return teamRoleRank[role] >= teamRoleRank[wanted]
+}
+
+// withActiveTeam adds team selected in session and user role in it to info.
+// Team stays in issued tokens until they expire, even if user leaves it
+func (s *Server) withActiveTeam(info UserInfo, session *SessionModel) (UserInfo, error) {
+	if session.ActiveTeamId == 0 {
+		return info, nil
+	}
+	membership, err := s.dbe.GetTeamMembership(session.ActiveTeamId, info.Id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return info, nil
+	}
+	if err != nil {
+		return info, err
+	}
+	info.TeamId = membership.TeamId
+	info.TeamRole = membership.Role
+	return info, nil
+}
+
+// teamMembership finds membership of current user in team of :teamId parameter and
+// checks that user role is at least minRole. Non members can't tell whether team exists
+func (s *Server) teamMembership(c *fiber.Ctx, minRole string) (*TeamMembership, error) {
+	teamId, err := idParam(c, "teamId")
+	if err != nil {
+		return nil, err
+	}
+	membership, err := s.dbe.GetTeamMembership(teamId, userClaims(c).UserInfo.Id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, apiError(codeNotFound, "no such team")
+	}
+	if err != nil {
+		return nil, apiError(codeInternal, "can't get team")
+	}
+	if !teamRoleAtLeast(membership.Role, minRole) {
+		return nil, apiError(codeForbidden, "team "+minRole+" role required")
+	}
+	return membership, nil
+}
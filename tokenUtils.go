@@ -1,15 +1,48 @@
 package main
 
 import (
-	"crypto/rsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt"
 	"time"
 )
 
+// Values of token_use claim, every parse path accepts exactly one of them.
+// Refresh tokens are opaque, see newOpaqueToken
+const (
+	tokenUseAccess        = "access"
+	tokenUseServiceAccess = "service_access"
+	tokenUseId            = "id"
+)
+
+var (
+	errTokenInvalid  = errors.New("invalid token")
+	errTokenExpired  = errors.New("token expired")
+	errTokenWrongUse = errors.New("unexpected token type")
+	errTokenRevoked  = errors.New("token revoked")
+)
+
+// TokenConfig describes who issues tokens and who they are meant for
+type TokenConfig struct {
+	Issuer string
+	// Audience of access tokens
+	Audience string
+	Keys     *KeyRing
+}
+
 type UserInfo struct {
 	Id       uint   `json:"id" validate:"required"`
 	Username string `json:"username" validate:"required"`
+	// Roles and Permissions are resolved when token is issued
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	// TeamId and TeamRole describe team selected in session
+	TeamId   uint   `json:"team_id,omitempty"`
+	TeamRole string `json:"team_role,omitempty"`
 }
 
 type ServiceInfo struct {
@@ -17,90 +50,210 @@ type ServiceInfo struct {
 	Name string `json:"name" validate:"required"`
 }
 
+// TokenGrant tells how user access token was obtained
+type TokenGrant struct {
+	// SessionId is zero for tokens issued outside of sessions
+	SessionId uint `json:"sid,omitempty"`
+	// ClientId is set for tokens issued to OAuth clients
+	ClientId string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+}
+
 type CustomClaims struct {
 	*jwt.StandardClaims
-	TokenType string
+	TokenUse string `json:"token_use"`
+	TokenGrant
 	UserInfo
 }
 
 type ServiceCustomClaims struct {
 	*jwt.StandardClaims
-	TokenType string
+	TokenUse string `json:"token_use"`
+	ClientId string `json:"client_id"`
+	Scope    string `json:"scope,omitempty"`
 	ServiceInfo
 }
 
-func ParseJWT(tokenString string, verifyKey *rsa.PublicKey) (UserInfo, error) {
+// typedClaims are claims with standard part and token_use
+type typedClaims interface {
+	jwt.Claims
+	standard() *jwt.StandardClaims
+	use() string
+}
 
-	token, err := jwt.ParseWithClaims(tokenString, &CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return verifyKey, nil
-	})
-	if err != nil {
-		return UserInfo{}, nil
-	}
+func (cc *CustomClaims) standard() *jwt.StandardClaims {
+	return cc.StandardClaims
+}
 
-	if !token.Valid {
-		return UserInfo{}, fmt.Errorf("invalid jwt")
+func (cc *CustomClaims) use() string {
+	return cc.TokenUse
+}
+
+func (scc *ServiceCustomClaims) standard() *jwt.StandardClaims {
+	return scc.StandardClaims
+}
+
+func (scc *ServiceCustomClaims) use() string {
+	return scc.TokenUse
+}
+
+// tokenTyp is typ header of every token kind
+var tokenTyp = map[string]string{
+	tokenUseAccess:        "at+jwt",
+	tokenUseServiceAccess: "at+jwt",
+}
+
+// audience returns aud claim expected for tokens of given kind
+func (tc *TokenConfig) audience(tokenUse string) string {
+	switch tokenUse {
+	case tokenUseAccess, tokenUseServiceAccess:
+		return tc.Audience
+	default:
+		return tc.Issuer
 	}
-	claims := token.Claims.(*CustomClaims)
+}
 
-	return claims.UserInfo, nil
+// newTokenId returns random jti, so that no two tokens are the same
+func newTokenId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return b64url(id)
 }
 
-func ParseServiceJWT(tokenString string, verifyKey *rsa.PublicKey) (ServiceInfo, error) {
+func (tc *TokenConfig) standardClaims(tokenUse string, expDuration time.Duration) *jwt.StandardClaims {
+	now := time.Now()
+	return &jwt.StandardClaims{
+		Id:        newTokenId(),
+		Issuer:    tc.Issuer,
+		Audience:  tc.audience(tokenUse),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(expDuration).Unix(),
+	}
+}
 
-	token, err := jwt.ParseWithClaims(tokenString, &CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return verifyKey, nil
-	})
+// parseClaims verifies token signature, lifetime, issuer, audience and token_use
+func parseClaims(tokenString string, claims typedClaims, tokenUse string, tc *TokenConfig) error {
+	token, err := jwt.ParseWithClaims(tokenString, claims, tc.Keys.keyFunc)
 	if err != nil {
-		return ServiceInfo{}, nil
+		var validationErr *jwt.ValidationError
+		if errors.As(err, &validationErr) && validationErr.Errors&jwt.ValidationErrorExpired != 0 {
+			return errTokenExpired
+		}
+		return fmt.Errorf("%w: %s", errTokenInvalid, err)
 	}
-
 	if !token.Valid {
-		return ServiceInfo{}, fmt.Errorf("invalid jwt")
+		return errTokenInvalid
+	}
+
+	standard := claims.standard()
+	if !standard.VerifyIssuer(tc.Issuer, true) {
+		return errTokenInvalid
+	}
+	if !standard.VerifyAudience(tc.audience(tokenUse), true) || claims.use() != tokenUse {
+		return errTokenWrongUse
+	}
+	return nil
+}
+
+func parseUserJWT(tokenString string, tokenUse string, tc *TokenConfig) (*CustomClaims, error) {
+	claims := &CustomClaims{StandardClaims: &jwt.StandardClaims{}}
+	if err := parseClaims(tokenString, claims, tokenUse, tc); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func parseServiceJWT(tokenString string, tokenUse string, tc *TokenConfig) (*ServiceCustomClaims, error) {
+	claims := &ServiceCustomClaims{StandardClaims: &jwt.StandardClaims{}}
+	if err := parseClaims(tokenString, claims, tokenUse, tc); err != nil {
+		return nil, err
 	}
-	claims := token.Claims.(*ServiceCustomClaims)
+	return claims, nil
+}
+
+// ParseJWT accepts only user access tokens
+func ParseJWT(tokenString string, tc *TokenConfig) (*CustomClaims, error) {
+	return parseUserJWT(tokenString, tokenUseAccess, tc)
+}
 
-	return claims.ServiceInfo, nil
+// ParseServiceJWT accepts only service access tokens
+func ParseServiceJWT(tokenString string, tc *TokenConfig) (*ServiceCustomClaims, error) {
+	return parseServiceJWT(tokenString, tokenUseServiceAccess, tc)
 }
 
-func generateServiceJWT(info ServiceInfo, expDuration time.Duration, signKey *rsa.PrivateKey) (string, error) {
+func generateServiceJWT(info ServiceInfo, scope string, tokenUse string, expDuration time.Duration, tc *TokenConfig) (string, error) {
+	standard := tc.standardClaims(tokenUse, expDuration)
+	standard.Subject = info.Name
+
 	token := jwt.New(jwt.GetSigningMethod("RS256"))
 	token.Claims = &ServiceCustomClaims{
-		&jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(expDuration).Unix(),
-		},
-		"level1",
+		standard,
+		tokenUse,
+		info.Name,
+		scope,
 		info,
 	}
 
-	return token.SignedString(signKey)
+	return signToken(token, tokenUse, tc)
 }
 
-func generateAuthServiceJWT(info ServiceInfo, signKey *rsa.PrivateKey) (string, error) {
-	return generateServiceJWT(info, time.Minute*10, signKey)
+func generateAuthServiceJWT(info ServiceInfo, scope string, tc *TokenConfig) (string, error) {
+	return generateServiceJWT(info, scope, tokenUseServiceAccess, serviceAccessTokenTTL, tc)
 }
 
-func generateServiceRefreshJWT(info ServiceInfo, signKey *rsa.PrivateKey) (string, error) {
-	return generateServiceJWT(info, time.Minute*30, signKey)
-}
+// Lifetimes of tokens, session expires together with its refresh token
+const (
+	accessTokenTTL         = time.Minute * 5
+	idTokenTTL             = time.Minute * 5
+	refreshTokenTTL        = time.Minute * 20
+	serviceAccessTokenTTL  = time.Minute * 10
+	serviceRefreshTokenTTL = time.Minute * 30
+)
 
-func generateJWT(info UserInfo, expDuration time.Duration, signKey *rsa.PrivateKey) (string, error) {
+func generateJWT(info UserInfo, grant TokenGrant, tokenUse string, expDuration time.Duration, tc *TokenConfig) (string, error) {
 	token := jwt.New(jwt.GetSigningMethod("RS256"))
 	token.Claims = &CustomClaims{
-		&jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(expDuration).Unix(),
-		},
-		"level1",
+		tc.standardClaims(tokenUse, expDuration),
+		tokenUse,
+		grant,
 		info,
 	}
 
-	return token.SignedString(signKey)
+	return signToken(token, tokenUse, tc)
+}
+
+func generateAuthJWT(info UserInfo, grant TokenGrant, tc *TokenConfig) (string, error) {
+	return generateJWT(info, grant, tokenUseAccess, accessTokenTTL, tc)
+}
+
+// newOpaqueToken returns random refresh token. Only its digest is stored,
+// so that database read doesn't leak usable credentials
+func newOpaqueToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return b64url(token), nil
+}
+
+// hashOpaqueToken returns hex encoded SHA-256 digest of token
+func hashOpaqueToken(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(digest[:])
 }
 
-func generateAuthJWT(info UserInfo, signKey *rsa.PrivateKey) (string, error) {
-	return generateJWT(info, time.Minute*5, signKey)
+func sameDigest(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
 }
 
-func generateRefreshJWT(info UserInfo, signKey *rsa.PrivateKey) (string, error) {
-	return generateJWT(info, time.Minute*20, signKey)
+// signToken signs token with the active key and marks it with key id and type
+func signToken(token *jwt.Token, tokenUse string, tc *TokenConfig) (string, error) {
+	key := tc.Keys.SigningKey()
+	token.Header["kid"] = key.Kid
+	if typ, ok := tokenTyp[tokenUse]; ok {
+		token.Header["typ"] = typ
+	}
+	return token.SignedString(key.PrivateKey)
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TOTP parameters, the defaults of authenticator apps
+const (
+	totpDigits     = 6
+	totpPeriod     = 30 * time.Second
+	totpSecretSize = 20
+	// totpSkew is how many periods code may be late or early because of clock drift
+	totpSkew = 1
+)
+
+const (
+	tokenUseMfaChallenge = "mfa_challenge"
+	mfaChallengeTTL      = 5 * time.Minute
+	recoveryCodeCount    = 10
+	// mfaMaxFailures wrong codes in a row lock second factor of user for mfaLockout
+	mfaMaxFailures = 5
+	mfaLockout     = 15 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTotpSecret() ([]byte, error) {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(totpPeriod/time.Second)
+}
+
+// hotp is RFC 4226 one-time password of counter
+func hotp(secret []byte, counter int64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulo := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulo)
+}
+
+// matchTotp finds time step of code around now, it returns false if code matches none
+func matchTotp(secret []byte, code string, now time.Time) (int64, bool) {
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// isTotpCode tells TOTP codes from recovery codes
+func isTotpCode(code string) bool {
+	if len(code) != totpDigits {
+		return false
+	}
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// totpURI is otpauth provisioning uri authenticator apps scan as QR code
+func totpURI(issuer string, account string, secret []byte) string {
+	query := url.Values{}
+	query.Set("secret", totpEncoding.EncodeToString(secret))
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", strconv.Itoa(totpDigits))
+	query.Set("period", strconv.Itoa(int(totpPeriod/time.Second)))
+	link := url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + issuer + ":" + account, RawQuery: query.Encode()}
+	return link.String()
+}
+
+// SecretBox encrypts secrets stored in database with AES-256-GCM
+type SecretBox struct {
+	aead cipher.AEAD
+}
+
+// NewSecretBox makes box of base64 encoded 32 byte key
+func NewSecretBox(encodedKey string) (*SecretBox, error) {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		key, err = base64.RawURLEncoding.DecodeString(encodedKey)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("encryption key must be 32 bytes encoded with base64")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretBox{aead: aead}, nil
+}
+
+// Seal encrypts plaintext bound to context, like owner id, so that
+// ciphertext can't be moved to another row
+func (sb *SecretBox) Seal(plaintext []byte, context string) (string, error) {
+	nonce := make([]byte, sb.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return b64url(sb.aead.Seal(nonce, nonce, plaintext, []byte(context))), nil
+}
+
+func (sb *SecretBox) Open(sealed string, context string) ([]byte, error) {
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(data) < sb.aead.NonceSize() {
+		return nil, errors.New("malformed sealed secret")
+	}
+	nonce, ciphertext := data[:sb.aead.NonceSize()], data[sb.aead.NonceSize():]
+	return sb.aead.Open(nil, nonce, ciphertext, []byte(context))
+}
+
+// totpContext binds encrypted TOTP secret to its user
+func totpContext(userId uint) string {
+	return "totp:" + strconv.FormatUint(uint64(userId), 10)
+}
+
+// recoveryCodeEncoding avoids letters easy to confuse when typing codes
+var recoveryCodeEncoding = base32.NewEncoding("abcdefghijkmnpqrstuvwxyz23456789").WithPadding(base32.NoPadding)
+
+// newRecoveryCodes returns codes like "abcde-fghjk", about 50 bits each
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		random := make([]byte, 7)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+		code := recoveryCodeEncoding.EncodeToString(random)[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode ignores case, dashes and spaces users may type
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return hashOpaqueToken(code)
+}
+
+// MfaClaims are claims of MFA challenge token, issued after password check
+// and exchanged together with second factor code for real tokens
+type MfaClaims struct {
+	*jwt.StandardClaims
+	TokenUse string `json:"token_use"`
+	UserId   uint   `json:"uid"`
+}
+
+func (mc *MfaClaims) standard() *jwt.StandardClaims {
+	return mc.StandardClaims
+}
+
+func (mc *MfaClaims) use() string {
+	return mc.TokenUse
+}
+
+func generateMfaToken(userId uint, tc *TokenConfig) (string, error) {
+	token := jwt.New(jwt.GetSigningMethod("RS256"))
+	token.Claims = &MfaClaims{
+		tc.standardClaims(tokenUseMfaChallenge, mfaChallengeTTL),
+		tokenUseMfaChallenge,
+		userId,
+	}
+	return signToken(token, tokenUseMfaChallenge, tc)
+}
+
+func parseMfaToken(tokenString string, tc *TokenConfig) (*MfaClaims, error) {
+	claims := &MfaClaims{StandardClaims: &jwt.StandardClaims{}}
+	if err := parseClaims(tokenString, claims, tokenUseMfaChallenge, tc); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
@@ -1,90 +1,266 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
 	"log"
 	"strconv"
+	"time"
 )
 
-func (s *Server) refreshToken(info UserInfo) (JwtResponse, error) {
-	token, err := generateAuthJWT(info, s.signKey)
+var (
+	errRefreshTokenInvalid = errors.New("invalid refresh token")
+	errRefreshTokenReused  = errors.New("refresh token reuse detected, session revoked")
+)
+
+// refreshToken issues tokens of session, parentId is id of rotated refresh token if any.
+// Scope of access token may be narrower than session one, refresh token keeps the latter
+func (s *Server) refreshToken(info UserInfo, session *SessionModel, scope string, parentId *uint) (JwtResponse, error) {
+	info, err := s.withActiveTeam(info, session)
+	if err != nil {
+		return JwtResponse{}, err
+	}
+	grant := session.grant()
+	grant.Scope = scope
+	token, err := generateAuthJWT(info, grant, s.tokens)
 	if err != nil {
 		return JwtResponse{}, err
 	}
-	refreshToken, err := generateRefreshJWT(info, s.signKey)
+	refreshToken, err := newOpaqueToken()
 	if err != nil {
 		return JwtResponse{}, err
 	}
-	if err := s.dbe.UpdateRefreshToken(info.Id, refreshToken); err != nil {
+	if err := s.dbe.AddRefreshToken(session, parentId, hashOpaqueToken(refreshToken)); err != nil {
 		return JwtResponse{}, err
 	}
 
 	return JwtResponse{JWT: token, RefreshToken: refreshToken, Id: info.Id}, nil
 }
 
+// startSession opens a new session for the requesting device and issues its tokens.
+// Sessions started by OAuth clients remember the client and granted scope
+func (s *Server) startSession(c *fiber.Ctx, info UserInfo, clientId string, scope string) (JwtResponse, *SessionModel, error) {
+	session, err := s.dbe.CreateSession(info.Id, c.Get(fiber.HeaderUserAgent), s.clientIP(c), clientId, scope)
+	if err != nil {
+		return JwtResponse{}, nil, err
+	}
+	response, err := s.refreshToken(info, session, session.Scope, nil)
+	return response, session, err
+}
+
+// useRefreshToken finds active session of refresh token and marks token rotated.
+// Session must be started by clientId, empty for first party sign-ins, so that
+// tokens of OAuth clients are not refreshed without client authentication.
+// Already rotated token means it was stolen or its legitimate owner
+// is racing with thief, so the whole token family gets revoked
+func (s *Server) useRefreshToken(c *fiber.Ctx, refreshToken string, clientId string) (*SessionModel, *uint, error) {
+	digest := hashOpaqueToken(refreshToken)
+	token, err := s.dbe.GetRefreshToken(digest)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, errRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !sameDigest(token.TokenHash, digest) {
+		return nil, nil, errRefreshTokenInvalid
+	}
+	session, err := s.dbe.GetSessionById(token.SessionId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !session.Active(time.Now()) || session.ClientId != clientId {
+		return nil, nil, errRefreshTokenInvalid
+	}
+
+	rotated, err := s.dbe.MarkRefreshTokenRotated(token.Id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !rotated {
+		if _, err := s.dbe.RevokeSession(session.UserId, session.Id); err != nil {
+			log.Printf("can't revoke session %d: %s", session.Id, err)
+		}
+		s.securityEvent(c, securityEventRefreshReuse, session.UserId, session.Id,
+			fmt.Sprintf("refresh token %d presented after rotation, session revoked", token.Id))
+		return nil, nil, errRefreshTokenReused
+	}
+	return session, &token.Id, nil
+}
+
+// refreshSessionTokens issues new tokens of session after useRefreshToken
+func (s *Server) refreshSessionTokens(session *SessionModel, scope string, parentId *uint) (JwtResponse, error) {
+	user, err := s.dbe.GetUserById(session.UserId)
+	if err != nil {
+		return JwtResponse{}, err
+	}
+
+	info, err := s.userInfo(user)
+	if err != nil {
+		return JwtResponse{}, err
+	}
+	return s.refreshToken(info, session, scope, parentId)
+}
+
 func (s *Server) HandleAuthSignIn(c *fiber.Ctx) error {
 	log.Printf("handle sign-in at %s", c.Path())
 
 	var req userAuthRequest
 	if err := c.BodyParser(&req); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "expect username and password")
+		return apiError(codeInvalidRequest, "expect username and password")
 	}
 	if err := validate.Struct(req); err != nil {
 		log.Printf(err.Error())
-		return fiber.NewError(fiber.StatusBadRequest, "validation error")
+		return validationError(err)
 	}
 
+	account := userAttemptKey(req.Username)
+	if err := s.reserveAttempt(c, account); err != nil {
+		return err
+	}
 	exist, err := s.dbe.CheckUser(req.Username, req.Password)
-	if err != nil || !exist {
-		return fiber.NewError(fiber.StatusBadRequest, "invalid username or password")
+	if err != nil {
+		s.refundAttempt(c, account)
+		log.Printf("can't check user %s: %s", req.Username, err)
+		return apiError(codeInternal, "can't check credentials")
 	}
+	if !exist {
+		return apiError(codeInvalidCredentials, "invalid username or password")
+	}
+	s.succeededAttempt(c, account)
 	user := &UserModel{}
 	user, err = s.dbe.GetUserByUsername(req.Username)
 	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "can't find such user")
+		return apiError(codeInternal, "can't find such user")
+	}
+	if s.requireVerifiedEmail && !user.EmailVerified() {
+		return apiError(codeEmailNotVerified, "email is not verified")
+	}
+	mfa, err := s.mfaRequired(user.Id)
+	if err != nil {
+		return apiError(codeInternal, "can't check two-factor authentication")
 	}
+	if mfa {
+		return s.mfaChallenge(c, user)
+	}
+
+	info, err := s.userInfo(user)
+	if err != nil {
+		return apiError(codeInternal, "can't get user roles")
+	}
+
+	response, _, err := s.startSession(c, info, "", "")
+	if err != nil {
+		return apiError(codeInternal, "error while create tokens")
+	}
+	return c.JSON(response)
+}
 
-	info := UserInfo{Username: user.Username, Id: user.Id}
+// signUpResponse starts session of new user, or only reports
+// the user if email has to be verified before sign-in
+func (s *Server) signUpResponse(c *fiber.Ctx, user *UserModel) error {
+	if s.requireVerifiedEmail && !user.EmailVerified() {
+		return c.Status(fiber.StatusAccepted).JSON(UserResponse{Id: user.Id, Username: user.Username})
+	}
 
-	response, err := s.refreshToken(info)
+	info, err := s.userInfo(user)
 	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "error while create tokens")
+		return apiError(codeInternal, "can't get user roles")
+	}
+
+	response, _, err := s.startSession(c, info, "", "")
+	if err != nil {
+		return apiError(codeInternal, "error while create tokens")
 	}
 	return c.JSON(response)
 }
 
+// HandleAuthSignUp creates user and sends verification to email, if it is given
 func (s *Server) HandleAuthSignUp(c *fiber.Ctx) error {
 	log.Printf("handle sign-up at %s", c.Path())
 
-	var req userAuthRequest
+	var req userSignUpRequest
 	if err := c.BodyParser(&req); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "expect username and password")
+		return apiError(codeInvalidRequest, "expect username and password")
 	}
 	if err := validate.Struct(req); err != nil {
 		log.Printf(err.Error())
-		return fiber.NewError(fiber.StatusBadRequest, "validation error")
+		return validationError(err)
+	}
+	email := normalizeEmail(req.Email)
+	if s.requireVerifiedEmail && email == "" {
+		return fieldError("email", "required", "email is required")
+	}
+	if violations := s.passwordViolations("password", req.Password, req.Username, email); len(violations) > 0 {
+		return rejectPassword(violations)
 	}
 
 	exist, err := s.dbe.CheckUserByUsername(req.Username)
 	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "invalid username or password")
+		return apiError(codeInternal, "can't check username")
 	}
 	if exist {
-		return fiber.NewError(fiber.StatusBadRequest, "such user already exists")
+		return apiError(codeUserExists, "such user already exists")
+	}
+	if email != "" {
+		err = s.emailAvailable(email, 0)
+		if errors.Is(err, errEmailUsed) {
+			return apiError(codeEmailTaken, "email is already used")
+		}
+		if err != nil {
+			return apiError(codeInternal, "can't check email")
+		}
 	}
 
-	user, err := s.dbe.CreateUser(req.Username, req.Password)
+	user, err := s.dbe.CreateUser(req.Username, req.Password, email)
+	if errors.Is(err, errDuplicate) {
+		return apiError(codeUserExists, "such user already exists")
+	}
 	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "can't create such user")
+		return apiError(codeInternal, "can't create such user")
 	}
+	if email != "" {
+		if err := s.sendEmailVerification(user, email); err != nil {
+			log.Printf("can't send verification to user %d: %s", user.Id, err)
+		}
+	}
+
+	return s.signUpResponse(c, user)
+}
 
-	info := UserInfo{Username: user.Username, Id: user.Id}
+// HandleChangeUsername renames signed-in user. Issued access tokens keep
+// old username until they expire, refreshed ones carry the new one
+func (s *Server) HandleChangeUsername(c *fiber.Ctx) error {
+	log.Printf("handle change username at %s", c.Path())
 
-	response, err := s.refreshToken(info)
+	var req usernameChangeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apiError(codeInvalidRequest, "expect current password and username")
+	}
+	if err := validate.Struct(req); err != nil {
+		return validationError(err)
+	}
+
+	user, err := s.currentUser(c, req.CurrentPassword)
 	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "error while create tokens")
+		return err
 	}
-	return c.JSON(response)
+	if user.Username == req.Username {
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+	err = s.dbe.ChangeUsername(user.Id, req.Username)
+	if errors.Is(err, errDuplicate) {
+		return apiError(codeUserExists, "such user already exists")
+	}
+	if err != nil {
+		return apiError(codeInternal, "can't change username")
+	}
+
+	s.securityEvent(c, securityEventUsernameChange, user.Id, userClaims(c).SessionId,
+		fmt.Sprintf("username changed from %q to %q", user.Username, req.Username))
+	return c.SendStatus(fiber.StatusNoContent)
 }
 
 func (s *Server) HandleAuthValidate(c *fiber.Ctx) error {
@@ -92,20 +268,17 @@ func (s *Server) HandleAuthValidate(c *fiber.Ctx) error {
 
 	var req AuthRequest
 	if err := c.BodyParser(&req); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "expect jwt")
+		return apiError(codeInvalidRequest, "expect jwt")
 	}
 	if err := validate.Struct(req); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "validation error")
+		return validationError(err)
 	}
 
-	user, err := ParseJWT(req.JWT, s.verifyKey)
+	claims, err := s.authenticate(req.JWT)
 	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "error while validate jwt")
+		return tokenError(err, tokenUseAccess)
 	}
-	if err = validate.Struct(user); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "error while validate jwt")
-	}
-	return c.JSON(user)
+	return c.JSON(claims.UserInfo)
 }
 
 func (s *Server) HandleAuthRefresh(c *fiber.Ctx) error {
@@ -113,31 +286,26 @@ func (s *Server) HandleAuthRefresh(c *fiber.Ctx) error {
 
 	var req RefreshRequest
 	if err := c.BodyParser(&req); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "expect refresh token")
+		return apiError(codeInvalidRequest, "expect refresh token")
 	}
 	if err := validate.Struct(req); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "validation error")
+		return validationError(err)
 	}
 
-	user, err := ParseJWT(req.RefreshToken, s.verifyKey)
-	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "error while validate jwt")
+	session, parentId, err := s.useRefreshToken(c, req.RefreshToken, "")
+	if errors.Is(err, errRefreshTokenReused) {
+		return apiError(codeTokenRevoked, err.Error())
 	}
-	if err = validate.Struct(user); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "error while validate jwt")
+	if errors.Is(err, errRefreshTokenInvalid) {
+		return apiError(codeTokenInvalid, err.Error())
 	}
-
-	userModel, err := s.dbe.GetUserById(user.Id)
 	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "can't find user")
-	}
-	if userModel.RefreshToken != req.RefreshToken {
-		return fiber.NewError(fiber.StatusBadRequest, "invalid refresh token")
+		return apiError(codeInternal, "can't rotate refresh token")
 	}
 
-	response, err := s.refreshToken(user)
+	response, err := s.refreshSessionTokens(session, session.Scope, parentId)
 	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "error while create tokens")
+		return apiError(codeInternal, "error while create tokens")
 	}
 
 	return c.JSON(response)
@@ -149,18 +317,18 @@ func (s *Server) HandleGetUser(c *fiber.Ctx) error {
 	var req userGetRequest
 	userId, err := strconv.Atoi(c.Params("userId", "not a number"))
 	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "expect userId")
+		return apiError(codeInvalidRequest, "expect userId")
 	}
 	req.Id = uint(userId)
 
 	if err := validate.Struct(req); err != nil {
 		log.Printf(err.Error())
-		return fiber.NewError(fiber.StatusBadRequest, "validation error")
+		return validationError(err)
 	}
 
 	user, err := s.dbe.GetUserById(req.Id)
 	if err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "no such user")
+		return apiError(codeNotFound, "no such user")
 	}
 
 	info := UserResponse{Id: user.Id, Username: user.Username}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"strings"
+	"time"
+)
+
+// WebAuthn ceremonies keep their challenge in signed single use tokens
+const (
+	tokenUseWebAuthnRegistration   = "webauthn_registration"
+	tokenUseWebAuthnAuthentication = "webauthn_authentication"
+	webAuthnCeremonyTTL            = 5 * time.Minute
+	webAuthnMaxCredentialIdLength  = 1023
+)
+
+// Flags of authenticator data
+const (
+	authDataUserPresent  = 0x01
+	authDataUserVerified = 0x04
+	authDataAttested     = 0x40
+)
+
+var errWebAuthn = errors.New("webauthn verification failed")
+
+// WebAuthnConfig describes relying party, that is this server and frontends using it
+type WebAuthnConfig struct {
+	RPId   string
+	RPName string
+	// Origins are allowed origins of client data, like https://tma.example.com
+	Origins []string
+}
+
+// webAuthnAlgorithms are credential algorithms in order of preference
+var webAuthnAlgorithms = []int64{coseAlgES256, coseAlgEdDSA, coseAlgRS256}
+
+// WebAuthnClaims are claims of ceremony token, UserId is set for registration only
+type WebAuthnClaims struct {
+	*jwt.StandardClaims
+	TokenUse  string `json:"token_use"`
+	Challenge string `json:"challenge"`
+	UserId    uint   `json:"uid,omitempty"`
+}
+
+func (wc *WebAuthnClaims) standard() *jwt.StandardClaims {
+	return wc.StandardClaims
+}
+
+func (wc *WebAuthnClaims) use() string {
+	return wc.TokenUse
+}
+
+// generateWebAuthnCeremony makes random challenge and token carrying it
+func generateWebAuthnCeremony(tokenUse string, userId uint, tc *TokenConfig) (string, string, error) {
+	challenge, err := newOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+	token := jwt.New(jwt.GetSigningMethod("RS256"))
+	token.Claims = &WebAuthnClaims{
+		tc.standardClaims(tokenUse, webAuthnCeremonyTTL),
+		tokenUse,
+		challenge,
+		userId,
+	}
+	signed, err := signToken(token, tokenUse, tc)
+	return challenge, signed, err
+}
+
+func parseWebAuthnCeremony(tokenString string, tokenUse string, tc *TokenConfig) (*WebAuthnClaims, error) {
+	claims := &WebAuthnClaims{StandardClaims: &jwt.StandardClaims{}}
+	if err := parseClaims(tokenString, claims, tokenUse, tc); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// decodeWebAuthnBytes accepts base64url with or without padding, as browsers encode ArrayBuffers
+func decodeWebAuthnBytes(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+type collectedClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// verifyClientData checks ceremony type, challenge and origin of clientDataJSON
+func (wc *WebAuthnConfig) verifyClientData(clientDataJSON []byte, ceremonyType string, challenge string) error {
+	var clientData collectedClientData
+	if err := json.Unmarshal(clientDataJSON, &clientData); err != nil {
+		return fmt.Errorf("%w: malformed client data", errWebAuthn)
+	}
+	if clientData.Type != ceremonyType {
+		return fmt.Errorf("%w: unexpected client data type %q", errWebAuthn, clientData.Type)
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.TrimRight(clientData.Challenge, "=")), []byte(challenge)) != 1 {
+		return fmt.Errorf("%w: challenge mismatch", errWebAuthn)
+	}
+	if clientData.CrossOrigin {
+		return fmt.Errorf("%w: cross-origin ceremony", errWebAuthn)
+	}
+	for _, origin := range wc.Origins {
+		if clientData.Origin == origin {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: origin %q is not allowed", errWebAuthn, clientData.Origin)
+}
+
+type authenticatorData struct {
+	RPIdHash  []byte
+	Flags     byte
+	SignCount uint32
+	// attested credential data, present in registration only
+	AAGUID       []byte
+	CredentialId []byte
+	Credential   *COSEKey
+	// CredentialKey is COSE encoded Credential
+	CredentialKey []byte
+}
+
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, fmt.Errorf("%w: authenticator data is too short", errWebAuthn)
+	}
+	authData := &authenticatorData{
+		RPIdHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if authData.Flags&authDataAttested == 0 {
+		return authData, nil
+	}
+
+	rest := data[37:]
+	if len(rest) < 18 {
+		return nil, fmt.Errorf("%w: attested credential data is too short", errWebAuthn)
+	}
+	authData.AAGUID = rest[:16]
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLength > webAuthnMaxCredentialIdLength || idLength > len(rest) {
+		return nil, fmt.Errorf("%w: invalid credential id length", errWebAuthn)
+	}
+	authData.CredentialId = rest[:idLength]
+	rest = rest[idLength:]
+
+	credential, extensions, err := parseCOSEKey(rest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errWebAuthn, err)
+	}
+	authData.Credential = credential
+	authData.CredentialKey = rest[:len(rest)-len(extensions)]
+	return authData, nil
+}
+
+// verifyAuthenticatorData checks relying party and user presence and verification flags
+func (wc *WebAuthnConfig) verifyAuthenticatorData(authData *authenticatorData) error {
+	rpIdHash := sha256.Sum256([]byte(wc.RPId))
+	if !bytes.Equal(authData.RPIdHash, rpIdHash[:]) {
+		return fmt.Errorf("%w: relying party mismatch", errWebAuthn)
+	}
+	if authData.Flags&authDataUserPresent == 0 {
+		return fmt.Errorf("%w: user is not present", errWebAuthn)
+	}
+	// passkeys replace both password and second factor, so user verification is required
+	if authData.Flags&authDataUserVerified == 0 {
+		return fmt.Errorf("%w: user is not verified", errWebAuthn)
+	}
+	return nil
+}
+
+// verifyCOSESignature checks signature made with credential algorithm
+func verifyCOSESignature(alg int64, publicKey crypto.PublicKey, message []byte, signature []byte) error {
+	switch alg {
+	case coseAlgES256:
+		key, ok := publicKey.(*ecdsa.PublicKey)
+		digest := sha256.Sum256(message)
+		if ok && ecdsa.VerifyASN1(key, digest[:], signature) {
+			return nil
+		}
+	case coseAlgEdDSA:
+		key, ok := publicKey.(ed25519.PublicKey)
+		if ok && ed25519.Verify(key, message, signature) {
+			return nil
+		}
+	case coseAlgRS256:
+		key, ok := publicKey.(*rsa.PublicKey)
+		digest := sha256.Sum256(message)
+		if ok && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: invalid signature", errWebAuthn)
+}
+
+// signCountRegressed tells counter which doesn't grow, that means authenticator may be cloned.
+// Authenticators without counter always present zero
+func signCountRegressed(presented uint32, stored int64) bool {
+	return (presented != 0 || stored != 0) && int64(presented) <= stored
+}
+
+// RegisteredCredential is credential verified by registration ceremony
+type RegisteredCredential struct {
+	Id        []byte
+	PublicKey []byte
+	SignCount uint32
+	AAGUID    []byte
+	// Attestation is attestation statement format, "none" or "packed"
+	Attestation string
+}
+
+// VerifyRegistration runs registration ceremony checks of WebAuthn Level 2 §7.1.
+// Attestation statements are verified, but their certificates are not trusted
+// against metadata, since only authenticator possession matters for sign-in
+func (wc *WebAuthnConfig) VerifyRegistration(challenge string, clientDataJSON []byte, attestationObject []byte) (*RegisteredCredential, error) {
+	if err := wc.verifyClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	item, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errWebAuthn, err)
+	}
+	attestation, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: attestation object is not a map", errWebAuthn)
+	}
+	format, _ := attestation["fmt"].(string)
+	statement, _ := attestation["attStmt"].(map[interface{}]interface{})
+	rawAuthData, _ := attestation["authData"].([]byte)
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err := wc.verifyAuthenticatorData(authData); err != nil {
+		return nil, err
+	}
+	if authData.Credential == nil {
+		return nil, fmt.Errorf("%w: no attested credential", errWebAuthn)
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	if err := verifyAttestationStatement(format, statement, rawAuthData, clientDataHash[:], authData.Credential); err != nil {
+		return nil, err
+	}
+
+	return &RegisteredCredential{
+		Id:          authData.CredentialId,
+		PublicKey:   authData.CredentialKey,
+		SignCount:   authData.SignCount,
+		AAGUID:      authData.AAGUID,
+		Attestation: format,
+	}, nil
+}
+
+// verifyAttestationStatement supports "none" and "packed" formats, the latter either
+// self attested with credential key or signed by attestation certificate
+func verifyAttestationStatement(format string, statement map[interface{}]interface{}, authData []byte, clientDataHash []byte, credential *COSEKey) error {
+	switch format {
+	case "none":
+		if len(statement) != 0 {
+			return fmt.Errorf("%w: none attestation has statement", errWebAuthn)
+		}
+		return nil
+	case "packed":
+		alg, _ := statement["alg"].(int64)
+		signature, _ := statement["sig"].([]byte)
+		signed := append(append([]byte{}, authData...), clientDataHash...)
+
+		chain, hasChain := statement["x5c"].([]interface{})
+		if !hasChain {
+			if alg != credential.Alg {
+				return fmt.Errorf("%w: self attestation algorithm mismatch", errWebAuthn)
+			}
+			return verifyCOSESignature(alg, credential.PublicKey, signed, signature)
+		}
+		if len(chain) == 0 {
+			return fmt.Errorf("%w: empty attestation certificate chain", errWebAuthn)
+		}
+		der, _ := chain[0].([]byte)
+		certificate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("%w: invalid attestation certificate", errWebAuthn)
+		}
+		return verifyCOSESignature(alg, certificate.PublicKey, signed, signature)
+	default:
+		return fmt.Errorf("%w: unsupported attestation format %q", errWebAuthn, format)
+	}
+}
+
+// VerifyAssertion runs authentication ceremony checks of WebAuthn Level 2 §7.2
+// against stored COSE credential key and returns new signature counter
+func (wc *WebAuthnConfig) VerifyAssertion(challenge string, credentialKey []byte, clientDataJSON []byte, rawAuthData []byte, signature []byte) (uint32, error) {
+	if err := wc.verifyClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return 0, err
+	}
+	if err := wc.verifyAuthenticatorData(authData); err != nil {
+		return 0, err
+	}
+
+	credential, _, err := parseCOSEKey(credentialKey)
+	if err != nil {
+		return 0, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	if err := verifyCOSESignature(credential.Alg, credential.PublicKey, signed, signature); err != nil {
+		return 0, err
+	}
+	return authData.SignCount, nil
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+const (
+	testRPId      = "tma.example.com"
+	testOrigin    = "https://tma.example.com"
+	testChallenge = "c2lnbi1tZS1pbi1wbGVhc2U"
+)
+
+var testWebAuthn = &WebAuthnConfig{RPId: testRPId, RPName: "tma", Origins: []string{testOrigin}}
+
+// cborMap keeps order of map entries, so encoded keys look like the ones of authenticators
+type cborMap []cborPair
+
+type cborPair struct {
+	Key   interface{}
+	Value interface{}
+}
+
+func cborHeadBytes(major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg <= 0xff:
+		return []byte{major<<5 | 24, byte(arg)}
+	case arg <= 0xffff:
+		head := []byte{major<<5 | 25, 0, 0}
+		binary.BigEndian.PutUint16(head[1:], uint16(arg))
+		return head
+	default:
+		head := []byte{major<<5 | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(head[1:], uint32(arg))
+		return head
+	}
+}
+
+// encodeCBOR is counterpart of decodeCBOR for items software authenticator needs
+func encodeCBOR(item interface{}) []byte {
+	switch value := item.(type) {
+	case int:
+		if value < 0 {
+			return cborHeadBytes(1, uint64(-1-value))
+		}
+		return cborHeadBytes(0, uint64(value))
+	case int64:
+		return encodeCBOR(int(value))
+	case []byte:
+		return append(cborHeadBytes(2, uint64(len(value))), value...)
+	case string:
+		return append(cborHeadBytes(3, uint64(len(value))), value...)
+	case []interface{}:
+		data := cborHeadBytes(4, uint64(len(value)))
+		for _, element := range value {
+			data = append(data, encodeCBOR(element)...)
+		}
+		return data
+	case cborMap:
+		data := cborHeadBytes(5, uint64(len(value)))
+		for _, pair := range value {
+			data = append(data, encodeCBOR(pair.Key)...)
+			data = append(data, encodeCBOR(pair.Value)...)
+		}
+		return data
+	default:
+		panic("can't encode cbor item")
+	}
+}
+
+// softAuthenticator is WebAuthn authenticator keeping its credential in memory
+type softAuthenticator struct {
+	alg          int64
+	ecKey        *ecdsa.PrivateKey
+	edKey        ed25519.PrivateKey
+	credentialId []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T, alg int64) *softAuthenticator {
+	t.Helper()
+	a := &softAuthenticator{alg: alg, credentialId: make([]byte, 16)}
+	if _, err := rand.Read(a.credentialId); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	switch alg {
+	case coseAlgES256:
+		a.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case coseAlgEdDSA:
+		_, a.edKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		t.Fatalf("unsupported algorithm %d", alg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	if a.alg == coseAlgES256 {
+		x := a.ecKey.X.FillBytes(make([]byte, 32))
+		y := a.ecKey.Y.FillBytes(make([]byte, 32))
+		return encodeCBOR(cborMap{
+			{coseKeyKty, coseKtyEC2},
+			{coseKeyAlg, coseAlgES256},
+			{coseKeyCrv, coseCrvP256},
+			{coseKeyX, x},
+			{coseKeyY, y},
+		})
+	}
+	return encodeCBOR(cborMap{
+		{coseKeyKty, coseKtyOKP},
+		{coseKeyAlg, coseAlgEdDSA},
+		{coseKeyCrv, coseCrvEd25519},
+		{coseKeyX, []byte(a.edKey.Public().(ed25519.PublicKey))},
+	})
+}
+
+func (a *softAuthenticator) sign(t *testing.T, message []byte) []byte {
+	t.Helper()
+	if a.alg == coseAlgEdDSA {
+		return ed25519.Sign(a.edKey, message)
+	}
+	digest := sha256.Sum256(message)
+	signature, err := ecdsa.SignASN1(rand.Reader, a.ecKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+// authData makes authenticator data, with attested credential data when attested is set
+func (a *softAuthenticator) authData(rpId string, flags byte, attested bool) []byte {
+	rpIdHash := sha256.Sum256([]byte(rpId))
+	data := append([]byte{}, rpIdHash[:]...)
+	if attested {
+		flags |= authDataAttested
+	}
+	data = append(data, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.signCount)
+	if !attested {
+		return data
+	}
+	data = append(data, make([]byte, 18)...)
+	binary.BigEndian.PutUint16(data[53:], uint16(len(a.credentialId)))
+	data = append(data, a.credentialId...)
+	return append(data, a.coseKey()...)
+}
+
+func testClientData(ceremonyType string, challenge string, origin string) []byte {
+	data, _ := json.Marshal(collectedClientData{Type: ceremonyType, Challenge: challenge, Origin: origin})
+	return data
+}
+
+// attest makes attestation object of "none" or self attested "packed" format
+func (a *softAuthenticator) attest(t *testing.T, format string, authData []byte, clientDataJSON []byte) []byte {
+	t.Helper()
+	statement := cborMap{}
+	if format == "packed" {
+		clientDataHash := sha256.Sum256(clientDataJSON)
+		signature := a.sign(t, append(append([]byte{}, authData...), clientDataHash[:]...))
+		statement = cborMap{{"alg", a.alg}, {"sig", signature}}
+	}
+	return encodeCBOR(cborMap{
+		{"fmt", format},
+		{"attStmt", statement},
+		{"authData", authData},
+	})
+}
+
+// assert makes assertion and returns its client data, authenticator data and signature
+func (a *softAuthenticator) assert(t *testing.T, rpId string, flags byte, challenge string, origin string) ([]byte, []byte, []byte) {
+	t.Helper()
+	a.signCount++
+	clientDataJSON := testClientData("webauthn.get", challenge, origin)
+	authData := a.authData(rpId, flags, false)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	return clientDataJSON, authData, a.sign(t, append(append([]byte{}, authData...), clientDataHash[:]...))
+}
+
+var testAuthenticatorAlgorithms = map[string]int64{"ES256": coseAlgES256, "Ed25519": coseAlgEdDSA}
+
+func TestVerifyRegistration(t *testing.T) {
+	for name, alg := range testAuthenticatorAlgorithms {
+		for _, format := range []string{"none", "packed"} {
+			t.Run(name+"/"+format, func(t *testing.T) {
+				authenticator := newSoftAuthenticator(t, alg)
+				clientDataJSON := testClientData("webauthn.create", testChallenge, testOrigin)
+				authData := authenticator.authData(testRPId, authDataUserPresent|authDataUserVerified, true)
+				attestation := authenticator.attest(t, format, authData, clientDataJSON)
+
+				registered, err := testWebAuthn.VerifyRegistration(testChallenge, clientDataJSON, attestation)
+				if err != nil {
+					t.Fatalf("registration failed: %s", err)
+				}
+				if !bytes.Equal(registered.Id, authenticator.credentialId) {
+					t.Errorf("credential id %x, want %x", registered.Id, authenticator.credentialId)
+				}
+				if !bytes.Equal(registered.PublicKey, authenticator.coseKey()) {
+					t.Errorf("public key %x, want %x", registered.PublicKey, authenticator.coseKey())
+				}
+				if registered.Attestation != format {
+					t.Errorf("attestation %q, want %q", registered.Attestation, format)
+				}
+			})
+		}
+	}
+}
+
+func TestVerifyRegistrationRejects(t *testing.T) {
+	authenticator := newSoftAuthenticator(t, coseAlgES256)
+	flags := byte(authDataUserPresent | authDataUserVerified)
+	clientDataJSON := testClientData("webauthn.create", testChallenge, testOrigin)
+	authData := authenticator.authData(testRPId, flags, true)
+	attestation := authenticator.attest(t, "packed", authData, clientDataJSON)
+
+	// self attestation signed by key other than attested credential
+	other := newSoftAuthenticator(t, coseAlgES256)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	forged := encodeCBOR(cborMap{
+		{"fmt", "packed"},
+		{"attStmt", cborMap{{"alg", coseAlgES256}, {"sig", other.sign(t, append(append([]byte{}, authData...), clientDataHash[:]...))}}},
+		{"authData", authData},
+	})
+
+	tests := []struct {
+		name           string
+		challenge      string
+		clientDataJSON []byte
+		attestation    []byte
+	}{
+		{"wrong challenge", "b3RoZXItY2hhbGxlbmdl", clientDataJSON, authenticator.attest(t, "none", authData, clientDataJSON)},
+		{"wrong ceremony", testChallenge, testClientData("webauthn.get", testChallenge, testOrigin), authenticator.attest(t, "none", authData, clientDataJSON)},
+		{"wrong origin", testChallenge, testClientData("webauthn.create", testChallenge, "https://evil.example.com"), authenticator.attest(t, "none", authData, clientDataJSON)},
+		{"wrong rp id", testChallenge, clientDataJSON, authenticator.attest(t, "none", authenticator.authData("evil.example.com", flags, true), clientDataJSON)},
+		{"user not verified", testChallenge, clientDataJSON, authenticator.attest(t, "none", authenticator.authData(testRPId, authDataUserPresent, true), clientDataJSON)},
+		{"no attested credential", testChallenge, clientDataJSON, authenticator.attest(t, "none", authenticator.authData(testRPId, flags, false), clientDataJSON)},
+		{"self attestation of other key", testChallenge, clientDataJSON, forged},
+		{"invalid signature", testChallenge, clientDataJSON, encodeCBOR(cborMap{
+			{"fmt", "packed"},
+			{"attStmt", cborMap{{"alg", coseAlgES256}, {"sig", []byte{0x30, 0x00}}}},
+			{"authData", authData},
+		})},
+		{"unsupported format", testChallenge, clientDataJSON, encodeCBOR(cborMap{
+			{"fmt", "fido-u2f"},
+			{"attStmt", cborMap{}},
+			{"authData", authData},
+		})},
+		{"truncated attestation", testChallenge, clientDataJSON, attestation[:len(attestation)/2]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := testWebAuthn.VerifyRegistration(tt.challenge, tt.clientDataJSON, tt.attestation); !errors.Is(err, errWebAuthn) {
+				t.Errorf("got %v, want webauthn verification error", err)
+			}
+		})
+	}
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	for name, alg := range testAuthenticatorAlgorithms {
+		t.Run(name, func(t *testing.T) {
+			authenticator := newSoftAuthenticator(t, alg)
+			authenticator.signCount = 41
+			clientDataJSON, authData, signature := authenticator.assert(t, testRPId, authDataUserPresent|authDataUserVerified, testChallenge, testOrigin)
+
+			signCount, err := testWebAuthn.VerifyAssertion(testChallenge, authenticator.coseKey(), clientDataJSON, authData, signature)
+			if err != nil {
+				t.Fatalf("assertion failed: %s", err)
+			}
+			if signCount != 42 {
+				t.Errorf("sign count %d, want 42", signCount)
+			}
+		})
+	}
+}
+
+func TestVerifyAssertionRejects(t *testing.T) {
+	authenticator := newSoftAuthenticator(t, coseAlgEdDSA)
+	flags := byte(authDataUserPresent | authDataUserVerified)
+
+	tests := []struct {
+		name      string
+		rpId      string
+		flags     byte
+		challenge string
+		origin    string
+		tamper    func(clientDataJSON, authData, signature []byte) ([]byte, []byte, []byte)
+	}{
+		{name: "wrong challenge", rpId: testRPId, flags: flags, challenge: "b3RoZXItY2hhbGxlbmdl", origin: testOrigin},
+		{name: "wrong origin", rpId: testRPId, flags: flags, challenge: testChallenge, origin: "https://tma.example.com.evil.example"},
+		{name: "wrong rp id", rpId: "example.com", flags: flags, challenge: testChallenge, origin: testOrigin},
+		{name: "user not verified", rpId: testRPId, flags: authDataUserPresent, challenge: testChallenge, origin: testOrigin},
+		{name: "user not present", rpId: testRPId, flags: authDataUserVerified, challenge: testChallenge, origin: testOrigin},
+		{name: "cleared uv flag of signed data", rpId: testRPId, flags: flags, challenge: testChallenge, origin: testOrigin,
+			tamper: func(clientDataJSON, authData, signature []byte) ([]byte, []byte, []byte) {
+				authData = append([]byte{}, authData...)
+				authData[32] &^= authDataUserVerified
+				return clientDataJSON, authData, signature
+			}},
+		{name: "raised sign count", rpId: testRPId, flags: flags, challenge: testChallenge, origin: testOrigin,
+			tamper: func(clientDataJSON, authData, signature []byte) ([]byte, []byte, []byte) {
+				authData = append([]byte{}, authData...)
+				binary.BigEndian.PutUint32(authData[33:37], 1<<31)
+				return clientDataJSON, authData, signature
+			}},
+		{name: "truncated authenticator data", rpId: testRPId, flags: flags, challenge: testChallenge, origin: testOrigin,
+			tamper: func(clientDataJSON, authData, signature []byte) ([]byte, []byte, []byte) {
+				return clientDataJSON, authData[:36], signature
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientDataJSON, authData, signature := authenticator.assert(t, tt.rpId, tt.flags, tt.challenge, tt.origin)
+			if tt.tamper != nil {
+				clientDataJSON, authData, signature = tt.tamper(clientDataJSON, authData, signature)
+			}
+			if _, err := testWebAuthn.VerifyAssertion(testChallenge, authenticator.coseKey(), clientDataJSON, authData, signature); err == nil {
+				t.Error("assertion is accepted")
+			}
+		})
+	}
+
+	t.Run("key of other credential", func(t *testing.T) {
+		other := newSoftAuthenticator(t, coseAlgEdDSA)
+		clientDataJSON, authData, signature := authenticator.assert(t, testRPId, flags, testChallenge, testOrigin)
+		if _, err := testWebAuthn.VerifyAssertion(testChallenge, other.coseKey(), clientDataJSON, authData, signature); !errors.Is(err, errWebAuthn) {
+			t.Errorf("got %v, want webauthn verification error", err)
+		}
+	})
+}
+
+func TestSignCountRegressed(t *testing.T) {
+	tests := []struct {
+		presented uint32
+		stored    int64
+		regressed bool
+	}{
+		{0, 0, false},
+		{1, 0, false},
+		{8, 7, false},
+		{7, 7, true},
+		{6, 7, true},
+		{0, 7, true},
+	}
+	for _, tt := range tests {
+		if regressed := signCountRegressed(tt.presented, tt.stored); regressed != tt.regressed {
+			t.Errorf("signCountRegressed(%d, %d) = %t, want %t", tt.presented, tt.stored, regressed, tt.regressed)
+		}
+	}
+}
+
+func TestDecodeCBORMalformed(t *testing.T) {
+	deep := bytes.Repeat([]byte{0x81}, cborMaxDepth+2)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated head", []byte{0x19, 0x01}},
+		{"truncated bytes", []byte{0x45, 0x01, 0x02}},
+		{"huge bytes length", []byte{0x5b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"huge array length", []byte{0x9b, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00}},
+		{"huge map length", []byte{0xba, 0xff, 0xff, 0xff, 0xff, 0x01, 0x02}},
+		{"truncated map", []byte{0xa2, 0x01, 0x02, 0x03}},
+		{"integer overflow", []byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"negative overflow", []byte{0x3b, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{"indefinite length", []byte{0x5f, 0x41, 0x00, 0xff}},
+		{"reserved head", []byte{0x1c}},
+		{"float", []byte{0xf9, 0x3c, 0x00}},
+		{"tag", []byte{0xc2, 0x41, 0x01}},
+		{"duplicate key", []byte{0xa2, 0x01, 0x02, 0x01, 0x03}},
+		{"bytes key", []byte{0xa1, 0x41, 0x01, 0x02}},
+		{"array key", []byte{0xa1, 0x80, 0x02}},
+		{"nested too deep", append(deep, 0x00)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := decodeCBOR(tt.data); !errors.Is(err, errCBOR) {
+				t.Errorf("got %v, want malformed cbor error", err)
+			}
+		})
+	}
+}
+
+func TestParseCOSEKeyTruncated(t *testing.T) {
+	for name, alg := range testAuthenticatorAlgorithms {
+		t.Run(name, func(t *testing.T) {
+			key := newSoftAuthenticator(t, alg).coseKey()
+			for i := 0; i < len(key); i++ {
+				if _, _, err := parseCOSEKey(key[:i]); err == nil {
+					t.Fatalf("key truncated to %d bytes is accepted", i)
+				}
+			}
+			if _, rest, err := parseCOSEKey(key); err != nil || len(rest) != 0 {
+				t.Fatalf("got rest %x and %v, want whole key parsed", rest, err)
+			}
+		})
+	}
+}
+
+func TestParseCOSEKeyMalicious(t *testing.T) {
+	authenticator := newSoftAuthenticator(t, coseAlgES256)
+	x := authenticator.ecKey.X.FillBytes(make([]byte, 32))
+	y := authenticator.ecKey.Y.FillBytes(make([]byte, 32))
+	offCurve := append([]byte{}, y...)
+	offCurve[31] ^= 0x01
+
+	tests := []struct {
+		name string
+		key  []byte
+	}{
+		{"not a map", encodeCBOR([]interface{}{coseKtyEC2, coseAlgES256})},
+		{"point off curve", encodeCBOR(cborMap{{coseKeyKty, coseKtyEC2}, {coseKeyAlg, coseAlgES256}, {coseKeyCrv, coseCrvP256}, {coseKeyX, x}, {coseKeyY, offCurve}})},
+		{"short coordinate", encodeCBOR(cborMap{{coseKeyKty, coseKtyEC2}, {coseKeyAlg, coseAlgES256}, {coseKeyCrv, coseCrvP256}, {coseKeyX, x[1:]}, {coseKeyY, y}})},
+		{"missing coordinate", encodeCBOR(cborMap{{coseKeyKty, coseKtyEC2}, {coseKeyAlg, coseAlgES256}, {coseKeyCrv, coseCrvP256}, {coseKeyX, x}})},
+		{"wrong curve", encodeCBOR(cborMap{{coseKeyKty, coseKtyEC2}, {coseKeyAlg, coseAlgES256}, {coseKeyCrv, 2}, {coseKeyX, x}, {coseKeyY, y}})},
+		{"coordinate of wrong type", encodeCBOR(cborMap{{coseKeyKty, coseKtyEC2}, {coseKeyAlg, coseAlgES256}, {coseKeyCrv, coseCrvP256}, {coseKeyX, "x"}, {coseKeyY, y}})},
+		{"algorithm of other key type", encodeCBOR(cborMap{{coseKeyKty, coseKtyOKP}, {coseKeyAlg, coseAlgES256}, {coseKeyCrv, coseCrvEd25519}, {coseKeyX, x}})},
+		{"short ed25519 key", encodeCBOR(cborMap{{coseKeyKty, coseKtyOKP}, {coseKeyAlg, coseAlgEdDSA}, {coseKeyCrv, coseCrvEd25519}, {coseKeyX, x[:31]}})},
+		{"short rsa modulus", encodeCBOR(cborMap{{coseKeyKty, coseKtyRSA}, {coseKeyAlg, coseAlgRS256}, {coseKeyN, x}, {coseKeyE, []byte{0x01, 0x00, 0x01}}})},
+		{"unsupported algorithm", encodeCBOR(cborMap{{coseKeyKty, coseKtyEC2}, {coseKeyAlg, -35}, {coseKeyCrv, 2}, {coseKeyX, x}, {coseKeyY, y}})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := parseCOSEKey(tt.key); err == nil {
+				t.Error("key is accepted")
+			}
+		})
+	}
+}